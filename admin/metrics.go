@@ -0,0 +1,10 @@
+package admin
+
+import (
+	"github.com/thyth/hive/metrics"
+)
+
+var (
+	unauthorizedRequests = metrics.Default.NewCounter("hive_admin_unauthorized_total",
+		"Admin API requests refused for lacking a valid bearer token, by method.", "method")
+)
@@ -0,0 +1,389 @@
+package admin
+
+import (
+	"github.com/thyth/hive/audit"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/hive"
+	"github.com/thyth/hive/logging"
+
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var adminLog = logging.For("admin")
+
+// defaultZoneName names the default zone in request paths, as it has no suffix of its own.
+const defaultZoneName = "default"
+
+// maxBodySize bounds the size of a request body.
+const maxBodySize = 64 * 1024
+
+// Server serves the HTTP administration API of an engine.
+type Server struct {
+	engine *hive.Engine
+	token  string
+	http   *http.Server
+}
+
+// ZoneSummary summarizes a zone held by the engine, as listed by GET /zones.
+type ZoneSummary struct {
+	Role         string `json:"role"` // primary, peer, default or rendezvous
+	Name         string `json:"name"`
+	Server       string `json:"server,omitempty"`
+	Serial       uint32 `json:"serial"`
+	ARecords     int    `json:"aRecords"`
+	CNAMERecords int    `json:"cnameRecords"`
+	State        string `json:"state,omitempty"` // of a peer zone's server
+	Withdrawn    bool   `json:"withdrawn,omitempty"`
+}
+
+// Record is an A, AAAA or CNAME record of a zone.
+type Record struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Address string `json:"address,omitempty"`
+	Target  string `json:"target,omitempty"`
+}
+
+// ZoneRecords lists the records of a zone, as given by GET /zones/{name}.
+type ZoneRecords struct {
+	Name    string    `json:"name"`
+	Serial  uint32    `json:"serial"`
+	Records []*Record `json:"records"`
+}
+
+// Candidate is a host a rendezvous name may point to, as given by GET /names/{name}.
+type Candidate struct {
+	Zone      string  `json:"zone"`
+	Target    string  `json:"target"`
+	Withdrawn bool    `json:"withdrawn"`
+	Probed    bool    `json:"probed"`
+	Reachable bool    `json:"reachable"`
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+}
+
+// Decision explains how a rendezvous name is merged, as given by GET /names/{name}.
+type Decision struct {
+	Name       string       `json:"name"`
+	Candidates []*Candidate `json:"candidates"`
+	Override   string       `json:"override,omitempty"`
+	Default    string       `json:"default,omitempty"`
+	Target     string       `json:"target,omitempty"`  // as merged
+	Current    string       `json:"current,omitempty"` // as held in the rendezvous zone
+}
+
+// Override is the body of PUT /overrides/{name}.
+type Override struct {
+	Target string `json:"target"`
+}
+
+// PlannedUpdate is an update to the primary planned in dry-run mode, as listed by GET /plan.
+type PlannedUpdate struct {
+	Time     time.Time `json:"time"`
+	Zone     string    `json:"zone"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	Record   string    `json:"record"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Start binds the administration API's listener and serves it in the background, until shut down.
+func Start(config *conf.Admin, engine *hive.Engine) (*Server, error) {
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", config.Listen, err)
+	}
+	s := &Server{
+		engine: engine,
+		token:  config.Token,
+	}
+	s.http = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := s.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			adminLog.Error("admin API failed", logging.Error, err)
+		}
+	}()
+	adminLog.Info("admin API listening", logging.Address, listener.Addr().String())
+	return s, nil
+}
+
+// Shutdown stops accepting requests, and waits for those in flight to complete (or the context to be done).
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// ServeHTTP authenticates a request by its bearer token, then routes it by path and method.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		// anyone able to reach the API can send these, so they are counted rather than audited
+		unauthorizedRequests.Inc(r.Method)
+		adminLog.Debug("unauthorized request refused", logging.Proposer, r.RemoteAddr, "method", r.Method,
+			"path", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hive"`)
+		writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "zones":
+		s.route(w, r, map[string]func(){
+			http.MethodGet: func() { s.listZones(w) },
+		})
+	case len(path) == 2 && path[0] == "zones":
+		s.route(w, r, map[string]func(){
+			http.MethodGet: func() { s.getZone(w, path[1]) },
+		})
+	case len(path) == 3 && path[0] == "zones" && path[2] == "transfer":
+		s.route(w, r, map[string]func(){
+			http.MethodPost: func() { s.transferZone(w, path[1]) },
+		})
+	case len(path) == 2 && path[0] == "names":
+		s.route(w, r, map[string]func(){
+			http.MethodGet: func() { s.explainName(w, path[1]) },
+		})
+	case len(path) == 1 && path[0] == "plan":
+		s.route(w, r, map[string]func(){
+			http.MethodGet: func() { s.listPlan(w) },
+		})
+	case len(path) == 1 && path[0] == "overrides":
+		s.route(w, r, map[string]func(){
+			http.MethodGet: func() { writeJSON(w, http.StatusOK, s.engine.Overrides()) },
+		})
+	case len(path) == 2 && path[0] == "overrides":
+		s.route(w, r, map[string]func(){
+			http.MethodPut:    func() { s.setOverride(w, r, path[1]) },
+			http.MethodDelete: func() { s.deleteOverride(w, r, path[1]) },
+		})
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// authorized determines whether a request carries the configured bearer token, comparing it in constant time.
+func (s *Server) authorized(r *http.Request) bool {
+	const scheme = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return false
+	}
+	token := strings.TrimSpace(header[len(scheme):])
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// route calls the handler for a request's method, or responds that the method is not allowed.
+func (s *Server) route(w http.ResponseWriter, r *http.Request, handlers map[string]func()) {
+	if handler, present := handlers[r.Method]; present {
+		handler()
+		return
+	}
+	var allowed []string
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+}
+
+func (s *Server) listZones(w http.ResponseWriter) {
+	status := s.engine.Status()
+	zones := []*ZoneSummary{
+		zoneSummary("primary", status.Primary),
+	}
+	for _, peer := range status.Peers {
+		summary := zoneSummary("peer", peer)
+		if peer.Liveness != nil {
+			summary.State = peer.Liveness.State.String()
+			summary.Withdrawn = peer.Liveness.Withdrawn
+		}
+		zones = append(zones, summary)
+	}
+	zones = append(zones, zoneSummary("default", status.Default), zoneSummary("rendezvous", status.Rendezvous))
+	writeJSON(w, http.StatusOK, zones)
+}
+
+func zoneSummary(role string, status *hive.ZoneStatus) *ZoneSummary {
+	summary := &ZoneSummary{
+		Role:         role,
+		Name:         status.Name,
+		Serial:       status.Serial,
+		ARecords:     status.ARecords,
+		CNAMERecords: status.CNAMERecords,
+	}
+	if role == "default" {
+		summary.Name = defaultZoneName
+	}
+	if status.Server != nil {
+		summary.Server = status.Server.String()
+	}
+	return summary
+}
+
+func (s *Server) getZone(w http.ResponseWriter, name string) {
+	zoneName := name
+	if name == defaultZoneName {
+		zoneName = ""
+	}
+	snapshot, present := s.engine.ZoneSnapshot(zoneName)
+	if !present {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("zone '%s' unknown", name))
+		return
+	}
+	zone := &ZoneRecords{
+		Name:    name,
+		Serial:  snapshot.Serial,
+		Records: []*Record{},
+	}
+	for _, mapping := range snapshot.Mappings {
+		record := &Record{
+			Name: mapping.Name,
+		}
+		if mapping.IP != nil {
+			record.Type = "A"
+			if mapping.IP.To4() == nil {
+				record.Type = "AAAA"
+			}
+			record.Address = mapping.IP.String()
+		} else {
+			record.Type = "CNAME"
+			record.Target = mapping.Target
+		}
+		zone.Records = append(zone.Records, record)
+	}
+	sort.Slice(zone.Records, func(i, j int) bool {
+		return zone.Records[i].Name < zone.Records[j].Name
+	})
+	writeJSON(w, http.StatusOK, zone)
+}
+
+func (s *Server) transferZone(w http.ResponseWriter, name string) {
+	// the default zone has no server to transfer from
+	if _, present := s.engine.ZoneSnapshot(name); !present || name == defaultZoneName {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("zone '%s' unknown", name))
+		return
+	}
+	if err := s.engine.Retransfer(name); err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	s.getZone(w, name)
+}
+
+func (s *Server) explainName(w http.ResponseWriter, name string) {
+	explained := s.engine.Explain(name)
+	decision := &Decision{
+		Name:       explained.Name,
+		Candidates: []*Candidate{},
+		Override:   explained.Override,
+		Default:    explained.Default,
+		Target:     explained.Target,
+		Current:    explained.Current,
+	}
+	for _, candidate := range explained.Candidates {
+		decision.Candidates = append(decision.Candidates, &Candidate{
+			Zone:      candidate.Zone,
+			Target:    candidate.Target,
+			Withdrawn: candidate.Withdrawn,
+			Probed:    candidate.Probed,
+			Reachable: candidate.Reachable,
+			LatencyMs: float64(candidate.Latency) / float64(time.Millisecond),
+		})
+	}
+	writeJSON(w, http.StatusOK, decision)
+}
+
+func (s *Server) listPlan(w http.ResponseWriter) {
+	plan := []*PlannedUpdate{}
+	for _, update := range s.engine.PlannedUpdates() {
+		plan = append(plan, &PlannedUpdate{
+			Time:     update.Time,
+			Zone:     update.Zone,
+			Name:     update.Name,
+			Type:     update.Type,
+			Action:   update.Action,
+			Target:   update.Target,
+			Previous: update.Previous,
+			Record:   update.Record,
+			Reason:   update.Reason,
+		})
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (s *Server) setOverride(w http.ResponseWriter, r *http.Request, name string) {
+	override := &Override{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(override); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid override: %v", err))
+		return
+	}
+	if err := s.engine.SetOverride(name, override.Target); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	auditRequest(r, &audit.Event{
+		Event:  audit.Proposal,
+		Name:   name,
+		Type:   "override",
+		Action: "add",
+		Target: override.Target,
+	})
+	writeJSON(w, http.StatusOK, s.engine.Overrides())
+}
+
+func (s *Server) deleteOverride(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.engine.DeleteOverride(name) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no override for '%s'", name))
+		return
+	}
+	auditRequest(r, &audit.Event{
+		Event:  audit.Proposal,
+		Name:   name,
+		Type:   "override",
+		Action: "delete",
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditRequest records an event caused by a request to the API in the audit log, attributed to its client.
+func auditRequest(r *http.Request, event *audit.Event) {
+	event.Proposer = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		event.Proposer = host
+	}
+	event.Key = "admin"
+	audit.Record(event)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(body); err != nil {
+		adminLog.Warn("unable to write response", logging.Error, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &errorResponse{Error: message})
+}
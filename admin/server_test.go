@@ -0,0 +1,221 @@
+package admin
+
+import (
+	"github.com/thyth/hive/audit"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/hive"
+	"github.com/thyth/hive/internal/dnstest"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/metrics"
+
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "0123456789abcdef"
+
+func TestMain(m *testing.M) {
+	logging.Configure(&conf.Logging{Level: "error"})
+	os.Exit(m.Run())
+}
+
+// startAPI serves the administration API of an engine for the west site, with a peer at the east site, stopping both
+// when the test completes.
+func startAPI(t *testing.T) (*hive.Engine, *httptest.Server) {
+	primary := dnstest.NewServer(t, "127.0.0.1")
+	primary.AddZone("west.example.com.", "foo.west.example.com. A 10.0.0.100", "v6.west.example.com. AAAA fd00::100")
+	primary.AddZone("rdvu.example.com.")
+	peer := dnstest.NewServer(t, "127.0.0.2")
+	peer.AddZone("east.example.com.", "foo.east.example.com. A 10.1.0.100", "bar.east.example.com. A 10.1.0.101")
+
+	e := hive.NewEngine(dnstest.Config(t, primary, peer), dnstest.Key)
+	if err := e.Start(); err != nil {
+		t.Fatalf("unable to start engine: %v", err)
+	}
+	api := httptest.NewServer(&Server{engine: e, token: testToken})
+	t.Cleanup(func() {
+		api.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		e.Stop(ctx)
+	})
+	return e, api
+}
+
+// request makes a request of the API with a token, decoding a JSON response into the body given (if not nil).
+func request(t *testing.T, api *httptest.Server, method, path, token, body string, response interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("invalid request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := api.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	if response != nil {
+		if err := json.Unmarshal(content, response); err != nil {
+			t.Fatalf("%s %s responded with invalid JSON '%s': %v", method, path, content, err)
+		}
+	}
+	return resp
+}
+
+// unauthorizedCount provides the number of requests of a method refused for lacking a valid token so far, as exposed
+// to Prometheus.
+func unauthorizedCount(t *testing.T, method string) int {
+	var text strings.Builder
+	if err := metrics.Default.WriteText(&text); err != nil {
+		t.Fatalf("unable to write metrics: %v", err)
+	}
+	prefix := `hive_admin_unauthorized_total{method="` + method + `"} `
+	for _, line := range strings.Split(text.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			count, _ := strconv.Atoi(strings.TrimPrefix(line, prefix))
+			return count
+		}
+	}
+	return 0
+}
+
+func TestAuthorization(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Configure(&conf.Audit{File: path, MaxSize: 1 << 20, MaxFiles: 1}); err != nil {
+		t.Fatalf("unable to configure audit log: %v", err)
+	}
+	defer audit.Configure(nil)
+
+	_, api := startAPI(t)
+	refused := unauthorizedCount(t, http.MethodGet)
+	for _, token := range []string{"", "wrong", testToken + "0"} {
+		resp := request(t, api, http.MethodGet, "/zones", token, "", nil)
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("token '%s': expected a challenge, got %d", token, resp.StatusCode)
+		}
+	}
+	if resp := request(t, api, http.MethodGet, "/zones", testToken, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("valid token refused with %d", resp.StatusCode)
+	}
+
+	// refusals are counted, but not audited
+	if count := unauthorizedCount(t, http.MethodGet); count != refused+3 {
+		t.Errorf("expected 3 refusals counted, got %d", count-refused)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || strings.Contains(string(content), audit.Rejection) {
+		t.Errorf("expected no rejections audited, got '%s' (%v)", content, err)
+	}
+}
+
+func TestZones(t *testing.T) {
+	_, api := startAPI(t)
+	var zones []*ZoneSummary
+	request(t, api, http.MethodGet, "/zones", testToken, "", &zones)
+	var roles []string
+	for _, zone := range zones {
+		roles = append(roles, zone.Role+" "+zone.Name)
+	}
+	expected := "primary west.example.com.,peer east.example.com.,default default,rendezvous rdvu.example.com."
+	if strings.Join(roles, ",") != expected {
+		t.Errorf("expected zones %s, got %v", expected, roles)
+	}
+	if zones[1].State != "up" || zones[1].ARecords != 2 {
+		t.Errorf("unexpected peer zone summary %+v", zones[1])
+	}
+
+	var west ZoneRecords
+	request(t, api, http.MethodGet, "/zones/west.example.com.", testToken, "", &west)
+	if len(west.Records) != 2 || west.Records[0].Type != "A" || west.Records[1].Type != "AAAA" ||
+		west.Records[1].Address != "fd00::100" {
+		t.Errorf("unexpected records of the primary zone %+v", west.Records)
+	}
+
+	if resp := request(t, api, http.MethodGet, "/zones/default", testToken, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("default zone responded %d", resp.StatusCode)
+	}
+	for _, path := range []string{"/zones/south.example.com.", "/zones/south.example.com./transfer",
+		"/zones/default/transfer"} {
+		method := http.MethodGet
+		if strings.HasSuffix(path, "/transfer") {
+			method = http.MethodPost
+		}
+		if resp := request(t, api, method, path, testToken, "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s %s: expected not found, got %d", method, path, resp.StatusCode)
+		}
+	}
+	var east ZoneRecords
+	if resp := request(t, api, http.MethodPost, "/zones/east.example.com./transfer", testToken, "",
+		&east); resp.StatusCode != http.StatusOK || len(east.Records) != 2 {
+		t.Errorf("transfer responded %d with %+v", resp.StatusCode, east)
+	}
+
+	resp := request(t, api, http.MethodDelete, "/zones", testToken, "", nil)
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET" {
+		t.Errorf("expected DELETE refused, allowing GET; got %d allowing %s", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if resp := request(t, api, http.MethodGet, "/nowhere", testToken, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path responded %d", resp.StatusCode)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	_, api := startAPI(t)
+	explain := func() *Decision {
+		decision := &Decision{}
+		request(t, api, http.MethodGet, "/names/foo.rdvu.example.com.", testToken, "", decision)
+		return decision
+	}
+	decision := explain()
+	if len(decision.Candidates) != 2 || decision.Target != "foo.west.example.com." {
+		t.Fatalf("unexpected merge decision %+v", decision)
+	}
+
+	for _, body := range []string{`{"target":`, `{"target":"www.example.org.","ttl":60}`, `{"target":""}`} {
+		if resp := request(t, api, http.MethodPut, "/overrides/foo.rdvu.example.com.", testToken, body,
+			nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("override %s: expected a bad request, got %d", body, resp.StatusCode)
+		}
+	}
+	if resp := request(t, api, http.MethodPut, "/overrides/foo.example.org.", testToken, `{"target":"www.example.org."}`,
+		nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("override outside the rendezvous zone: expected a bad request, got %d", resp.StatusCode)
+	}
+
+	overrides := map[string]string{}
+	request(t, api, http.MethodPut, "/overrides/foo.rdvu.example.com.", testToken, `{"target":"www.example.org"}`,
+		&overrides)
+	if overrides["foo.rdvu.example.com."] != "www.example.org." {
+		t.Fatalf("override not set: %v", overrides)
+	}
+	if decision := explain(); decision.Override != "www.example.org." || decision.Target != "www.example.org." {
+		t.Errorf("override not merged: %+v", decision)
+	}
+
+	if resp := request(t, api, http.MethodDelete, "/overrides/foo.rdvu.example.com.", testToken, "",
+		nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("deleting the override responded %d", resp.StatusCode)
+	}
+	if resp := request(t, api, http.MethodDelete, "/overrides/foo.rdvu.example.com.", testToken, "",
+		nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting an absent override responded %d", resp.StatusCode)
+	}
+	if decision := explain(); decision.Override != "" || decision.Target != "foo.west.example.com." {
+		t.Errorf("deleted override still merged: %+v", decision)
+	}
+}
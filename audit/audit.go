@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"github.com/thyth/hive/conf"
+
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The kinds of events recorded.
+const (
+	Proposal  = "proposal"  // a change proposed by an RFC2136 update, as accepted
+	Rejection = "rejection" // a signed request refused by policy (e.g. failing TSIG validation, or out of zone)
+	Merge     = "merge"     // a change to the target of a rendezvous name, as written to the primary
+	Write     = "write"     // an update written to the primary, successfully or not
+)
+
+// Event is a record of the audit log, written as one JSON line.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Proposer string    `json:"proposer,omitempty"` // the address the request came from
+	Key      string    `json:"key,omitempty"`      // the name of the TSIG key the request was signed with
+	Zone     string    `json:"zone,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Type     string    `json:"type,omitempty"`   // of the records proposed or written
+	Action   string    `json:"action,omitempty"` // add or delete
+	Target   string    `json:"target,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	Previous string    `json:"previous,omitempty"` // the target of a rendezvous name before a merge
+	Reason   string    `json:"reason,omitempty"`   // why a request was rejected, or a target selected
+	Rcode    string    `json:"rcode,omitempty"`
+	Error    string    `json:"error,omitempty"` // why a write failed; empty if it succeeded
+}
+
+var (
+	mutex   sync.Mutex
+	current *rotatingFile // nil unless configured
+)
+
+// Configure directs events to the audit log configured, or stops recording them if the configuration is nil. It may be
+// called again to reconfigure the audit log, e.g. on reload.
+func Configure(config *conf.Audit) error {
+	var next *rotatingFile
+	if config != nil {
+		var err error
+		if next, err = openRotating(config.File, config.MaxSize, config.MaxFiles); err != nil {
+			return err
+		}
+	}
+	mutex.Lock()
+	previous := current
+	current = next
+	mutex.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+	return nil
+}
+
+// Enabled reports whether events are being recorded, so that callers may skip describing events that would be
+// discarded.
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return current != nil
+}
+
+// Record appends an event to the audit log (timestamped now, unless its time is set), if configured. Failures to
+// record are reported on standard error, as there is nowhere more durable to report them.
+func Record(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode audit event: %v\n", err)
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil {
+		return
+	}
+	if err := current.write(append(line, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write audit event to %s: %v\n", current.path, err)
+	}
+}
@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"github.com/thyth/hive/conf"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readEvents reads the events of an audit log file.
+func readEvents(t *testing.T, path string) []*Event {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read audit log: %v", err)
+	}
+	var events []*Event
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		event := &Event{}
+		if err := json.Unmarshal([]byte(line), event); err != nil {
+			t.Fatalf("invalid audit record '%s': %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	Record(&Event{Event: Proposal, Name: "discarded.rdvu.example.com."})
+	if err := Configure(&conf.Audit{File: path, MaxSize: 1 << 20, MaxFiles: 1}); err != nil {
+		t.Fatalf("unable to configure audit log: %v", err)
+	}
+	defer Configure(nil)
+	if !Enabled() {
+		t.Fatalf("configured audit log not enabled")
+	}
+	Record(&Event{Event: Proposal, Proposer: "10.1.0.2", Name: "foo.east.example.com.", Action: "add"})
+
+	events := readEvents(t, path)
+	if len(events) != 1 || events[0].Name != "foo.east.example.com." || events[0].Time.IsZero() {
+		t.Errorf("unexpected events %+v", events)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unable to stat audit log: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("audit log readable beyond its owner: %v", mode)
+	}
+
+	Configure(nil)
+	Record(&Event{Event: Proposal, Name: "discarded.rdvu.example.com."})
+	if Enabled() || len(readEvents(t, path)) != 1 {
+		t.Errorf("events recorded after the audit log was disabled")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line, _ := json.Marshal(&Event{Event: Write, Name: "host00.rdvu.example.com."})
+	// rotated every two events, keeping two rotations
+	if err := Configure(&conf.Audit{File: path, MaxSize: int64(2*len(line) + 100), MaxFiles: 2}); err != nil {
+		t.Fatalf("unable to configure audit log: %v", err)
+	}
+	defer Configure(nil)
+	for i := 0; i < 7; i++ {
+		Record(&Event{Event: Write, Name: fmt.Sprintf("host%02d.rdvu.example.com.", i)})
+	}
+
+	for file, expected := range map[string][]string{
+		path:        {"host06.rdvu.example.com."},
+		path + ".1": {"host04.rdvu.example.com.", "host05.rdvu.example.com."},
+		path + ".2": {"host02.rdvu.example.com.", "host03.rdvu.example.com."},
+	} {
+		var names []string
+		for _, event := range readEvents(t, file) {
+			names = append(names, event.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(expected) {
+			t.Errorf("%s: expected %v, got %v", filepath.Base(file), expected, names)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("rotation beyond maxFiles kept")
+	}
+}
@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotatingFile appends to a file, rotating it before it would exceed its maximum size: the file is renamed with the
+// suffix .1 (and each earlier rotation's suffix incremented), keeping at most maxFiles rotations.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotating(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	// audit records are for security review, so are readable only by the owner
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) write(line []byte) error {
+	if f.file == nil {
+		// an earlier rotation failed to open the file again
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if rotateErr = f.rotate(); f.file == nil {
+			return rotateErr
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if rotateErr != nil {
+		return fmt.Errorf("failed to rotate audit log (appending to it instead): %v", rotateErr)
+	}
+	return nil
+}
+
+// rotate closes the file and renames it (and each earlier rotation) to make way for a new, empty file. If renaming
+// fails, the file is opened again as it is, to be appended to; if that fails too, the file is left nil.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	err := f.shift()
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shift renames the file and each earlier rotation to the next suffix, removing the oldest beyond maxFiles.
+func (f *rotatingFile) shift() error {
+	if f.maxFiles <= 0 {
+		return os.Remove(f.path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", f.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+func (f *rotatingFile) close() {
+	if f.file != nil {
+		f.file.Close()
+	}
+}
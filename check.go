@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/logging"
+
+	"flag"
+	"fmt"
+)
+
+// checkConfig implements the check-config subcommand: it parses a configuration file (and key file, if given), then
+// reports every problem found with them, returning the exit status (non-zero if there were any).
+func checkConfig(args []string) int {
+	configFile := ""
+	dnsKeyFile := ""
+
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	flags.StringVar(&configFile, "config", "", "Path to a JSON, YAML (.yaml/.yml) or TOML (.toml) configuration file")
+	flags.StringVar(&dnsKeyFile, "key", "", "Path to a DNS key file (optional)")
+	flags.Parse(args)
+	if configFile == "" {
+		flags.Usage()
+		return 2
+	}
+
+	var key *conf.TsigKey
+	if dnsKeyFile != "" {
+		var err error
+		if key, err = conf.ParseKeyfile(dnsKeyFile); err != nil {
+			fmt.Printf("Error processing key file: %v\n", err)
+			return 1
+		}
+	}
+	problems, err := conf.CheckFile(configFile, key)
+	if err != nil {
+		fmt.Printf("Error processing config file: %v\n", err)
+		return 1
+	}
+	for _, problem := range problems {
+		fmt.Printf("Problem: %v\n", problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in %s\n", len(problems), configFile)
+		return 1
+	}
+	fmt.Printf("%s OK\n", configFile)
+	return 0
+}
+
+// warnConfig reports the problems found with a configuration being put into effect, which runs regardless.
+func warnConfig(config *conf.Configuration, key *conf.TsigKey) {
+	for _, problem := range config.Check(key) {
+		mainLog.Warn("configuration problem", logging.Error, problem)
+	}
+}
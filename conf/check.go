@@ -0,0 +1,194 @@
+package conf
+
+import (
+	"github.com/miekg/dns"
+
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// minAdminToken is the length below which an admin token is considered guessable.
+const minAdminToken = 16
+
+// CheckFile parses a configuration file (see ParseFile) and checks it with a key (if not nil), returning every problem
+// found: each invalid setting, then those found by Check as far as the settings were valid. An error is returned only
+// if the file could not be read or parsed at all.
+func CheckFile(confFile string, key *TsigKey) ([]error, error) {
+	config, err := parseFile(confFile)
+	var problems []error
+	var invalid Errors
+	if errors.As(err, &invalid) {
+		problems = append(problems, invalid...)
+	} else if err != nil {
+		return nil, err
+	}
+	return append(problems, config.Check(key)...), nil
+}
+
+// Check validates the semantics of a configuration (and the key it is used with, if not nil), beyond the syntax checked
+// when parsing it, returning every problem found. A configuration with problems may still run, but not as intended.
+func (c *Configuration) Check(key *TsigKey) []error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	// names must be valid, and every site (local or peer) and the rendezvous namespace must be disjoint: a name within
+	// several would be transposed or served ambiguously
+	checkName := func(what, name string) bool {
+		if name == "" {
+			problem("%s missing", what)
+			return false
+		}
+		if _, ok := dns.IsDomainName(name); !ok || name == "." {
+			problem("%s '%s' is not a valid domain name", what, name)
+			return false
+		}
+		return true
+	}
+	type site struct {
+		what   string
+		suffix string
+	}
+	var sites []*site
+	for _, name := range c.unqualified {
+		problem("%s is not fully qualified (missing trailing dot)", name)
+	}
+	if checkName("search suffix", c.SearchSuffix) {
+		sites = append(sites, &site{"search suffix", c.SearchSuffix})
+	}
+	if checkName("local zone suffix", c.LocalZone.Suffix) {
+		sites = append(sites, &site{"local zone suffix", c.LocalZone.Suffix})
+	}
+	for idx, peer := range c.Peers {
+		what := fmt.Sprintf("peer %d suffix", idx)
+		if checkName(what, peer.Suffix) {
+			sites = append(sites, &site{what, peer.Suffix})
+		}
+	}
+	for i, a := range sites {
+		for _, b := range sites[i+1:] {
+			switch {
+			case dns.CanonicalName(a.suffix) == dns.CanonicalName(b.suffix):
+				problem("%s and %s are both '%s'", a.what, b.what, a.suffix)
+			case dns.IsSubDomain(a.suffix, b.suffix):
+				problem("%s '%s' is within %s '%s'", b.what, b.suffix, a.what, a.suffix)
+			case dns.IsSubDomain(b.suffix, a.suffix):
+				problem("%s '%s' is within %s '%s'", a.what, a.suffix, b.what, b.suffix)
+			}
+		}
+	}
+
+	// proposers are identified by address alone, so the primary and each peer must have their own (rejected by parsing,
+	// but possible in a configuration constructed otherwise)
+	servers := map[string]string{
+		AddrIP(c.LocalZone.Server).String(): "local zone server",
+	}
+	for idx, peer := range c.Peers {
+		what := fmt.Sprintf("peer %d server", idx)
+		ip := AddrIP(peer.Server).String()
+		if other, present := servers[ip]; present {
+			problem("%s and %s share the address %s", other, what, ip)
+		} else {
+			servers[ip] = what
+		}
+	}
+
+	// local nets must not overlap (a sign of a mistyped prefix length)
+	for i, a := range c.LocalNets {
+		for _, b := range c.LocalNets[i+1:] {
+			if netsOverlap(a, b) {
+				problem("local nets %v and %v overlap", a, b)
+			}
+		}
+	}
+
+	listening := map[string]bool{}
+	for _, address := range c.ListenAddresses {
+		if listening[address.String()] {
+			problem("listen address %v repeated", address)
+		}
+		listening[address.String()] = true
+	}
+
+	// views must prefer known sites, and each subnet should select only one view
+	known := map[string]bool{
+		dns.CanonicalName(c.LocalZone.Suffix): true,
+	}
+	for _, peer := range c.Peers {
+		known[dns.CanonicalName(peer.Suffix)] = true
+	}
+	for i, view := range c.Views {
+		for _, suffix := range view.Prefer {
+			if !known[dns.CanonicalName(suffix)] && c.Catalog == nil {
+				problem("view '%s' prefers '%s', which is neither the local zone nor a peer", view.Name, suffix)
+			}
+		}
+		for _, other := range c.Views[i+1:] {
+			for _, a := range view.Subnets {
+				for _, b := range other.Subnets {
+					if netsOverlap(a, b) {
+						problem("view '%s' subnet %v overlaps view '%s' subnet %v (only the first applies)",
+							view.Name, a, other.Name, b)
+					}
+				}
+			}
+		}
+	}
+
+	// liveness settings only take effect while peers are probed, and withdrawal only once they are considered down
+	if c.ProbeInterval <= 0 && (c.PeerDownAfter > 0 || c.PeerGracePeriod > 0) {
+		problem("peerDownAfter and peerGracePeriod have no effect without probeInterval")
+	} else if c.PeerDownAfter <= 0 && c.PeerGracePeriod > 0 {
+		problem("peerGracePeriod has no effect without peerDownAfter")
+	}
+
+	if c.Catalog != nil {
+		if checkName("catalog zone", c.Catalog.Zone) {
+			for _, site := range sites {
+				if dns.IsSubDomain(site.suffix, c.Catalog.Zone) {
+					problem("catalog zone '%s' is within %s '%s'", c.Catalog.Zone, site.what, site.suffix)
+				}
+			}
+		}
+	}
+
+	if c.Admin != nil && len(c.Admin.Token) < minAdminToken {
+		problem("admin token is shorter than %d characters", minAdminToken)
+	}
+	if c.Admin != nil && c.Metrics != nil && c.Admin.Listen == c.Metrics.Listen {
+		problem("admin API and metrics both listen on %s", c.Admin.Listen)
+	}
+	if c.Admin != nil && c.Health != nil && c.Admin.Listen == c.Health.Listen {
+		problem("admin API and health checks both listen on %s", c.Admin.Listen)
+	}
+	if c.Metrics != nil && c.Health != nil && c.Metrics.Listen == c.Health.Listen {
+		problem("metrics and health checks both listen on %s", c.Metrics.Listen)
+	}
+
+	// the same key authenticates to the primary and every peer
+	if key != nil {
+		switch key.Algorithm {
+		case dns.HmacMD5, dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512:
+		default:
+			problem("key algorithm '%s' unknown", key.Algorithm)
+		}
+		if key.Algorithm == dns.HmacMD5 {
+			problem("key algorithm '%s' is deprecated (RFC8945); use %s", key.Algorithm, dns.HmacSHA256)
+		}
+		if _, err := base64.StdEncoding.DecodeString(key.Key); err != nil {
+			problem("key value is not valid base64: %v", err)
+		}
+		if !dns.IsFqdn(key.ZoneName) {
+			problem("key zone name '%s' is not fully qualified (missing trailing dot)", key.ZoneName)
+		}
+	}
+	return problems
+}
+
+// netsOverlap reports whether two subnets share any address.
+func netsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
@@ -0,0 +1,240 @@
+package conf
+
+import (
+	"github.com/miekg/dns"
+
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustCIDR(cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+func testServer(host string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: DefaultPort}
+}
+
+// checkedConfig is a configuration without problems, for each test case to introduce one into.
+func checkedConfig() (*Configuration, *TsigKey) {
+	config := &Configuration{
+		LocalNets:    []*net.IPNet{mustCIDR("10.0.0.0/16")},
+		LocalZone:    &ZonePeer{Suffix: "west.example.com.", Server: testServer("10.0.0.2")},
+		SearchSuffix: "rdvu.example.com.",
+		Peers: []*ZonePeer{
+			{Suffix: "east.example.com.", Server: testServer("10.1.0.2")},
+			{Suffix: "north.example.com.", Server: testServer("10.2.0.2")},
+		},
+		ListenAddresses: []net.Addr{testServer("10.0.0.3")},
+		Views: []*View{
+			{Name: "west", Subnets: []*net.IPNet{mustCIDR("10.0.0.0/16")}, Prefer: []string{"west.example.com."}},
+			{Name: "east", Subnets: []*net.IPNet{mustCIDR("10.1.0.0/16")}, Prefer: []string{"east.example.com."}},
+		},
+		Admin:   &Admin{Listen: "127.0.0.1:8053", Token: "0123456789abcdef"},
+		Metrics: &Metrics{Listen: "127.0.0.1:9153"},
+		Health:  &Health{Listen: "127.0.0.1:8080"},
+	}
+	key := &TsigKey{
+		Algorithm: dns.HmacSHA256,
+		Key:       "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0",
+		ZoneName:  "hive.",
+	}
+	return config, key
+}
+
+func TestCheck(t *testing.T) {
+	config, key := checkedConfig()
+	if problems := config.Check(key); len(problems) != 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+
+	tests := []struct {
+		problem string
+		change  func(c *Configuration, key *TsigKey)
+	}{
+		{"search suffix missing", func(c *Configuration, key *TsigKey) {
+			c.SearchSuffix = ""
+		}},
+		{"search suffix '.' is not a valid domain name", func(c *Configuration, key *TsigKey) {
+			c.SearchSuffix = "."
+		}},
+		{"peer 1 suffix 'north..example.com.' is not a valid domain name", func(c *Configuration, key *TsigKey) {
+			c.Peers[1].Suffix = "north..example.com."
+		}},
+		{"peer 0 suffix and peer 1 suffix are both 'east.example.com.'", func(c *Configuration, key *TsigKey) {
+			c.Peers[1].Suffix = "EAST.example.com."
+		}},
+		{"peer 0 suffix 'east.west.example.com.' is within local zone suffix 'west.example.com.'",
+			func(c *Configuration, key *TsigKey) {
+				c.Peers[0].Suffix = "east.west.example.com."
+				c.Views = c.Views[:1]
+			}},
+		{"search suffix 'rdvu.west.example.com.' is within local zone suffix 'west.example.com.'",
+			func(c *Configuration, key *TsigKey) {
+				c.SearchSuffix = "rdvu.west.example.com."
+			}},
+		{"local zone server and peer 1 server share the address 10.0.0.2", func(c *Configuration, key *TsigKey) {
+			c.Peers[1].Server = &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}
+		}},
+		{"local nets 10.0.0.0/16 and 10.0.0.0/8 overlap", func(c *Configuration, key *TsigKey) {
+			c.LocalNets = append(c.LocalNets, mustCIDR("10.0.0.0/8"))
+		}},
+		{"listen address 10.0.0.3:53 repeated", func(c *Configuration, key *TsigKey) {
+			c.ListenAddresses = append(c.ListenAddresses, testServer("10.0.0.3"))
+		}},
+		{"view 'east' prefers 'south.example.com.', which is neither the local zone nor a peer",
+			func(c *Configuration, key *TsigKey) {
+				c.Views[1].Prefer = append(c.Views[1].Prefer, "south.example.com.")
+			}},
+		{"view 'west' subnet 10.0.0.0/16 overlaps view 'east' subnet 10.0.0.0/12 (only the first applies)",
+			func(c *Configuration, key *TsigKey) {
+				c.Views[1].Subnets = []*net.IPNet{mustCIDR("10.0.0.0/12")}
+			}},
+		{"peerDownAfter and peerGracePeriod have no effect without probeInterval",
+			func(c *Configuration, key *TsigKey) {
+				c.PeerDownAfter = 3
+			}},
+		{"peerGracePeriod has no effect without peerDownAfter", func(c *Configuration, key *TsigKey) {
+			c.ProbeInterval = 30 * time.Second
+			c.PeerGracePeriod = 2 * time.Minute
+		}},
+		{"catalog zone 'catalog.west.example.com.' is within local zone suffix 'west.example.com.'",
+			func(c *Configuration, key *TsigKey) {
+				c.Catalog = &Catalog{Zone: "catalog.west.example.com."}
+			}},
+		{"admin token is shorter than 16 characters", func(c *Configuration, key *TsigKey) {
+			c.Admin.Token = "secret"
+		}},
+		{"admin API and metrics both listen on 127.0.0.1:8053", func(c *Configuration, key *TsigKey) {
+			c.Metrics.Listen = c.Admin.Listen
+		}},
+		{"admin API and health checks both listen on 127.0.0.1:8053", func(c *Configuration, key *TsigKey) {
+			c.Health.Listen = c.Admin.Listen
+		}},
+		{"metrics and health checks both listen on 127.0.0.1:9153", func(c *Configuration, key *TsigKey) {
+			c.Health.Listen = c.Metrics.Listen
+		}},
+		{"key algorithm 'hmac-sha3.' unknown", func(c *Configuration, key *TsigKey) {
+			key.Algorithm = "hmac-sha3."
+		}},
+		{"key algorithm 'hmac-md5.sig-alg.reg.int.' is deprecated (RFC8945); use hmac-sha256.",
+			func(c *Configuration, key *TsigKey) {
+				key.Algorithm = dns.HmacMD5
+			}},
+		{"key value is not valid base64", func(c *Configuration, key *TsigKey) {
+			key.Key = "not base64!"
+		}},
+		{"key zone name 'hive' is not fully qualified (missing trailing dot)", func(c *Configuration, key *TsigKey) {
+			key.ZoneName = "hive"
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.problem, func(t *testing.T) {
+			config, key := checkedConfig()
+			test.change(config, key)
+			problems := config.Check(key)
+			if len(problems) != 1 || !strings.HasPrefix(problems[0].Error(), test.problem) {
+				t.Errorf("expected only '%s', got %v", test.problem, problems)
+			}
+		})
+	}
+}
+
+func TestCheckCatalogPreference(t *testing.T) {
+	// with a catalog, views may prefer sites only discovered from it
+	config, key := checkedConfig()
+	config.Catalog = &Catalog{Zone: "catalog.example.org."}
+	config.Views[1].Prefer = append(config.Views[1].Prefer, "south.example.com.")
+	if problems := config.Check(key); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+}
+
+// writeConfig writes a configuration file into a temporary directory, returning its path.
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write configuration: %v", err)
+	}
+	return path
+}
+
+func TestCheckFile(t *testing.T) {
+	path := writeConfig(t, "hive.json", `{
+  "localNets": ["10.0.0.0/33"],
+  "localZone": {"suffix": "west.example.com", "server": "10.0.0.2"},
+  "searchSuffix": "rdvu.west.example.com.",
+  "peers": [{"suffix": "east.example.com.", "server": "10.0.0.2:5353"}],
+  "listen": ["10.0.0.3:99999"],
+  "ttl": 60,
+  "probeInterval": "soon"
+}`)
+	// every invalid setting is reported, rather than the first, as are the problems with those that are valid
+	expected := []string{
+		"ttl must be at least 300 seconds but got 60 seconds",
+		"listen address 0 with value '10.0.0.3:99999' invalid",
+		"local net 0 with value '10.0.0.0/33' invalid",
+		"peer 0 server shares the address 10.0.0.2 with the zone primary",
+		"probe interval 'soon' invalid",
+		"local zone suffix 'west.example.com' is not fully qualified (missing trailing dot)",
+		"search suffix 'rdvu.west.example.com.' is within local zone suffix 'west.example.com.'",
+	}
+	problems, err := CheckFile(path, nil)
+	if err != nil {
+		t.Fatalf("unable to check: %v", err)
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for idx, problem := range problems {
+		if !strings.HasPrefix(problem.Error(), expected[idx]) {
+			t.Errorf("expected problem %d to be '%s', got '%v'", idx, expected[idx], problem)
+		}
+	}
+
+	// parsing fails with each invalid setting
+	config, err := ParseFile(path)
+	var invalid Errors
+	if config != nil || !errors.As(err, &invalid) || len(invalid) != 5 {
+		t.Errorf("expected the 5 invalid settings, got %v", err)
+	}
+
+	// a file that cannot be parsed at all has no problems to list
+	if _, err := CheckFile(writeConfig(t, "broken.json", "{"), nil); err == nil {
+		t.Errorf("expected a syntax error")
+	}
+}
+
+func TestCheckUnqualified(t *testing.T) {
+	problems, err := CheckFile(writeConfig(t, "hive.yaml", `localNets: [10.0.0.0/16]
+localZone: {suffix: west.example.com, server: 10.0.0.2}
+searchSuffix: rdvu.example.com
+peers: [{suffix: east.example.com, server: 10.1.0.2}]
+ttl: 600
+`), nil)
+	if err != nil {
+		t.Fatalf("unable to check: %v", err)
+	}
+	expected := []string{
+		"search suffix 'rdvu.example.com' is not fully qualified (missing trailing dot)",
+		"local zone suffix 'west.example.com' is not fully qualified (missing trailing dot)",
+		"peer 0 suffix 'east.example.com' is not fully qualified (missing trailing dot)",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), problems)
+	}
+	for idx, problem := range problems {
+		if problem.Error() != expected[idx] {
+			t.Errorf("expected problem %d to be '%s', got '%v'", idx, expected[idx], problem)
+		}
+	}
+}
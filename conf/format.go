@@ -0,0 +1,212 @@
+package conf
+
+import (
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// envPrefix prefixes the names of the environment variables overriding configuration settings.
+const envPrefix = "HIVE_"
+
+// envReplaces lists the settings that a setting overridden by the environment also replaces, where both set the same
+// thing (bindAddress being equivalent to a single listen entry), so that the file's values are not combined with it.
+var envReplaces = map[string][]string{
+	"bindAddress": {"listen"},
+	"listen":      {"bindAddress"},
+}
+
+// ParseFile reads a configuration file as YAML (.yaml or .yml), TOML (.toml), or otherwise JSON, then overrides its
+// settings with any set by environment variables (see EnvironmentVariables). Each format has the same settings, named
+// as in JSON. If any setting is invalid, the error is Errors, listing each.
+func ParseFile(confFile string) (*Configuration, error) {
+	config, err := parseFile(confFile)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// parseFile parses a configuration file as ParseFile does, but also returns the configuration if its settings are
+// invalid (as Errors), inhabited as far as they are valid.
+func parseFile(confFile string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	settings := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(confFile)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &settings)
+	case ".toml":
+		err = toml.Unmarshal(data, &settings)
+	default:
+		err = json.Unmarshal(data, &settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if settings == nil {
+		// an empty document
+		settings = map[string]interface{}{}
+	}
+	if err := overrideSettings(settings, reflect.TypeOf(parseConfiguration{}), envPrefix, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	// the settings of every format are validated and inhabited as JSON
+	data, err = json.Marshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	config := &Configuration{}
+	if err := json.Unmarshal(data, config); err != nil {
+		var invalid Errors
+		if errors.As(err, &invalid) {
+			return config, invalid
+		}
+		return nil, err
+	}
+	return config, nil
+}
+
+// EnvironmentVariables lists the environment variables that override configuration settings, with the setting each
+// overrides. Lists are given comma separated, e.g. HIVE_LISTEN=10.1.0.2:53,[fd00:1::2]:53. The peers and views can only
+// be set in the configuration file.
+func EnvironmentVariables() [][2]string {
+	var variables [][2]string
+	listOverrides(reflect.TypeOf(parseConfiguration{}), envPrefix, "", func(variable, setting string) {
+		variables = append(variables, [2]string{variable, setting})
+	})
+	return variables
+}
+
+// listOverrides visits the settings of a parse structure that environment variables may override: those holding a
+// scalar or list of scalars, within the top level or a nested structure.
+func listOverrides(parseType reflect.Type, prefix, path string, visit func(variable, setting string)) {
+	for i := 0; i < parseType.NumField(); i++ {
+		field := parseType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		variable := prefix + envName(name)
+		switch fieldType := field.Type; {
+		case fieldType.Kind() == reflect.Ptr && fieldType.Elem().Kind() == reflect.Struct:
+			listOverrides(fieldType.Elem(), variable+"_", path+name+".", visit)
+		case isScalar(fieldType), fieldType.Kind() == reflect.Slice && isScalar(fieldType.Elem()):
+			visit(variable, path+name)
+		}
+	}
+}
+
+// overrideSettings replaces the settings of a parse structure with the values of the environment variables set for
+// them, converted to the type each setting has. The settings an overridden setting replaces (see envReplaces) are
+// removed, unless overridden themselves.
+func overrideSettings(settings map[string]interface{}, parseType reflect.Type, prefix string,
+	lookup func(string) (string, bool)) error {
+	overridden := map[string]bool{}
+	for i := 0; i < parseType.NumField(); i++ {
+		field := parseType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		variable := prefix + envName(name)
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr && fieldType.Elem().Kind() == reflect.Struct {
+			nested, _ := settings[name].(map[string]interface{})
+			if nested == nil {
+				nested = map[string]interface{}{}
+			}
+			if err := overrideSettings(nested, fieldType.Elem(), variable+"_", lookup); err != nil {
+				return err
+			}
+			if len(nested) > 0 {
+				settings[name] = nested
+			}
+			continue
+		}
+		value, set := lookup(variable)
+		if !set {
+			continue
+		}
+		overridden[name] = true
+		if fieldType.Kind() == reflect.Slice && isScalar(fieldType.Elem()) {
+			var values []interface{}
+			for _, element := range strings.Split(value, ",") {
+				if element = strings.TrimSpace(element); element == "" {
+					continue
+				}
+				converted, err := convertSetting(element, fieldType.Elem())
+				if err != nil {
+					return fmt.Errorf("environment variable %s value '%s' invalid: %v", variable, value, err)
+				}
+				values = append(values, converted)
+			}
+			settings[name] = values
+		} else if isScalar(fieldType) {
+			converted, err := convertSetting(value, fieldType)
+			if err != nil {
+				return fmt.Errorf("environment variable %s value '%s' invalid: %v", variable, value, err)
+			}
+			settings[name] = converted
+		}
+	}
+	for name := range overridden {
+		for _, replaced := range envReplaces[name] {
+			if !overridden[replaced] {
+				delete(settings, replaced)
+			}
+		}
+	}
+	return nil
+}
+
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Uint32:
+		return true
+	}
+	return false
+}
+
+// convertSetting converts the value of an environment variable to the type of the setting it overrides.
+func convertSetting(value string, t reflect.Type) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Uint32:
+		return strconv.ParseUint(value, 10, 32)
+	}
+	return value, nil
+}
+
+// envName converts the (camel case) JSON name of a setting to the upper snake case of an environment variable, e.g.
+// bindAddress to BIND_ADDRESS. A run of capitals is an acronym, so one word, e.g. maxSizeMB to MAX_SIZE_MB.
+func envName(name string) string {
+	runes := []rune(name)
+	var converted strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			// a word starts after a lower case letter, or at the last capital of an acronym followed by a word
+			if !unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				converted.WriteRune('_')
+			}
+		}
+		converted.WriteRune(unicode.ToUpper(r))
+	}
+	return converted.String()
+}
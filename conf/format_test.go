@@ -0,0 +1,226 @@
+package conf
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// formatConfigs holds the same configuration in each format.
+var formatConfigs = map[string]string{
+	"hive.json": `{
+  "localNets": ["10.0.0.0/16"],
+  "localZone": {"suffix": "west.example.com", "server": "10.0.0.2"},
+  "searchSuffix": "rdvu.example.com",
+  "peers": [{"suffix": "east.example.com", "server": "10.1.0.2:5353"}],
+  "listen": ["10.0.0.3:53"],
+  "ttl": 600,
+  "answerQueries": true,
+  "probeInterval": "30s",
+  "logging": {"level": "warn"}
+}`,
+	"hive.yaml": `localNets: [10.0.0.0/16]
+localZone:
+  suffix: west.example.com
+  server: 10.0.0.2
+searchSuffix: rdvu.example.com
+peers:
+  - suffix: east.example.com
+    server: 10.1.0.2:5353
+listen: ["10.0.0.3:53"]
+ttl: 600
+answerQueries: true
+probeInterval: 30s
+logging:
+  level: warn
+`,
+	"hive.toml": `localNets = ["10.0.0.0/16"]
+searchSuffix = "rdvu.example.com"
+listen = ["10.0.0.3:53"]
+ttl = 600
+answerQueries = true
+probeInterval = "30s"
+
+[localZone]
+suffix = "west.example.com"
+server = "10.0.0.2"
+
+[[peers]]
+suffix = "east.example.com"
+server = "10.1.0.2:5353"
+
+[logging]
+level = "warn"
+`,
+}
+
+func TestParseFileFormats(t *testing.T) {
+	var parsed []*Configuration
+	for _, name := range []string{"hive.json", "hive.yaml", "hive.toml"} {
+		config, err := ParseFile(writeConfig(t, name, formatConfigs[name]))
+		if err != nil {
+			t.Fatalf("unable to parse %s: %v", name, err)
+		}
+		parsed = append(parsed, config)
+	}
+	json := parsed[0]
+	if json.TTL != 600 || !json.AnswerQueries || json.ProbeInterval != 30*time.Second ||
+		json.LocalZone.Server.String() != "10.0.0.2:53" || json.Peers[0].Server.String() != "10.1.0.2:5353" ||
+		json.Logging.Level != "warn" {
+		t.Fatalf("JSON configuration parsed incorrectly: %+v", json)
+	}
+	// unless configured, peers are never considered down, nor are their zones compared by digest
+	if json.PeerDownAfter != 0 || json.PeerGracePeriod != 0 || json.AntiEntropyInterval != 0 {
+		t.Errorf("liveness or anti-entropy enabled by default: %+v", json)
+	}
+	for idx, name := range []string{"hive.yaml", "hive.toml"} {
+		if !reflect.DeepEqual(parsed[idx+1], json) {
+			t.Errorf("%s parsed as %+v, differing from JSON %+v", name, parsed[idx+1], json)
+		}
+	}
+
+	// an empty document lacks the required settings, rather than failing to parse
+	if _, err := ParseFile(writeConfig(t, "empty.yaml", "")); err == nil ||
+		!strings.Contains(err.Error(), "ttl must be at least 300 seconds") {
+		t.Errorf("expected the missing ttl reported, got %v", err)
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	// settings of the file, including nested and list settings, are overridden; others are kept
+	t.Setenv("HIVE_TTL", "900")
+	t.Setenv("HIVE_ANSWER_QUERIES", "false")
+	t.Setenv("HIVE_LISTEN", "10.0.0.4:53, 10.0.0.5:53")
+	t.Setenv("HIVE_LOGGING_LEVEL", "debug")
+	t.Setenv("HIVE_METRICS_LISTEN", "127.0.0.1:9153")
+	for _, name := range []string{"hive.json", "hive.yaml", "hive.toml"} {
+		t.Run(name, func(t *testing.T) {
+			config, err := ParseFile(writeConfig(t, name, formatConfigs[name]))
+			if err != nil {
+				t.Fatalf("unable to parse: %v", err)
+			}
+			if config.TTL != 900 || config.AnswerQueries {
+				t.Errorf("scalar settings not overridden: ttl %d, answerQueries %v", config.TTL, config.AnswerQueries)
+			}
+			if listen := fmtAddrs(config.ListenAddresses); listen != "10.0.0.4:53 10.0.0.5:53" {
+				t.Errorf("listen not overridden: %s", listen)
+			}
+			if config.Logging.Level != "debug" {
+				t.Errorf("nested logging level not overridden: %s", config.Logging.Level)
+			}
+			if config.Metrics == nil || config.Metrics.Listen != "127.0.0.1:9153" {
+				t.Errorf("metrics absent from the file not enabled by the environment: %+v", config.Metrics)
+			}
+			if config.ProbeInterval != 30*time.Second || len(config.Peers) != 1 {
+				t.Errorf("settings not overridden were changed: %+v", config)
+			}
+		})
+	}
+
+	t.Setenv("HIVE_TTL", "soon")
+	if _, err := ParseFile(writeConfig(t, "hive.json", formatConfigs["hive.json"])); err == nil ||
+		!strings.Contains(err.Error(), "HIVE_TTL") {
+		t.Errorf("expected the invalid variable reported, got %v", err)
+	}
+}
+
+func TestEnvironmentReplacesListen(t *testing.T) {
+	// the bind address of the environment replaces the listen addresses of the file, and vice versa
+	t.Setenv("HIVE_BIND_ADDRESS", "10.9.9.9")
+	config, err := ParseFile(writeConfig(t, "hive.json", formatConfigs["hive.json"]))
+	if err != nil {
+		t.Fatalf("unable to parse: %v", err)
+	}
+	if listen := fmtAddrs(config.ListenAddresses); listen != "10.9.9.9:53" {
+		t.Errorf("expected listen replaced by the bind address, got %s", listen)
+	}
+
+	os.Unsetenv("HIVE_BIND_ADDRESS")
+	content := strings.Replace(formatConfigs["hive.json"], `"listen": ["10.0.0.3:53"]`, `"bindAddress": "10.0.0.3"`, 1)
+	t.Setenv("HIVE_LISTEN", "10.0.0.4:5353")
+	config, err = ParseFile(writeConfig(t, "hive.json", content))
+	if err != nil {
+		t.Fatalf("unable to parse: %v", err)
+	}
+	if listen := fmtAddrs(config.ListenAddresses); listen != "10.0.0.4:5353" {
+		t.Errorf("expected the bind address replaced by listen, got %s", listen)
+	}
+
+	// set together in the environment, both apply
+	t.Setenv("HIVE_BIND_ADDRESS", "10.9.9.9")
+	config, err = ParseFile(writeConfig(t, "hive.json", content))
+	if err != nil {
+		t.Fatalf("unable to parse: %v", err)
+	}
+	if listen := fmtAddrs(config.ListenAddresses); listen != "10.0.0.4:5353 10.9.9.9:53" {
+		t.Errorf("expected listen and the bind address of the environment, got %s", listen)
+	}
+}
+
+func fmtAddrs(addrs []net.Addr) string {
+	var formatted []string
+	for _, addr := range addrs {
+		formatted = append(formatted, addr.String())
+	}
+	return strings.Join(formatted, " ")
+}
+
+func TestEnvironmentVariables(t *testing.T) {
+	variables := map[string]string{}
+	for _, variable := range EnvironmentVariables() {
+		variables[variable[0]] = variable[1]
+	}
+	expected := map[string]string{
+		"HIVE_BIND_ADDRESS":                "bindAddress",
+		"HIVE_LOCAL_ZONE_SERVER":           "localZone.server",
+		"HIVE_ANTI_ENTROPY_INTERVAL":       "antiEntropyInterval",
+		"HIVE_REACHABILITY_TCP_PORTS":      "reachability.tcpPorts",
+		"HIVE_LOGGING_SYSLOG_ADDRESS":      "logging.syslog.address",
+		"HIVE_HIGH_AVAILABILITY_LOCK_FILE": "highAvailability.lockFile",
+	}
+	for variable, setting := range expected {
+		if variables[variable] != setting {
+			t.Errorf("expected %s to override %s, got '%s'", variable, setting, variables[variable])
+		}
+	}
+	// lists of structures and maps cannot be given as a variable
+	for _, variable := range []string{"HIVE_PEERS", "HIVE_VIEWS", "HIVE_LOGGING_LEVELS"} {
+		if setting, present := variables[variable]; present {
+			t.Errorf("%s unexpectedly overrides %s", variable, setting)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"ttl", "TTL"},
+		{"bindAddress", "BIND_ADDRESS"},
+		{"antiEntropyInterval", "ANTI_ENTROPY_INTERVAL"},
+		{"maxSizeMB", "MAX_SIZE_MB"},
+		{"tcpPorts", "TCP_PORTS"},
+		{"udpEcho", "UDP_ECHO"},
+		{"id", "ID"},
+		{"TTL", "TTL"},
+		{"serverID", "SERVER_ID"},
+		{"httpTLSListen", "HTTP_TLS_LISTEN"},
+	}
+	for _, test := range tests {
+		if converted := envName(test.name); converted != test.expected {
+			t.Errorf("expected %s converted to %s, got %s", test.name, test.expected, converted)
+		}
+	}
+	// the audit settings name their acronyms as such
+	variables := map[string]string{}
+	for _, variable := range EnvironmentVariables() {
+		variables[variable[0]] = variable[1]
+	}
+	if setting := variables["HIVE_AUDIT_MAX_SIZE_MB"]; setting != "audit.maxSizeMB" {
+		t.Errorf("expected HIVE_AUDIT_MAX_SIZE_MB to override audit.maxSizeMB, got '%s'", setting)
+	}
+}
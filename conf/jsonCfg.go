@@ -5,20 +5,154 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// DefaultPort is the port assumed for DNS servers and listeners configured without one.
+const DefaultPort = 53
+
 type ZonePeer struct {
 	Suffix string   // e.g. west.example.com.
-	Server net.Addr // e.g. 10.1.0.1
+	Server net.Addr // e.g. 10.1.0.1:53
+}
+
+// View selects the site a rendezvous name is answered with for queriers within a set of subnets.
+type View struct {
+	Name    string       // e.g. west
+	Subnets []*net.IPNet // e.g. [10.0.0.0/16]
+	Prefer  []string     // site suffixes in preference order, e.g. [west.example.com., east.example.com.]
+}
+
+// Reachability configures how the hosts a contested rendezvous name may point to (at several sites) are probed.
+type Reachability struct {
+	TCPPorts []int         // ports a TCP connection is attempted to, e.g. [22, 443]
+	UDPEcho  bool          // whether a datagram is echoed by the host's UDP echo service (port 7)
+	Interval time.Duration // how often hosts are probed
+	Timeout  time.Duration // how long each probe is given to succeed
+}
+
+// Catalog configures discovery of peers from the member zones of an RFC9432 catalog zone (in addition to those
+// configured). The server of each member is given by its "server" custom property (at
+// server.ext.<member id>.zones.<catalog>) as a TXT record holding a "host[:port]" address, or as an A/AAAA record.
+type Catalog struct {
+	Zone     string        // e.g. catalog.example.com.
+	Server   net.Addr      // the server of the catalog zone, by default that of the local zone
+	Interval time.Duration // how often the catalog zone is transferred, in addition to when notified of changes
+}
+
+// HighAvailability configures active/standby operation of several Hive instances at a site. Only the instance holding
+// the leadership lease writes to the primary; the others keep their zones up to date, and take over once the lease
+// expires unrenewed.
+type HighAvailability struct {
+	ID       string        // unique among the instances of the site, by default the hostname
+	LockFile string        // holds the lease in a file on local disk (e.g. for testing), rather than the rendezvous zone
+	Lease    time.Duration // how long the lease lasts unrenewed, bounding how long failover takes
+}
+
+// Admin configures the HTTP administration API, whose requests must carry the bearer token.
+type Admin struct {
+	Listen string // host:port, e.g. 127.0.0.1:8053
+	Token  string
+}
+
+// Metrics configures the HTTP listener serving metrics in the Prometheus text format at /metrics.
+type Metrics struct {
+	Listen string // host:port, e.g. 127.0.0.1:9153
+}
+
+// Health configures the HTTP listener serving the liveness and readiness of the engine at /healthz and /readyz.
+type Health struct {
+	Listen string // host:port, e.g. 127.0.0.1:8080
+}
+
+// Logging configures the format, verbosity and destination of log records.
+type Logging struct {
+	Format string            // logfmt (the default) or json
+	Level  string            // debug, info (the default), warn or error
+	Levels map[string]string // by subsystem, overriding the level
+	Syslog *Syslog           // if not nil, records are sent to syslog rather than standard output
+}
+
+// Syslog configures sending log records to syslog: to the local daemon if the network and address are empty, otherwise
+// e.g. to udp 10.0.0.1:514.
+type Syslog struct {
+	Network string
+	Address string
+	Tag     string
+}
+
+// Audit configures the audit log: JSON lines appended to a file, rotated before exceeding MaxSize bytes, keeping at
+// most MaxFiles rotations.
+type Audit struct {
+	File     string
+	MaxSize  int64
+	MaxFiles int
 }
 
 type Configuration struct {
 	LocalNets    []*net.IPNet // e.g. [10.1.0.0/16]
 	LocalZone    *ZonePeer
-	SearchSuffix string      // e.g. rdvu.example.com.
+	SearchSuffix string // e.g. rdvu.example.com.
 	Peers        []*ZonePeer
-	BindAddress  net.Addr    // e.g. 10.1.0.2
-	TTL          uint32      // record time to live in seconds
+	TTL          uint32 // record time to live in seconds
+	// ListenAddresses are the host:port addresses Hive serves DNS on, e.g. [10.1.0.2:53, [fd00:1::2]:5353]
+	ListenAddresses []net.Addr
+	// ListenNetworks are the transports served on each listen address, e.g. [udp, tcp]
+	ListenNetworks []string
+	// AnswerQueries enables authoritative answers to standard queries for the zones Hive serves
+	AnswerQueries bool
+	// Views (consulted in order) steer query answers for rendezvous names toward a site based on querier address
+	Views []*View
+	// ReconcileDelay is how long the rendezvous zone recomputation waits for changes to stop arriving
+	ReconcileDelay time.Duration
+	// ReconcileMaxDelay bounds how long the rendezvous zone recomputation may be deferred by continuing changes
+	ReconcileMaxDelay time.Duration
+	// WriteConcurrency bounds how many updates are pipelined to the primary at once
+	WriteConcurrency int
+	// WriteTimeout is how long the primary is given to reply to an update before it is retried
+	WriteTimeout time.Duration
+	// ProbeInterval is how often each peer is probed for liveness, or zero if peers are not probed
+	ProbeInterval time.Duration
+	// PeerDownAfter is how many consecutive failed probes mark a (degraded) peer as down, or zero if peers are never
+	// considered down
+	PeerDownAfter int
+	// PeerGracePeriod is how long a peer may be down before its mappings are withdrawn from the rendezvous zone, or
+	// zero if they are never withdrawn
+	PeerGracePeriod time.Duration
+	// AntiEntropyInterval is how often each peer's zone is compared with its copy by digest, or zero if never
+	AntiEntropyInterval time.Duration
+	// Reachability enables selecting the target of contested rendezvous names by probing the hosts, if not nil
+	Reachability *Reachability
+	// Catalog enables discovery of peers from a catalog zone, if not nil
+	Catalog *Catalog
+	// HighAvailability enables leader election among several instances at the site, if not nil
+	HighAvailability *HighAvailability
+	// Admin enables the HTTP administration API, if not nil
+	Admin *Admin
+	// Metrics enables serving metrics, if not nil
+	Metrics *Metrics
+	// Health enables serving health checks, if not nil
+	Health *Health
+	// Logging configures log records; logfmt to standard output at the info level if nil
+	Logging *Logging
+	// Audit enables the audit log, if not nil
+	Audit *Audit
+
+	unqualified []string // domain names configured without the trailing dot, as reported by Check
+}
+
+// Errors lists every setting of a configuration found invalid when parsing it.
+type Errors []error
+
+func (e Errors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
 }
 
 type parsePeer struct {
@@ -26,59 +160,488 @@ type parsePeer struct {
 	Server string `json:"server"`
 }
 
+type parseView struct {
+	Name    string   `json:"name"`
+	Subnets []string `json:"subnets"`
+	Prefer  []string `json:"prefer"`
+}
+
+type parseReachability struct {
+	TCPPorts []int  `json:"tcpPorts"`
+	UDPEcho  bool   `json:"udpEcho"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+type parseCatalog struct {
+	Zone     string `json:"zone"`
+	Server   string `json:"server"`
+	Interval string `json:"interval"`
+}
+
+type parseHighAvailability struct {
+	ID       string `json:"id"`
+	LockFile string `json:"lockFile"`
+	Lease    string `json:"lease"`
+}
+
+type parseAdmin struct {
+	Listen    string `json:"listen"`
+	Token     string `json:"token"`
+	TokenFile string `json:"tokenFile"` // read instead of the token, to keep it out of the configuration file
+}
+
+type parseMetrics struct {
+	Listen string `json:"listen"`
+}
+
+type parseHealth struct {
+	Listen string `json:"listen"`
+}
+
+type parseSyslog struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Tag     string `json:"tag"`
+}
+
+type parseLogging struct {
+	Format string            `json:"format"`
+	Level  string            `json:"level"`
+	Levels map[string]string `json:"levels"`
+	Syslog *parseSyslog      `json:"syslog"`
+}
+
+type parseAudit struct {
+	File      string `json:"file"`
+	MaxSizeMB int    `json:"maxSizeMB"` // default 100
+	MaxFiles  int    `json:"maxFiles"`  // default 10
+}
+
 type parseConfiguration struct {
-	LocalNets    []string     `json:"localNets"`
-	LocalZone    *parsePeer   `json:"localZone"`
-	SearchSuffix string       `json:"searchSuffix"`
-	Peers        []*parsePeer `json:"peers"`
-	BindAddress  string       `json:"bindAddress"`
-	TTL          uint32       `json:"ttl"`
+	LocalNets      []string     `json:"localNets"`
+	LocalZone      *parsePeer   `json:"localZone"`
+	SearchSuffix   string       `json:"searchSuffix"`
+	Peers          []*parsePeer `json:"peers"`
+	BindAddress    string       `json:"bindAddress"` // superseded by listen, equivalent to a single entry on port 53
+	Listen         []string     `json:"listen"`
+	ListenNetworks []string     `json:"listenNetworks"`
+	TTL            uint32       `json:"ttl"`
+	AnswerQueries  bool         `json:"answerQueries"`
+	Views          []*parseView `json:"views"`
+	// durations are strings such as "500ms" or "5s"
+	ReconcileDelay      string `json:"reconcileDelay"`
+	ReconcileMaxDelay   string `json:"reconcileMaxDelay"`
+	WriteConcurrency    int    `json:"writeConcurrency"`
+	WriteTimeout        string `json:"writeTimeout"`
+	ProbeInterval       string `json:"probeInterval"`
+	PeerDownAfter       int    `json:"peerDownAfter"`
+	PeerGracePeriod     string `json:"peerGracePeriod"`
+	AntiEntropyInterval string `json:"antiEntropyInterval"`
+
+	Reachability *parseReachability `json:"reachability"`
+	Catalog      *parseCatalog      `json:"catalog"`
+
+	HighAvailability *parseHighAvailability `json:"highAvailability"`
+	Admin            *parseAdmin            `json:"admin"`
+	Metrics          *parseMetrics          `json:"metrics"`
+	Health           *parseHealth           `json:"health"`
+	Logging          *parseLogging          `json:"logging"`
+	Audit            *parseAudit            `json:"audit"`
+}
+
+// ParseAddress resolves a "host", "host:port", or "[ipv6]:port" address, assuming DefaultPort when the port is absent.
+func ParseAddress(address string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// no port present (bare IPv6 addresses are not split either)
+		host, port = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]"), strconv.Itoa(DefaultPort)
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+}
+
+// qualify normalizes a domain name as fully qualified (with the trailing dot) and in lower case, as Hive compares them.
+func qualify(name string) string {
+	if name == "" {
+		return ""
+	}
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
 }
 
+// AddrIP extracts the IP address from an address as configured or observed on a connection.
+func AddrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// inhabitConfig validates the settings parsed and inhabits a configuration with them, returning every setting found
+// invalid as Errors. The configuration is inhabited as far as possible regardless, for its semantics to be checked.
 func (pc *parseConfiguration) inhabitConfig(c *Configuration) error {
-	c.SearchSuffix = pc.SearchSuffix
+	var errs Errors
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	// domain names are compared fully qualified, but those that were not are reported by Check
+	qualifyName := func(what, name string) string {
+		if name != "" && !strings.HasSuffix(name, ".") {
+			c.unqualified = append(c.unqualified, fmt.Sprintf("%s '%s'", what, name))
+		}
+		return qualify(name)
+	}
+
+	c.SearchSuffix = qualifyName("search suffix", pc.SearchSuffix)
 	c.TTL = pc.TTL
+	c.AnswerQueries = pc.AnswerQueries
 	if c.TTL < 300 {
-		return fmt.Errorf("ttl must be at least 300 seconds but got %d seconds", c.TTL)
+		invalid("ttl must be at least 300 seconds but got %d seconds", c.TTL)
 	}
+	c.LocalZone = &ZonePeer{}
 	if pc.LocalZone == nil {
-		return fmt.Errorf("localZone must be specified")
-	}
-	c.LocalZone = &ZonePeer{
-		Suffix: pc.LocalZone.Suffix,
-	}
-	if addr, err := net.ResolveIPAddr("ip", pc.LocalZone.Server); err != nil {
-		return fmt.Errorf("zone primary address '%v' invalid: %v", pc.LocalZone.Server, err)
+		invalid("localZone must be specified")
 	} else {
-		c.LocalZone.Server = addr
+		c.LocalZone.Suffix = qualifyName("local zone suffix", pc.LocalZone.Suffix)
+		if addr, err := ParseAddress(pc.LocalZone.Server); err != nil {
+			invalid("zone primary address '%v' invalid: %v", pc.LocalZone.Server, err)
+		} else {
+			c.LocalZone.Server = addr
+		}
 	}
+	listen := pc.Listen
 	if pc.BindAddress != "" {
-		if addr, err := net.ResolveIPAddr("ip", pc.BindAddress); err != nil {
-			return fmt.Errorf("bind address '%v' invalid: %v", pc.BindAddress, err)
+		listen = append(listen, pc.BindAddress)
+	}
+	if len(listen) == 0 {
+		// listen on all addresses
+		listen = []string{""}
+	}
+	for idx, address := range listen {
+		if addr, err := ParseAddress(address); err != nil {
+			invalid("listen address %d with value '%v' invalid: %v", idx, address, err)
 		} else {
-			c.BindAddress = addr
+			c.ListenAddresses = append(c.ListenAddresses, addr)
+		}
+	}
+	c.ListenNetworks = pc.ListenNetworks
+	if len(c.ListenNetworks) == 0 {
+		c.ListenNetworks = []string{"udp", "tcp"}
+	}
+	for _, network := range c.ListenNetworks {
+		switch network {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		default:
+			invalid("listen network '%v' invalid", network)
 		}
 	}
 	for idx, localNet := range pc.LocalNets {
 		if _, netAddr, err := net.ParseCIDR(localNet); err != nil {
-			return fmt.Errorf("local net %d with value '%v' invalid: %v", idx, localNet, err)
+			invalid("local net %d with value '%v' invalid: %v", idx, localNet, err)
 		} else {
 			c.LocalNets = append(c.LocalNets, netAddr)
 		}
 	}
+	// proposals and notifications are attributed to the primary or a peer by the address they come from alone (they are
+	// sent from ephemeral ports), so each must have a server address of its own
+	servers := map[string]string{}
+	if c.LocalZone.Server != nil {
+		servers[AddrIP(c.LocalZone.Server).String()] = "the zone primary"
+	}
 	for idx, peer := range pc.Peers {
-		if addr, err := net.ResolveIPAddr("ip", peer.Server); err != nil {
-			return fmt.Errorf("peer %d with value '%v' invalid: %v", idx, peer, err)
+		addr, err := ParseAddress(peer.Server)
+		if err != nil {
+			invalid("peer %d with value '%v' invalid: %v", idx, peer, err)
+			continue
+		}
+		ip := AddrIP(addr).String()
+		if other, present := servers[ip]; present {
+			invalid("peer %d server shares the address %s with %s", idx, ip, other)
+			continue
+		}
+		servers[ip] = fmt.Sprintf("peer %d", idx)
+		c.Peers = append(c.Peers, &ZonePeer{
+			Suffix: qualifyName(fmt.Sprintf("peer %d suffix", idx), peer.Suffix),
+			Server: addr,
+		})
+	}
+	c.ReconcileDelay = 500 * time.Millisecond
+	if pc.ReconcileDelay != "" {
+		if delay, err := time.ParseDuration(pc.ReconcileDelay); err != nil {
+			invalid("reconcile delay '%v' invalid: %v", pc.ReconcileDelay, err)
+		} else {
+			c.ReconcileDelay = delay
+		}
+	}
+	c.ReconcileMaxDelay = 5 * time.Second
+	if pc.ReconcileMaxDelay != "" {
+		if delay, err := time.ParseDuration(pc.ReconcileMaxDelay); err != nil {
+			invalid("reconcile max delay '%v' invalid: %v", pc.ReconcileMaxDelay, err)
+		} else {
+			c.ReconcileMaxDelay = delay
+		}
+	}
+	if c.ReconcileMaxDelay < c.ReconcileDelay {
+		invalid("reconcile max delay %v must not be less than reconcile delay %v", c.ReconcileMaxDelay,
+			c.ReconcileDelay)
+	}
+	c.WriteConcurrency = 8
+	if pc.WriteConcurrency < 0 {
+		invalid("write concurrency %v invalid: must be positive", pc.WriteConcurrency)
+	} else if pc.WriteConcurrency > 0 {
+		c.WriteConcurrency = pc.WriteConcurrency
+	}
+	c.WriteTimeout = 5 * time.Second
+	if pc.WriteTimeout != "" {
+		if timeout, err := time.ParseDuration(pc.WriteTimeout); err != nil {
+			invalid("write timeout '%v' invalid: %v", pc.WriteTimeout, err)
+		} else if timeout <= 0 {
+			invalid("write timeout '%v' invalid: must be positive", pc.WriteTimeout)
+		} else {
+			c.WriteTimeout = timeout
+		}
+	}
+	if pc.ProbeInterval != "" {
+		if interval, err := time.ParseDuration(pc.ProbeInterval); err != nil {
+			invalid("probe interval '%v' invalid: %v", pc.ProbeInterval, err)
+		} else if interval < 0 {
+			invalid("probe interval '%v' invalid: must not be negative", pc.ProbeInterval)
+		} else {
+			c.ProbeInterval = interval
+		}
+	}
+	if pc.PeerDownAfter < 0 {
+		invalid("peer down after %v invalid: must not be negative", pc.PeerDownAfter)
+	} else {
+		c.PeerDownAfter = pc.PeerDownAfter
+	}
+	if pc.PeerGracePeriod != "" {
+		if period, err := time.ParseDuration(pc.PeerGracePeriod); err != nil {
+			invalid("peer grace period '%v' invalid: %v", pc.PeerGracePeriod, err)
+		} else if period < 0 {
+			invalid("peer grace period '%v' invalid: must not be negative", pc.PeerGracePeriod)
 		} else {
-			c.Peers = append(c.Peers, &ZonePeer{
-				Suffix: peer.Suffix,
-				Server: addr,
-			})
+			c.PeerGracePeriod = period
 		}
 	}
+	for idx, view := range pc.Views {
+		parsed := &View{
+			Name: view.Name,
+		}
+		for _, suffix := range view.Prefer {
+			parsed.Prefer = append(parsed.Prefer, qualifyName(fmt.Sprintf("view '%s' preference", view.Name), suffix))
+		}
+		for _, subnet := range view.Subnets {
+			if _, netAddr, err := net.ParseCIDR(subnet); err != nil {
+				invalid("view %d subnet with value '%v' invalid: %v", idx, subnet, err)
+			} else {
+				parsed.Subnets = append(parsed.Subnets, netAddr)
+			}
+		}
+		c.Views = append(c.Views, parsed)
+	}
+	if pc.AntiEntropyInterval != "" {
+		if interval, err := time.ParseDuration(pc.AntiEntropyInterval); err != nil {
+			invalid("anti-entropy interval '%v' invalid: %v", pc.AntiEntropyInterval, err)
+		} else if interval < 0 {
+			invalid("anti-entropy interval '%v' invalid: must not be negative", pc.AntiEntropyInterval)
+		} else {
+			c.AntiEntropyInterval = interval
+		}
+	}
+	if pc.Catalog != nil {
+		if pc.Catalog.Zone == "" {
+			invalid("catalog zone name missing")
+		}
+		c.Catalog = &Catalog{
+			Zone:     qualifyName("catalog zone", pc.Catalog.Zone),
+			Server:   c.LocalZone.Server,
+			Interval: 5 * time.Minute,
+		}
+		if pc.Catalog.Server != "" {
+			if addr, err := ParseAddress(pc.Catalog.Server); err != nil {
+				invalid("catalog server '%v' invalid: %v", pc.Catalog.Server, err)
+			} else {
+				c.Catalog.Server = addr
+			}
+		}
+		if pc.Catalog.Interval != "" {
+			if interval, err := time.ParseDuration(pc.Catalog.Interval); err != nil {
+				invalid("catalog interval '%v' invalid: %v", pc.Catalog.Interval, err)
+			} else if interval <= 0 {
+				invalid("catalog interval '%v' invalid: must be positive", pc.Catalog.Interval)
+			} else {
+				c.Catalog.Interval = interval
+			}
+		}
+	}
+	if pc.HighAvailability != nil {
+		c.HighAvailability = &HighAvailability{
+			ID:       pc.HighAvailability.ID,
+			LockFile: pc.HighAvailability.LockFile,
+			Lease:    15 * time.Second,
+		}
+		if c.HighAvailability.ID == "" {
+			if hostname, err := os.Hostname(); err != nil {
+				invalid("high availability id missing, and hostname unavailable: %v", err)
+			} else {
+				c.HighAvailability.ID = hostname
+			}
+		}
+		if strings.ContainsAny(c.HighAvailability.ID, " \t\"") {
+			invalid("high availability id '%v' invalid: must not contain whitespace or quotes",
+				c.HighAvailability.ID)
+		}
+		if pc.HighAvailability.Lease != "" {
+			if lease, err := time.ParseDuration(pc.HighAvailability.Lease); err != nil {
+				invalid("high availability lease '%v' invalid: %v", pc.HighAvailability.Lease, err)
+			} else if lease < time.Second {
+				invalid("high availability lease '%v' invalid: must be at least 1s",
+					pc.HighAvailability.Lease)
+			} else {
+				c.HighAvailability.Lease = lease
+			}
+		}
+	}
+	if pc.Logging != nil {
+		switch strings.ToLower(pc.Logging.Format) {
+		case "", "logfmt", "text", "json":
+		default:
+			invalid("log format '%s' unknown (expected logfmt or json)", pc.Logging.Format)
+		}
+		if pc.Logging.Level != "" && !validLogLevel(pc.Logging.Level) {
+			invalid("log level '%s' unknown (expected debug, info, warn or error)", pc.Logging.Level)
+		}
+		for subsystem, level := range pc.Logging.Levels {
+			if !validLogLevel(level) {
+				invalid("log level '%s' of subsystem '%s' unknown (expected debug, info, warn or error)",
+					level, subsystem)
+			}
+		}
+		c.Logging = &Logging{
+			Format: pc.Logging.Format,
+			Level:  pc.Logging.Level,
+			Levels: pc.Logging.Levels,
+		}
+		if pc.Logging.Syslog != nil {
+			c.Logging.Syslog = &Syslog{
+				Network: pc.Logging.Syslog.Network,
+				Address: pc.Logging.Syslog.Address,
+				Tag:     pc.Logging.Syslog.Tag,
+			}
+		}
+	}
+	if pc.Audit != nil {
+		if pc.Audit.File == "" {
+			invalid("audit log file missing")
+		}
+		c.Audit = &Audit{
+			File:     pc.Audit.File,
+			MaxSize:  100 << 20,
+			MaxFiles: 10,
+		}
+		if pc.Audit.MaxSizeMB < 0 {
+			invalid("audit log maximum size %d MB invalid", pc.Audit.MaxSizeMB)
+		} else if pc.Audit.MaxSizeMB > 0 {
+			c.Audit.MaxSize = int64(pc.Audit.MaxSizeMB) << 20
+		}
+		if pc.Audit.MaxFiles < 0 {
+			invalid("audit log maximum files %d invalid", pc.Audit.MaxFiles)
+		} else if pc.Audit.MaxFiles > 0 {
+			c.Audit.MaxFiles = pc.Audit.MaxFiles
+		}
+	}
+	if pc.Metrics != nil {
+		if _, _, err := net.SplitHostPort(pc.Metrics.Listen); err != nil {
+			invalid("metrics listen address '%v' invalid: %v", pc.Metrics.Listen, err)
+		}
+		c.Metrics = &Metrics{
+			Listen: pc.Metrics.Listen,
+		}
+	}
+	if pc.Health != nil {
+		if _, _, err := net.SplitHostPort(pc.Health.Listen); err != nil {
+			invalid("health listen address '%v' invalid: %v", pc.Health.Listen, err)
+		}
+		c.Health = &Health{
+			Listen: pc.Health.Listen,
+		}
+	}
+	if pc.Admin != nil {
+		if _, _, err := net.SplitHostPort(pc.Admin.Listen); err != nil {
+			invalid("admin listen address '%v' invalid: %v", pc.Admin.Listen, err)
+		}
+		c.Admin = &Admin{
+			Listen: pc.Admin.Listen,
+			Token:  pc.Admin.Token,
+		}
+		if pc.Admin.TokenFile != "" {
+			if token, err := ioutil.ReadFile(pc.Admin.TokenFile); err != nil {
+				invalid("admin token file '%v' unreadable: %v", pc.Admin.TokenFile, err)
+			} else {
+				c.Admin.Token = strings.TrimSpace(string(token))
+			}
+		}
+		if c.Admin.Token == "" {
+			invalid("admin token missing")
+		}
+	}
+	if pc.Reachability != nil {
+		if len(pc.Reachability.TCPPorts) == 0 && !pc.Reachability.UDPEcho {
+			invalid("reachability invalid: no TCP ports or UDP echo to probe")
+		}
+		c.Reachability = &Reachability{
+			UDPEcho:  pc.Reachability.UDPEcho,
+			Interval: time.Minute,
+			Timeout:  time.Second,
+		}
+		for _, port := range pc.Reachability.TCPPorts {
+			if port < 1 || port > 65535 {
+				invalid("reachability TCP port %v invalid", port)
+			}
+			c.Reachability.TCPPorts = append(c.Reachability.TCPPorts, port)
+		}
+		if pc.Reachability.Interval != "" {
+			if interval, err := time.ParseDuration(pc.Reachability.Interval); err != nil {
+				invalid("reachability interval '%v' invalid: %v", pc.Reachability.Interval, err)
+			} else if interval <= 0 {
+				invalid("reachability interval '%v' invalid: must be positive", pc.Reachability.Interval)
+			} else {
+				c.Reachability.Interval = interval
+			}
+		}
+		if pc.Reachability.Timeout != "" {
+			if timeout, err := time.ParseDuration(pc.Reachability.Timeout); err != nil {
+				invalid("reachability timeout '%v' invalid: %v", pc.Reachability.Timeout, err)
+			} else if timeout <= 0 {
+				invalid("reachability timeout '%v' invalid: must be positive", pc.Reachability.Timeout)
+			} else {
+				c.Reachability.Timeout = timeout
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "warning", "error":
+		return true
+	}
+	return false
+}
+
 func (c *Configuration) UnmarshalJSON(b []byte) error {
 	parseCfg := &parseConfiguration{}
 	if err := json.Unmarshal(b, &parseCfg); err != nil {
@@ -86,15 +649,3 @@ func (c *Configuration) UnmarshalJSON(b []byte) error {
 	}
 	return parseCfg.inhabitConfig(c)
 }
-
-func ParseFile(confFile string) (*Configuration, error) {
-	data, err := ioutil.ReadFile(confFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %v", err)
-	}
-	config := &Configuration{}
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, err
-	}
-	return config, nil
-}
@@ -0,0 +1,89 @@
+package conf
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string // empty if invalid
+	}{
+		{"10.0.0.2:5353", "10.0.0.2:5353"},
+		{"10.0.0.2", "10.0.0.2:53"},
+		{"[fd00::2]:5353", "[fd00::2]:5353"},
+		{"[fd00::2]", "[fd00::2]:53"},
+		{"fd00::2", "[fd00::2]:53"},
+		{":5353", ":5353"},
+		{"", ":53"},
+		{"10.0.0.2:domain", "10.0.0.2:53"},
+		{"10.0.0.2:notaport", ""},
+		{"10.0.0.2:70000", ""},
+		{"10.0.0.2:53:53", ""},
+	}
+	for _, test := range tests {
+		addr, err := ParseAddress(test.address)
+		switch {
+		case test.expected == "" && err == nil:
+			t.Errorf("'%s': expected invalid, got %v", test.address, addr)
+		case test.expected != "" && err != nil:
+			t.Errorf("'%s': unexpectedly invalid: %v", test.address, err)
+		case test.expected != "" && addr.String() != test.expected:
+			t.Errorf("'%s': expected %s, got %v", test.address, test.expected, addr)
+		}
+	}
+}
+
+// listenConfig parses a configuration of the west site with listen settings, given as JSON members.
+func listenConfig(listen string) (*Configuration, error) {
+	config := &Configuration{}
+	err := json.Unmarshal([]byte(`{
+		"localNets": ["10.0.0.0/16"],
+		"localZone": {"suffix": "west.example.com.", "server": "10.0.0.2"},
+		"searchSuffix": "rdvu.example.com.",
+		"ttl": 300,
+		`+listen+`
+	}`), config)
+	return config, err
+}
+
+func TestListenAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		listen    string
+		addresses []string
+		networks  []string
+	}{
+		{"default", `"answerQueries": false`, []string{":53"}, []string{"udp", "tcp"}},
+		{"several", `"listen": ["10.0.0.3", "[fd00::3]:5353", ":5300"], "listenNetworks": ["udp4", "tcp"]`,
+			[]string{"10.0.0.3:53", "[fd00::3]:5353", ":5300"}, []string{"udp4", "tcp"}},
+		{"bind address", `"bindAddress": "10.0.0.3"`, []string{"10.0.0.3:53"}, []string{"udp", "tcp"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := listenConfig(test.listen)
+			if err != nil {
+				t.Fatalf("unable to parse: %v", err)
+			}
+			var addresses []string
+			for _, addr := range config.ListenAddresses {
+				addresses = append(addresses, addr.String())
+			}
+			if strings.Join(addresses, " ") != strings.Join(test.addresses, " ") {
+				t.Errorf("expected addresses %q, got %q", test.addresses, addresses)
+			}
+			if strings.Join(config.ListenNetworks, " ") != strings.Join(test.networks, " ") {
+				t.Errorf("expected networks %q, got %q", test.networks, config.ListenNetworks)
+			}
+		})
+	}
+
+	// each invalid address or network is reported
+	for _, listen := range []string{`"listen": ["10.0.0.3", "10.0.0.4:notaport"]`, `"listenNetworks": ["sctp"]`} {
+		if _, err := listenConfig(listen); err == nil {
+			t.Errorf("expected %s invalid", listen)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package health
+
+import (
+	"github.com/thyth/hive/hive"
+	"github.com/thyth/hive/logging"
+
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// superviseInterval is how often the readiness of the engine is checked, to notify systemd as it changes.
+const superviseInterval = time.Second
+
+// Notifier notifies systemd of the state of the service (per sd_notify), over the Unix datagram socket it names in
+// NOTIFY_SOCKET, for services of Type=notify. With the watchdog enabled (WatchdogSec=), it expects a keep-alive
+// within the interval given in WATCHDOG_USEC, or restarts the service.
+type Notifier struct {
+	socket   *net.UnixAddr
+	watchdog time.Duration
+}
+
+// NewNotifier prepares a Notifier from the environment systemd sets, or returns nil if there is no notification socket
+// (i.e. the service was not started by systemd with Type=notify). Abstract sockets, named with a leading @, are
+// supported.
+func NewNotifier() (*Notifier, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil, nil
+	}
+	n := &Notifier{
+		socket: &net.UnixAddr{Name: socket, Net: "unixgram"},
+	}
+	if usec := os.Getenv("WATCHDOG_USEC"); usec != "" {
+		// the watchdog may be meant for another process (e.g. the parent of this one)
+		if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			interval, err := strconv.ParseInt(usec, 10, 64)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("WATCHDOG_USEC '%s' invalid", usec)
+			}
+			n.watchdog = time.Duration(interval) * time.Microsecond
+		}
+	}
+	return n, nil
+}
+
+// Notify sends a notification of state, as newline separated assignments (e.g. READY=1). It does nothing for a nil
+// Notifier, so may be called whether or not run by systemd.
+func (n *Notifier) Notify(state string) error {
+	if n == nil {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.socket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to notification socket %s: %v", n.socket.Name, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify %s: %v", n.socket.Name, err)
+	}
+	return nil
+}
+
+// Supervise notifies systemd that the service has started once the engine is serving and has made its initial update
+// (READY=1), describes any problems keeping the engine from being ready (STATUS=, e.g. peers not yet transferred), and
+// sends keep-alives (WATCHDOG=1) at half the watchdog interval while the engine is alive, in the background until
+// stopped. A peer that stays unreachable does not hold up READY=1 (so systemd does not time out starting the service),
+// but fails /readyz.
+func (n *Notifier) Supervise(engine *hive.Engine) (stop func()) {
+	if n == nil {
+		return func() {}
+	}
+	interval := superviseInterval
+	if n.watchdog > 0 && n.watchdog/2 < interval {
+		interval = n.watchdog / 2
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		lastWatchdog := time.Time{}
+		ready := false
+		status := ""
+		for {
+			health := engine.Health()
+			var notifications []string
+			if n.watchdog > 0 && health.Alive() && time.Since(lastWatchdog) >= n.watchdog/2 {
+				notifications = append(notifications, "WATCHDOG=1")
+				lastWatchdog = time.Now()
+			}
+			if !ready && health.Alive() && health.Started {
+				notifications = append(notifications, "READY=1")
+				ready = true
+			}
+			next := "ready"
+			if problems := health.Problems(); len(problems) > 0 {
+				next = "not ready: " + strings.Join(problems, "; ")
+			}
+			if next != status {
+				notifications = append(notifications, "STATUS="+next)
+				status = next
+			}
+			if len(notifications) > 0 {
+				if err := n.Notify(strings.Join(notifications, "\n")); err != nil {
+					healthLog.Warn("unable to notify systemd", logging.Error, err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
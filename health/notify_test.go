@@ -0,0 +1,157 @@
+package health
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifySocket listens on a Unix datagram socket named in NOTIFY_SOCKET, as systemd does for services of Type=notify.
+func notifySocket(t *testing.T) *net.UnixConn {
+	name := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unable to listen on %s: %v", name, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	return conn
+}
+
+// receive reads the next notification, failing the test if there is none within the timeout.
+func receive(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	t.Helper()
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNewNotifier(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if n, err := NewNotifier(); n != nil || err != nil {
+		t.Fatalf("expected no notifier without a socket, got %+v (%v)", n, err)
+	}
+	// does nothing, without a notifier
+	var none *Notifier
+	if err := none.Notify("READY=1"); err != nil {
+		t.Errorf("nil notifier failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		usec     string
+		pid      string
+		watchdog time.Duration
+		err      bool
+	}{
+		{"no watchdog", "", "", 0, false},
+		{"watchdog", "30000000", "", 30 * time.Second, false},
+		{"watchdog of this process", "500", strconv.Itoa(os.Getpid()), 500 * time.Microsecond, false},
+		{"watchdog of another process", "500", strconv.Itoa(os.Getpid() + 1), 0, false},
+		{"invalid watchdog", "soon", "", 0, true},
+		{"zero watchdog", "0", "", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("NOTIFY_SOCKET", "@hive")
+			t.Setenv("WATCHDOG_USEC", test.usec)
+			t.Setenv("WATCHDOG_PID", test.pid)
+			notifier, err := NewNotifier()
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected WATCHDOG_USEC '%s' to be refused", test.usec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to prepare notifier: %v", err)
+			}
+			if notifier.socket.Name != "@hive" || notifier.watchdog != test.watchdog {
+				t.Errorf("expected socket @hive with watchdog %v, got %s with %v", test.watchdog,
+					notifier.socket.Name, notifier.watchdog)
+			}
+		})
+	}
+}
+
+func TestNotify(t *testing.T) {
+	conn := notifySocket(t)
+	notifier, err := NewNotifier()
+	if err != nil || notifier == nil {
+		t.Fatalf("unable to prepare notifier: %v", err)
+	}
+	if err := notifier.Notify("STOPPING=1"); err != nil {
+		t.Fatalf("unable to notify: %v", err)
+	}
+	if state := receive(t, conn, time.Second); state != "STOPPING=1" {
+		t.Errorf("expected STOPPING=1, got '%s'", state)
+	}
+
+	conn.Close()
+	if err := notifier.Notify("STOPPING=1"); err == nil {
+		t.Errorf("notified a closed socket")
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	conn := notifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	notifier, err := NewNotifier()
+	if err != nil || notifier == nil {
+		t.Fatalf("unable to prepare notifier: %v", err)
+	}
+	e, east, _ := testEngine(t, nil)
+	east.Close()
+
+	// not alive before starting, so neither keep-alives nor readiness are sent
+	stop := notifier.Supervise(e)
+	expected := "STATUS=not ready: listeners not serving; initial rendezvous update not made"
+	if state := receive(t, conn, time.Second); state != expected {
+		t.Fatalf("expected '%s', got '%s'", expected, state)
+	}
+
+	// ready once started, even with a peer not yet transferred, which is described
+	if err := e.Start(); err != nil {
+		t.Fatalf("unable to start engine: %v", err)
+	}
+	var assignments []string
+	for !strings.Contains(strings.Join(assignments, "\n"), "READY=1") {
+		assignments = append(assignments, strings.Split(receive(t, conn, time.Second), "\n")...)
+	}
+	expected = "STATUS=not ready: zone 'east.example.com.' of peer " + east.Addr.String() + " not transferred (peer up)"
+	if assignments[0] != "WATCHDOG=1" || assignments[len(assignments)-1] != expected {
+		t.Fatalf("expected a keep-alive, then readiness with '%s', got %q", expected, assignments)
+	}
+
+	// keep-alives continue at half the watchdog interval while alive, with no repetition of readiness
+	for idx := 0; idx < 3; idx++ {
+		if state := receive(t, conn, time.Second); state != "WATCHDOG=1" {
+			t.Fatalf("expected WATCHDOG=1, got '%s'", state)
+		}
+	}
+
+	// and cease once stopped (after any already sent)
+	stop()
+	stop()
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("notified '%s' after being stopped", buf[:n])
+	}
+}
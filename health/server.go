@@ -0,0 +1,116 @@
+package health
+
+import (
+	"github.com/thyth/hive/hive"
+	"github.com/thyth/hive/logging"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var healthLog = logging.For("health")
+
+// Status is the body of a response to /healthz or /readyz.
+type Status struct {
+	Status   string   `json:"status"`             // ok, or failing
+	Problems []string `json:"problems,omitempty"` // why the check fails
+	Peers    []*Peer  `json:"peers,omitempty"`    // of /readyz
+}
+
+// Peer is the health of a peer, as given by /readyz.
+type Peer struct {
+	Zone         string `json:"zone"`
+	Server       string `json:"server"`
+	State        string `json:"state"`
+	Synchronized bool   `json:"synchronized"`
+	Withdrawn    bool   `json:"withdrawn,omitempty"`
+}
+
+// Server serves the liveness and readiness of an engine at /healthz and /readyz.
+type Server struct {
+	http *http.Server
+}
+
+// Handler serves the liveness of an engine at /healthz (whether it is serving requests, so need not be restarted) and
+// its readiness at /readyz (whether its rendezvous zone reflects every peer): 200 OK if the check passes, otherwise 503
+// Service Unavailable, with the problems found.
+func Handler(engine *hive.Engine) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := &Status{}
+		if !engine.Health().Alive() {
+			status.Problems = []string{"listeners not serving"}
+		}
+		writeStatus(w, r, status)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		health := engine.Health()
+		status := &Status{
+			Problems: health.Problems(),
+		}
+		for _, peer := range health.Peers {
+			status.Peers = append(status.Peers, &Peer{
+				Zone:         peer.Zone,
+				Server:       peer.Server.String(),
+				State:        peer.Liveness.State.String(),
+				Synchronized: peer.Synchronized,
+				Withdrawn:    peer.Liveness.Withdrawn,
+			})
+		}
+		writeStatus(w, r, status)
+	})
+	return mux
+}
+
+// Start binds a listener for the health checks of an engine and serves them in the background, until shut down.
+func Start(listen string, engine *hive.Engine) (*Server, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", listen, err)
+	}
+	s := &Server{
+		http: &http.Server{
+			Handler:           Handler(engine),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	go func() {
+		if err := s.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			healthLog.Error("health server failed", logging.Error, err)
+		}
+	}()
+	healthLog.Info("health checks listening", logging.Address, listener.Addr().String())
+	return s, nil
+}
+
+// Shutdown stops accepting requests, and waits for those in flight to complete (or the context to be done).
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// writeStatus responds with the status of a check, which passes if no problems were found.
+func writeStatus(w http.ResponseWriter, r *http.Request, status *Status) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code := http.StatusOK
+	status.Status = "ok"
+	if len(status.Problems) > 0 {
+		code = http.StatusServiceUnavailable
+		status.Status = "failing"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(status); err != nil {
+		healthLog.Warn("unable to write response", logging.Error, err)
+	}
+}
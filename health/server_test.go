@@ -0,0 +1,169 @@
+package health
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/hive"
+	"github.com/thyth/hive/internal/dnstest"
+	"github.com/thyth/hive/logging"
+
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logging.Configure(&conf.Logging{Level: "error"})
+	os.Exit(m.Run())
+}
+
+// testEngine prepares (but does not start) an engine for the west site, with a peer at the east site, adjusting its
+// configuration if needed. The engine is stopped by calling stop, or when the test completes.
+func testEngine(t *testing.T, adjust func(*conf.Configuration)) (e *hive.Engine, east *dnstest.Server, stop func()) {
+	primary := dnstest.NewServer(t, "127.0.0.1")
+	primary.AddZone("west.example.com.", "foo.west.example.com. A 10.0.0.100")
+	primary.AddZone("rdvu.example.com.")
+	east = dnstest.NewServer(t, "127.0.0.2")
+	east.AddZone("east.example.com.", "bar.east.example.com. A 10.1.0.100")
+
+	config := dnstest.Config(t, primary, east)
+	if adjust != nil {
+		adjust(config)
+	}
+	e = hive.NewEngine(config, dnstest.Key)
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			e.Stop(ctx)
+		})
+	}
+	t.Cleanup(stop)
+	return e, east, stop
+}
+
+// check requests a health check, returning the status code and the status.
+func check(t *testing.T, handler http.Handler, path string) (int, *Status) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	status := &Status{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), status); err != nil {
+		t.Fatalf("unable to decode %s response '%s': %v", path, recorder.Body.String(), err)
+	}
+	if recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("%s served as %s", path, recorder.Header().Get("Content-Type"))
+	}
+	return recorder.Code, status
+}
+
+// expectCheck requests a health check, failing the test unless it has the code and problems expected.
+func expectCheck(t *testing.T, handler http.Handler, path string, code int, problems ...string) *Status {
+	t.Helper()
+	actualCode, status := check(t, handler, path)
+	if actualCode != code || strings.Join(status.Problems, "\n") != strings.Join(problems, "\n") {
+		t.Fatalf("expected %s to be %d with problems %q, got %d with %q", path, code, problems, actualCode,
+			status.Problems)
+	}
+	expected := "ok"
+	if code != http.StatusOK {
+		expected = "failing"
+	}
+	if status.Status != expected {
+		t.Errorf("expected %s status '%s', got '%s'", path, expected, status.Status)
+	}
+	return status
+}
+
+// waitReady polls /readyz until it passes.
+func waitReady(t *testing.T, handler http.Handler) *Status {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, status := check(t, handler, "/readyz")
+		if code == http.StatusOK {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("never ready: %q", status.Problems)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	e, _, stop := testEngine(t, nil)
+	handler := Handler(e)
+	expectCheck(t, handler, "/healthz", http.StatusServiceUnavailable, "listeners not serving")
+	if err := e.Start(); err != nil {
+		t.Fatalf("unable to start engine: %v", err)
+	}
+	expectCheck(t, handler, "/healthz", http.StatusOK)
+	stop()
+	expectCheck(t, handler, "/healthz", http.StatusServiceUnavailable, "listeners not serving")
+}
+
+func TestReadiness(t *testing.T) {
+	e, east, _ := testEngine(t, func(config *conf.Configuration) {
+		config.ProbeInterval = 20 * time.Millisecond
+	})
+	handler := Handler(e)
+	expectCheck(t, handler, "/readyz", http.StatusServiceUnavailable, "listeners not serving",
+		"initial rendezvous update not made")
+
+	// unreachable as the engine starts, so its zone is not transferred
+	east.Close()
+	if err := e.Start(); err != nil {
+		t.Fatalf("unable to start engine: %v", err)
+	}
+	code, status := check(t, handler, "/readyz")
+	problem := "zone 'east.example.com.' of peer " + east.Addr.String() + " not transferred"
+	if code != http.StatusServiceUnavailable || len(status.Problems) != 1 ||
+		!strings.HasPrefix(status.Problems[0], problem) {
+		t.Fatalf("expected only the peer to keep the engine from being ready, got %d with %q", code, status.Problems)
+	}
+	if len(status.Peers) != 1 || status.Peers[0].Synchronized || status.Peers[0].Server != east.Addr.String() {
+		t.Fatalf("expected the unsynchronized peer, got %+v", status.Peers)
+	}
+
+	// ready once the peer replies to a probe, and its zone is transferred
+	east.Restart()
+	status = waitReady(t, handler)
+	if len(status.Peers) != 1 || !status.Peers[0].Synchronized || status.Peers[0].State != "up" {
+		t.Fatalf("expected the synchronized peer, got %+v", status.Peers[0])
+	}
+}
+
+func TestReadinessWithdrawn(t *testing.T) {
+	e, east, _ := testEngine(t, func(config *conf.Configuration) {
+		config.ProbeInterval = 20 * time.Millisecond
+		config.PeerDownAfter = 1
+		config.PeerGracePeriod = 10 * time.Millisecond
+	})
+	east.Close()
+	if err := e.Start(); err != nil {
+		t.Fatalf("unable to start engine: %v", err)
+	}
+
+	// a peer that stays unreachable keeps the engine from being ready only until its mappings are withdrawn
+	status := waitReady(t, Handler(e))
+	if len(status.Peers) != 1 || status.Peers[0].Synchronized || !status.Peers[0].Withdrawn ||
+		status.Peers[0].State != "down" {
+		t.Fatalf("expected the withdrawn peer, got %+v", status.Peers[0])
+	}
+}
+
+func TestMethods(t *testing.T) {
+	e, _, _ := testEngine(t, nil)
+	recorder := httptest.NewRecorder()
+	Handler(e).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/readyz", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("expected POST to be refused, got %d (allowing '%s')", recorder.Code, recorder.Header().Get("Allow"))
+	}
+}
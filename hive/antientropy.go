@@ -0,0 +1,139 @@
+package hive
+
+import (
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"strings"
+	"time"
+)
+
+var syncLog = logging.For("antientropy")
+
+// startAntiEntropy compares the copy of each peer's zone with the peer periodically in the background, until stopped.
+func (e *Engine) startAntiEntropy() {
+	if e.currentConfig().AntiEntropyInterval <= 0 {
+		close(e.syncDone)
+		return
+	}
+	go func() {
+		defer close(e.syncDone)
+		ticker := time.NewTicker(e.currentConfig().AntiEntropyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, peer := range e.currentPeers() {
+					if err := e.syncPeer(peer); err != nil {
+						syncLog.Warn("unable to synchronize zone of peer", logging.Zone, peer.Suffix,
+							logging.Peer, peer.Server.String(), logging.Error, err)
+					}
+				}
+			case <-e.syncStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopAntiEntropy stops comparing peer zones, waiting for any comparison in progress.
+func (e *Engine) stopAntiEntropy() {
+	close(e.syncStop)
+	<-e.syncDone
+}
+
+// syncPeer compares the digest of a peer's zone with that of its copy, and transfers the records of only the buckets
+// that differ. Peers that are not up are left to the liveness probes.
+func (e *Engine) syncPeer(peer *peerEntry) error {
+	e.livenessMutex.Lock()
+	state := peer.liveness.State
+	e.livenessMutex.Unlock()
+	if state != PeerUp {
+		return nil
+	}
+
+	zone := peer.zone
+	remote, err := xform.ReadDigest(peer.Server, e.key, peer.Suffix, probeTimeout)
+	if err != nil {
+		return err
+	}
+	version, mappings := xform.ZoneMappings(zone)
+	differing := xform.DifferingBuckets(xform.ZoneDigest(peer.Suffix, mappings), remote)
+	if len(differing) == 0 {
+		e.markSynchronized(zone)
+		return nil
+	}
+	syncLog.Info("zone of peer differs", logging.Zone, peer.Suffix, logging.Peer, peer.Server.String(),
+		"buckets", len(differing), "of", xform.DigestBuckets)
+	for _, bucket := range differing {
+		fetched, err := xform.ReadBucket(peer.Server, e.key, peer.Suffix, bucket, probeTimeout)
+		if err != nil {
+			return err
+		}
+		var changed []string
+		var applied bool
+		if version, changed, applied = applyBucket(zone, peer.Suffix, bucket, fetched, version); !applied {
+			// the peer's changes are arriving by other means; compare again next round
+			return nil
+		}
+		if len(changed) > 0 {
+			e.markDirty(zone, changed...)
+		}
+	}
+	e.markSynchronized(zone)
+	return nil
+}
+
+// applyBucket replaces the records of one bucket of a zone with those fetched from its server, returning the new version
+// of the zone and the names that changed. The records are only applied if the zone is still at the expected version
+// (i.e. nothing else changed it while the bucket was fetched, which the fetched records might predate).
+func applyBucket(zone *xform.Zone, zoneName string, bucket int, fetched []*xform.Mapping, version uint32) (uint32,
+	[]string, bool) {
+	replacement := emptyZone(nil)
+	for _, mapping := range fetched {
+		name := strings.ToLower(mapping.Name)
+		if !xform.Digested(zoneName, name) || xform.Bucket(name) != bucket {
+			continue
+		}
+		if mapping.IP != nil {
+			replacement.ARecords[name] = mapping.IP
+		} else {
+			replacement.CNAMERecords[name] = strings.ToLower(mapping.Target)
+		}
+	}
+
+	zone.Lock()
+	defer zone.Unlock()
+	if zone.Version != version {
+		return zone.Version, nil, false
+	}
+	current := emptyZone(nil)
+	for name, ip := range zone.ARecords {
+		if xform.Digested(zoneName, name) && xform.Bucket(name) == bucket {
+			current.ARecords[name] = ip
+		}
+	}
+	for name, target := range zone.CNAMERecords {
+		if xform.Digested(zoneName, name) && xform.Bucket(name) == bucket {
+			current.CNAMERecords[name] = target
+		}
+	}
+	changed := changedNames(current, replacement)
+	if len(changed) == 0 {
+		return zone.Version, nil, true
+	}
+	for _, name := range changed {
+		if ip, present := replacement.ARecords[name]; present {
+			zone.ARecords[name] = ip
+		} else {
+			delete(zone.ARecords, name)
+		}
+		if target, present := replacement.CNAMERecords[name]; present {
+			zone.CNAMERecords[name] = target
+		} else {
+			delete(zone.CNAMERecords, name)
+		}
+	}
+	zone.Version++
+	return zone.Version, changed, true
+}
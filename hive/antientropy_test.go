@@ -0,0 +1,113 @@
+package hive
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/internal/dnstest"
+	"github.com/thyth/hive/xform"
+
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestApplyBucket(t *testing.T) {
+	zoneName := "east.example.com."
+	foo := "foo.east.example.com."
+	bucket := xform.Bucket(foo)
+	// another name, hashed to another bucket
+	other := ""
+	for host := 0; other == ""; host++ {
+		if name := fmt.Sprintf("host%d.east.example.com.", host); xform.Bucket(name) != bucket {
+			other = name
+		}
+	}
+	zone := emptyZone(nil)
+	zone.ARecords[foo] = net.ParseIP("10.1.0.100")
+	zone.ARecords[other] = net.ParseIP("10.1.0.101")
+	zone.Version = 7
+	fetched := []*xform.Mapping{
+		{Name: "FOO.east.example.com.", Target: "www.example.org."},
+		// records of other buckets, and the nameserver, are not the bucket's to replace
+		{Name: other, IP: net.ParseIP("10.1.0.200")},
+		{Name: "ns.east.example.com.", IP: net.ParseIP("10.1.0.2")},
+	}
+
+	if version, changed, applied := applyBucket(zone, zoneName, bucket, fetched, 6); applied || changed != nil ||
+		version != 7 {
+		t.Fatalf("bucket applied to a zone changed since (version %d, changed %v)", version, changed)
+	}
+	if zone.CNAMERecords[foo] != "" {
+		t.Fatalf("stale bucket replaced records")
+	}
+
+	version, changed, applied := applyBucket(zone, zoneName, bucket, fetched, 7)
+	if !applied || version != 8 || len(changed) != 1 || changed[0] != foo {
+		t.Fatalf("expected %s changed at version 8, got %v at version %d (applied %v)", foo, changed, version, applied)
+	}
+	if _, present := zone.ARecords[foo]; present || zone.CNAMERecords[foo] != "www.example.org." {
+		t.Errorf("address of %s was not replaced by its CNAME", foo)
+	}
+	if !zone.ARecords[other].Equal(net.ParseIP("10.1.0.101")) {
+		t.Errorf("record of another bucket was replaced")
+	}
+	if _, present := zone.ARecords["ns.east.example.com."]; present {
+		t.Errorf("nameserver record was applied")
+	}
+
+	// applying the same records again changes nothing
+	if version, changed, applied := applyBucket(zone, zoneName, bucket, fetched, 8); !applied || len(changed) != 0 ||
+		version != 8 {
+		t.Errorf("reapplying a bucket changed %v (version %d, applied %v)", changed, version, applied)
+	}
+}
+
+// TestSyncPeer runs an engine for the east site as the peer of one for the west site, diverging the zone east serves
+// from the copy west holds (as would a missed notification), then has west synchronize with it.
+func TestSyncPeer(t *testing.T) {
+	eastPrimary := newPeerServer(t, "127.0.0.3", "east.example.com.",
+		"foo.east.example.com. A 10.1.0.100",
+		"bar.east.example.com. A 10.1.0.101")
+	eastPrimary.AddZone("rdvu.example.com.")
+	eastConfig := dnstest.Config(t, eastPrimary)
+	_, eastNet, _ := net.ParseCIDR("10.1.0.0/16")
+	eastConfig.LocalNets = []*net.IPNet{eastNet}
+	eastConfig.LocalZone.Suffix = "east.example.com."
+	eastListen := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: dnstest.FreePort(t, "127.0.0.2")}
+	eastConfig.ListenAddresses = []net.Addr{eastListen}
+	east := startEngine(t, eastConfig)
+
+	primary := newPrimary(t)
+	config := dnstest.Config(t, primary)
+	config.Peers = append(config.Peers, &conf.ZonePeer{Suffix: "east.example.com.", Server: eastListen})
+	e := startEngine(t, config)
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "bar.rdvu.example.com.") == "bar.east.example.com."
+	})
+	peer := e.currentPeers()[0]
+	if err := e.syncPeer(peer); err != nil {
+		t.Fatalf("unable to synchronize: %v", err)
+	}
+
+	served := east.primaryZone
+	served.Lock()
+	served.ARecords["foo.east.example.com."] = net.ParseIP("10.1.0.200")
+	delete(served.ARecords, "bar.east.example.com.")
+	served.ARecords["baz.east.example.com."] = net.ParseIP("10.1.0.102")
+	served.Version++
+	served.Unlock()
+
+	if err := e.syncPeer(peer); err != nil {
+		t.Fatalf("unable to synchronize: %v", err)
+	}
+	_, expected := xform.ZoneMappings(served)
+	_, synchronized := xform.ZoneMappings(peer.zone)
+	zoneName := "east.example.com."
+	if differing := xform.DifferingBuckets(xform.ZoneDigest(zoneName, expected),
+		xform.ZoneDigest(zoneName, synchronized)); len(differing) != 0 {
+		t.Errorf("copy of the peer's zone still differs in buckets %v", differing)
+	}
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "bar.rdvu.example.com.") == "" &&
+			rendezvousTarget(primary, "baz.rdvu.example.com.") == "baz.east.example.com."
+	})
+}
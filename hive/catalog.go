@@ -0,0 +1,110 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"time"
+)
+
+var catalogLog = logging.For("catalog")
+
+// startCatalog discovers peers from the catalog zone at start, then periodically and whenever its server notifies a
+// change in the background, until stopped.
+func (e *Engine) startCatalog() {
+	if e.currentConfig().Catalog == nil {
+		close(e.catalogDone)
+		return
+	}
+	e.refreshCatalog()
+	go func() {
+		defer close(e.catalogDone)
+		ticker := time.NewTicker(e.currentConfig().Catalog.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.catalogRequest:
+			case <-e.catalogStop:
+				return
+			}
+			e.refreshCatalog()
+		}
+	}()
+}
+
+// stopCatalog stops discovering peers, waiting for any discovery in progress.
+func (e *Engine) stopCatalog() {
+	close(e.catalogStop)
+	<-e.catalogDone
+}
+
+// requestCatalog asks for the catalog zone to be transferred again, without waiting for it. Requests made while one is
+// already outstanding are coalesced.
+func (e *Engine) requestCatalog() {
+	select {
+	case e.catalogRequest <- struct{}{}:
+	default:
+	}
+}
+
+// refreshCatalog transfers the catalog zone, then adds the peers of new member zones and removes those of member zones
+// no longer listed (or now listed with another server). Member zones for the local site or a configured peer are
+// ignored. If the catalog zone cannot be transferred, the peers are left as they were.
+func (e *Engine) refreshCatalog() error {
+	config := e.currentConfig()
+	catalog := config.Catalog
+	zonePeers, err := xform.ReadCatalog(catalog.Server, e.key, catalog.Zone)
+	if err != nil {
+		catalogLog.Error("unable to transfer catalog zone", logging.Zone, catalog.Zone,
+			logging.Server, catalog.Server.String(), logging.Error, err)
+		return err
+	}
+
+	configured := map[string]bool{
+		dns.CanonicalName(config.LocalZone.Suffix): true,
+	}
+	for _, zonePeer := range config.Peers {
+		configured[dns.CanonicalName(zonePeer.Suffix)] = true
+	}
+	listed := map[string]*conf.ZonePeer{}
+	for _, zonePeer := range zonePeers {
+		if !configured[dns.CanonicalName(zonePeer.Suffix)] {
+			listed[dns.CanonicalName(zonePeer.Suffix)] = zonePeer
+		}
+	}
+
+	discovered := map[string]bool{}
+	for _, peer := range e.currentPeers() {
+		if !peer.discovered {
+			continue
+		}
+		suffix := dns.CanonicalName(peer.Suffix)
+		if zonePeer, present := listed[suffix]; present && zonePeer.Server.String() == peer.Server.String() {
+			discovered[suffix] = true
+			continue
+		}
+		catalogLog.Info("removing peer no longer in catalog zone", logging.Zone, peer.Suffix,
+			logging.Peer, peer.Server.String(), "catalog", catalog.Zone)
+		e.removePeer(peer)
+	}
+	// zonePeers is sorted, so peers discovered together are added in a stable priority order
+	for _, zonePeer := range zonePeers {
+		suffix := dns.CanonicalName(zonePeer.Suffix)
+		if listed[suffix] != zonePeer || discovered[suffix] {
+			continue
+		}
+		if _, taken := e.serverZone(conf.AddrIP(zonePeer.Server).String()); taken {
+			// proposals from the peer could not be told apart from those of the server already at its address
+			catalogLog.Error("ignoring peer from catalog zone sharing the address of another server",
+				logging.Zone, zonePeer.Suffix, logging.Peer, zonePeer.Server.String(), "catalog", catalog.Zone)
+			continue
+		}
+		catalogLog.Info("adding peer from catalog zone", logging.Zone, zonePeer.Suffix,
+			logging.Peer, zonePeer.Server.String(), "catalog", catalog.Zone)
+		e.addPeer(zonePeer, true)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package hive
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/internal/dnstest"
+
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setCatalog replaces the catalog zone on the primary, listing each member zone with the address of its server.
+func setCatalog(primary *dnstest.Server, members map[string]net.Addr) {
+	records := []string{"version.catalog.example.com. TXT \"2\""}
+	for zone, server := range members {
+		// member IDs are opaque; the first label of the zone serves, e.g. east for east.example.com.
+		id := strings.SplitN(zone, ".", 2)[0]
+		records = append(records,
+			fmt.Sprintf("%s.zones.catalog.example.com. PTR %s", id, zone),
+			fmt.Sprintf("server.ext.%s.zones.catalog.example.com. TXT \"%s\"", id, server.String()))
+	}
+	primary.AddZone("catalog.example.com.", records...)
+}
+
+// peerList lists the peers of an engine as their suffix and server, marking those discovered from the catalog.
+func peerList(e *Engine) []string {
+	var peers []string
+	for _, peer := range e.currentPeers() {
+		listed := peer.Suffix + " " + peer.Server.String()
+		if peer.discovered {
+			listed += " (discovered)"
+		}
+		peers = append(peers, listed)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func checkPeers(t *testing.T, e *Engine, expected ...string) {
+	t.Helper()
+	if peers := peerList(e); fmt.Sprint(peers) != fmt.Sprint(expected) {
+		t.Fatalf("expected peers %q, got %q", expected, peers)
+	}
+}
+
+func TestRefreshCatalog(t *testing.T) {
+	primary := newPrimary(t)
+	east := newPeerServer(t, "127.0.0.2", "east.example.com.", "foo.east.example.com. A 10.1.0.100")
+	north := newPeerServer(t, "127.0.0.3", "north.example.com.")
+	setCatalog(primary, map[string]net.Addr{
+		"west.example.com.":  primary.Addr,
+		"east.example.com.":  east.Addr,
+		"north.example.com.": north.Addr,
+	})
+	config := dnstest.Config(t, primary)
+	config.Peers = append(config.Peers, &conf.ZonePeer{Suffix: "north.example.com.", Server: north.Addr})
+	config.Catalog = &conf.Catalog{
+		Zone:     "catalog.example.com.",
+		Server:   primary.Addr,
+		Interval: time.Hour,
+	}
+	e := startEngine(t, config)
+
+	// the local site and configured peers listed in the catalog are not discovered again
+	checkPeers(t, e,
+		fmt.Sprintf("east.example.com. %v (discovered)", east.Addr),
+		fmt.Sprintf("north.example.com. %v", north.Addr))
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == "foo.east.example.com."
+	})
+
+	// a member whose server moved is replaced; one at the address of another server is ignored
+	moved := newPeerServer(t, "127.0.0.2", "east.example.com.", "bar.east.example.com. A 10.1.0.101")
+	setCatalog(primary, map[string]net.Addr{
+		"east.example.com.":  moved.Addr,
+		"south.example.com.": north.Addr,
+	})
+	e.refreshCatalog()
+	checkPeers(t, e,
+		fmt.Sprintf("east.example.com. %v (discovered)", moved.Addr),
+		fmt.Sprintf("north.example.com. %v", north.Addr))
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == "" &&
+			rendezvousTarget(primary, "bar.rdvu.example.com.") == "bar.east.example.com."
+	})
+
+	// a member removed from the catalog is withdrawn
+	setCatalog(primary, map[string]net.Addr{})
+	e.refreshCatalog()
+	checkPeers(t, e, fmt.Sprintf("north.example.com. %v", north.Addr))
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "bar.rdvu.example.com.") == ""
+	})
+
+	// a catalog that cannot be transferred leaves the peers as they were
+	primary.AddZone("catalog.example.com.", "version.catalog.example.com. TXT \"1\"")
+	e.refreshCatalog()
+	checkPeers(t, e, fmt.Sprintf("north.example.com. %v", north.Addr))
+}
@@ -0,0 +1,246 @@
+package hive
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var electionLog = logging.For("election")
+
+// leaseTimeout bounds each attempt to read or replace the lease record in the rendezvous zone.
+const leaseTimeout = 5 * time.Second
+
+// Elector decides which of several Hive instances at a site is the leader, by a lease each instance periodically
+// attempts to acquire (or renew, while it holds it).
+type Elector interface {
+	// Acquire acquires or renews the lease for a duration, reporting whether this instance holds it.
+	Acquire(lease time.Duration) (bool, error)
+	// Release gives up the lease if held, so that another instance may take over without waiting for it to expire.
+	Release() error
+}
+
+// formatLease produces the value of a lease held by an instance until an expiry (in Unix milliseconds).
+func formatLease(id string, expiry time.Time) string {
+	return id + " " + strconv.FormatInt(expiry.UnixMilli(), 10)
+}
+
+// parseLease extracts the holder and expiry of a lease, treating an absent or malformed lease as expired.
+func parseLease(value string) (string, time.Time) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return "", time.Time{}
+	}
+	expiry, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return fields[0], time.UnixMilli(expiry)
+}
+
+// zoneElector holds the lease as a TXT record in the rendezvous zone on the primary, replaced by RFC2136 updates whose
+// prerequisites make each acquisition atomic. The instances must have roughly synchronized clocks.
+type zoneElector struct {
+	server net.Addr
+	key    *conf.TsigKey
+	zone   string
+	id     string
+}
+
+// NewZoneElector elects the leader by a lease record in a zone on a DNS server.
+func NewZoneElector(server net.Addr, key *conf.TsigKey, zone, id string) Elector {
+	return &zoneElector{
+		server: server,
+		key:    key,
+		zone:   zone,
+		id:     id,
+	}
+}
+
+func (z *zoneElector) Acquire(lease time.Duration) (bool, error) {
+	current, err := xform.ReadLease(z.server, z.key, z.zone, leaseTimeout)
+	if err != nil {
+		return false, err
+	}
+	if holder, expiry := parseLease(current); holder != z.id && time.Now().Before(expiry) {
+		return false, nil
+	}
+	return xform.SwapLease(z.server, z.key, z.zone, current, formatLease(z.id, time.Now().Add(lease)), leaseTimeout)
+}
+
+func (z *zoneElector) Release() error {
+	current, err := xform.ReadLease(z.server, z.key, z.zone, leaseTimeout)
+	if err != nil {
+		return err
+	}
+	if holder, _ := parseLease(current); holder != z.id {
+		return nil
+	}
+	_, err = xform.SwapLease(z.server, z.key, z.zone, current, "", leaseTimeout)
+	return err
+}
+
+// fileElector holds the lease in a file on local disk, replaced by renaming, so is only suitable for instances on the
+// same host (e.g. for testing). Instances racing to acquire an expired lease each confirm the file names them after
+// replacing it, but may briefly both believe they hold it.
+type fileElector struct {
+	path string
+	id   string
+}
+
+// NewFileElector elects the leader by a lease file on local disk.
+func NewFileElector(path, id string) Elector {
+	return &fileElector{
+		path: path,
+		id:   id,
+	}
+}
+
+func (f *fileElector) read() (string, error) {
+	content, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(content)), err
+}
+
+func (f *fileElector) Acquire(lease time.Duration) (bool, error) {
+	current, err := f.read()
+	if err != nil {
+		return false, err
+	}
+	if holder, expiry := parseLease(current); holder != f.id && time.Now().Before(expiry) {
+		return false, nil
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".")
+	if err != nil {
+		return false, err
+	}
+	_, err = temp.WriteString(formatLease(f.id, time.Now().Add(lease)) + "\n")
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return false, err
+	}
+	// another instance may have replaced the file at the same time; the last to do so holds the lease
+	current, err = f.read()
+	if err != nil {
+		return false, err
+	}
+	holder, _ := parseLease(current)
+	return holder == f.id, nil
+}
+
+func (f *fileElector) Release() error {
+	current, err := f.read()
+	if err != nil {
+		return err
+	}
+	if holder, _ := parseLease(current); holder != f.id {
+		return nil
+	}
+	return os.Remove(f.path)
+}
+
+// SetElector replaces the Elector deciding whether this instance is the leader of its site (a lease file or record, as
+// configured). It takes effect only with high availability configured (which gives the lease duration), and must be
+// called before Start.
+func (e *Engine) SetElector(elector Elector) {
+	e.elector = elector
+}
+
+// IsLeader reports whether this instance writes to the primary: always, unless high availability is configured.
+func (e *Engine) IsLeader() bool {
+	e.leaderMutex.Lock()
+	defer e.leaderMutex.Unlock()
+	return e.leader
+}
+
+// startElection acquires the lease if possible, then renews it (or attempts to acquire it, while a standby) at a third
+// of its duration in the background, until stopped.
+func (e *Engine) startElection() {
+	// a dry run writes no lease, and plans every update as the leader would
+	if e.currentConfig().HighAvailability == nil || e.dryRun {
+		e.leaderMutex.Lock()
+		e.leader = true
+		e.leaderMutex.Unlock()
+		close(e.electDone)
+		return
+	}
+	e.elect()
+	go func() {
+		defer close(e.electDone)
+		ticker := time.NewTicker(e.currentConfig().HighAvailability.Lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.elect()
+			case <-e.electStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopElection stops renewing the lease, then releases it so that a standby may take over at once.
+func (e *Engine) stopElection() {
+	close(e.electStop)
+	<-e.electDone
+	if e.currentConfig().HighAvailability != nil && !e.dryRun && e.IsLeader() {
+		if err := e.elector.Release(); err != nil {
+			electionLog.Warn("unable to release leadership lease", logging.Error, err)
+		}
+		e.leaderMutex.Lock()
+		e.leader = false
+		e.leaderMutex.Unlock()
+	}
+}
+
+// elect attempts to acquire or renew the lease, taking over from (or handing over to) another instance as the outcome
+// changes. A leader unable to renew its lease steps down at two thirds of its duration, before a standby may take over.
+func (e *Engine) elect() {
+	config := e.currentConfig()
+	lease := config.HighAvailability.Lease
+	held, err := e.elector.Acquire(lease)
+	if err != nil {
+		electionLog.Warn("unable to acquire leadership lease", logging.Error, err)
+		held = e.IsLeader() && time.Since(e.renewed) < lease*2/3
+	} else if held {
+		e.renewed = time.Now()
+	}
+
+	e.leaderMutex.Lock()
+	changed := e.leader != held
+	e.leader = held
+	e.leaderMutex.Unlock()
+	if !changed {
+		return
+	}
+	if held {
+		electionLog.Info("acquired leadership lease; taking over writes to the primary", "id",
+			config.HighAvailability.ID)
+		e.takeOver()
+	} else {
+		electionLog.Warn("lost leadership lease; standing by", "id", config.HighAvailability.ID)
+	}
+}
+
+// takeOver transfers the rendezvous zone again (the previous leader wrote to it while this instance stood by), then
+// merges every zone in full, writing whatever the previous leader left outstanding.
+func (e *Engine) takeOver() {
+	e.refreshRendezvous()
+}
@@ -0,0 +1,150 @@
+package hive
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/internal/dnstest"
+
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLease(t *testing.T) {
+	expiry := time.UnixMilli(1700000000123)
+	if holder, parsed := parseLease(formatLease("hive-a", expiry)); holder != "hive-a" || !parsed.Equal(expiry) {
+		t.Errorf("lease parsed as held by '%s' until %v", holder, parsed)
+	}
+	for _, value := range []string{"", "hive-a", "hive-a soon", "hive-a 1 2"} {
+		if holder, parsed := parseLease(value); holder != "" || !parsed.IsZero() {
+			t.Errorf("malformed lease '%s' parsed as held by '%s' until %v", value, holder, parsed)
+		}
+	}
+}
+
+// testElectors checks that a pair of electors for the same lease take it over from one another as it is released or
+// expires.
+func testElectors(t *testing.T, a, b Elector) {
+	const lease = 200 * time.Millisecond
+	acquire := func(elector Elector, name string, expected bool) {
+		t.Helper()
+		held, err := elector.Acquire(lease)
+		if err != nil {
+			t.Fatalf("%s unable to acquire lease: %v", name, err)
+		}
+		if held != expected {
+			t.Fatalf("expected %s to hold the lease: %v", name, expected)
+		}
+	}
+
+	acquire(a, "a", true)
+	acquire(b, "b", false)
+	// renewing keeps the lease from expiring
+	time.Sleep(lease / 2)
+	acquire(a, "a", true)
+	time.Sleep(lease / 2)
+	acquire(b, "b", false)
+
+	// once expired unrenewed, it is taken over
+	time.Sleep(lease)
+	acquire(b, "b", true)
+	acquire(a, "a", false)
+
+	// releasing a lease held by another does nothing; releasing one held lets another take over at once
+	if err := a.Release(); err != nil {
+		t.Fatalf("a unable to release lease: %v", err)
+	}
+	acquire(a, "a", false)
+	if err := b.Release(); err != nil {
+		t.Fatalf("b unable to release lease: %v", err)
+	}
+	acquire(a, "a", true)
+}
+
+func TestZoneElector(t *testing.T) {
+	primary := newPrimary(t)
+	testElectors(t,
+		NewZoneElector(primary.Addr, dnstest.Key, "rdvu.example.com.", "hive-a"),
+		NewZoneElector(primary.Addr, dnstest.Key, "rdvu.example.com.", "hive-b"))
+}
+
+func TestFileElector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader")
+	testElectors(t, NewFileElector(path, "hive-a"), NewFileElector(path, "hive-b"))
+}
+
+// failingElector cannot reach wherever the lease is held.
+type failingElector struct{}
+
+func (failingElector) Acquire(time.Duration) (bool, error) {
+	return false, errors.New("lease unavailable")
+}
+
+func (failingElector) Release() error {
+	return errors.New("lease unavailable")
+}
+
+func TestElectionStepDown(t *testing.T) {
+	primary := newPrimary(t)
+	config := dnstest.Config(t, primary)
+	config.HighAvailability = &conf.HighAvailability{ID: "hive-a", Lease: time.Hour}
+	e := startEngine(t, config)
+	if !e.IsLeader() {
+		t.Fatalf("instance alone at its site did not acquire the lease")
+	}
+
+	// unable to renew, the leader carries on until two thirds of the lease have passed, then steps down
+	e.SetElector(failingElector{})
+	e.elect()
+	if !e.IsLeader() {
+		t.Fatalf("leader stepped down unable to renew a lease recently renewed")
+	}
+	e.renewed = time.Now().Add(-time.Hour * 2 / 3)
+	e.elect()
+	if e.IsLeader() {
+		t.Fatalf("leader did not step down, unable to renew its lease")
+	}
+}
+
+// TestFailover runs two instances of a site against the same primary: the standby writes nothing until the leader
+// stops, then takes over, writing what was left outstanding.
+func TestFailover(t *testing.T) {
+	primary := newPrimary(t, "foo.west.example.com. A 10.0.0.100")
+	leaderConfig := dnstest.Config(t, primary)
+	leaderConfig.HighAvailability = &conf.HighAvailability{ID: "hive-a", Lease: time.Hour}
+	leader := NewEngine(leaderConfig, dnstest.Key)
+	if err := leader.Start(); err != nil {
+		t.Fatalf("unable to start engine: %v", err)
+	}
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == "foo.west.example.com."
+	})
+
+	standbyConfig := dnstest.Config(t, primary)
+	standbyConfig.HighAvailability = &conf.HighAvailability{ID: "hive-b", Lease: time.Hour}
+	standby := startEngine(t, standbyConfig)
+	if !leader.IsLeader() || standby.IsLeader() {
+		t.Fatalf("expected the first instance to lead, and the second to stand by")
+	}
+	updates := len(primary.Updates())
+	// the rendezvous zone loses its records (and the lease), which a full merge would write again, were the standby
+	// writing
+	primary.AddZone("rdvu.example.com.")
+	standby.refreshRendezvous()
+	time.Sleep(2 * standbyConfig.ReconcileMaxDelay)
+	if written := len(primary.Updates()) - updates; written != 0 {
+		t.Fatalf("standby wrote %d updates to the primary", written)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	leader.Stop(ctx)
+	standby.elect()
+	if !standby.IsLeader() {
+		t.Fatalf("standby did not take over the released lease")
+	}
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == "foo.west.example.com."
+	})
+}
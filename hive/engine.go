@@ -0,0 +1,581 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var engineLog = logging.For("engine")
+
+// Engine holds the zone state of a Hive instance (the local primary zone, the zones of each peer, a default zone for
+// unaffiliated proposals, and the rendezvous zone merged from all of them) and keeps the primary up to date with it.
+//
+// The peers (and the indices of zones by server and name) are guarded by the peersMutex, and replaced rather than
+// modified as peers are discovered or removed, so that readers may use them without holding it. The records of each
+// zone are guarded by its own lock: proposals, deletions and notifications modify a zone under its write lock
+// (incrementing its version, from which its serial is derived), while transfers, queries and merges read it under its
+// read lock, so that each observes a single consistent version. The rendezvous zone is only modified by reconciliation
+// passes, which are serialized by the zoneUpdateMutex and apply each pass as one version.
+type Engine struct {
+	// the configuration in effect, replaced (never modified) on reload
+	configMutex sync.RWMutex
+	config      *conf.Configuration
+	key         *conf.TsigKey
+
+	primaryZone    *xform.Zone
+	rendezvousZone *xform.Zone
+	// the defaultZone is populated by update requests not associated with configured peers, whose values are merged
+	// into the rendezvous zone at lowest priority (i.e. any peer configured value will take precedence).
+	defaultZone *xform.Zone
+
+	peersMutex   sync.RWMutex
+	peers        []*peerEntry // in priority order: configured, then discovered
+	zoneByServer map[string]*xform.Zone
+	zoneByName   map[string]*xform.Zone
+
+	zoneUpdateMutex sync.Mutex
+	// transposed holds the rendezvous CNAME records derived from each primary and peer zone, maintained incrementally
+	// as names in those zones change
+	transposed map[*xform.Zone]map[string]string
+	// pending holds rendezvous names whose write to the primary failed, to be retried by the next pass
+	pending map[string]bool
+	// rewrite forces the next full pass to write every rendezvous name, even those already current (e.g. for a new TTL)
+	rewrite bool
+
+	dirtyMutex sync.Mutex
+	dirty      map[*xform.Zone]map[string]bool
+
+	// manual overrides of rendezvous names (e.g. by an administrator), taking precedence over every zone
+	overridesMutex sync.Mutex
+	overrides      map[string]string
+
+	// in dry-run mode, updates to the primary are planned (logged and held, by zone, name and type) but never written
+	dryRun    bool
+	planMutex sync.Mutex
+	planned   map[string]*PlannedUpdate
+
+	// guards the liveness of each peer, as determined by periodic probes
+	livenessMutex sync.Mutex
+	probeStop     chan struct{}
+	probeDone     chan struct{}
+
+	// reachability of the hosts of contested rendezvous names (by site name), as determined by periodic probes
+	dialer       Dialer
+	reachMutex   sync.Mutex
+	reachability map[string]*reachability
+	reachStop    chan struct{}
+	reachDone    chan struct{}
+
+	// periodic anti-entropy comparison of peer zones
+	syncStop chan struct{}
+	syncDone chan struct{}
+
+	// periodic discovery of peers from a catalog zone
+	catalogRequest chan struct{}
+	catalogStop    chan struct{}
+	catalogDone    chan struct{}
+
+	// leader election among the instances of the site; only the leader writes to the primary
+	elector     Elector
+	leaderMutex sync.Mutex
+	leader      bool
+	renewed     time.Time // when the lease was last acquired or renewed
+	electStop   chan struct{}
+	electDone   chan struct{}
+
+	// health as reported to orchestration: whether the rendezvous zone was updated after the initial transfers, and the
+	// zones transferred (or synchronized by anti-entropy) from their servers at least once
+	healthMutex  sync.Mutex
+	started      bool
+	synchronized map[*xform.Zone]bool
+
+	reconciler  *reconciler
+	serverMutex sync.Mutex // guards the server, replaced as listeners are bound again
+	server      *xform.Server
+	writer      *xform.Writer
+	// updates forwarded to the primary's own zone are written on a connection of their own, so that a large
+	// rendezvous update never delays them
+	forwarder *xform.Writer
+}
+
+// ZoneStatus summarizes the contents of one zone held by the engine.
+type ZoneStatus struct {
+	Name         string
+	Server       net.Addr
+	Serial       uint32
+	ARecords     int
+	CNAMERecords int
+	Liveness     *Liveness // of a peer zone's server
+}
+
+// Status summarizes the zones held by the engine.
+type Status struct {
+	Primary    *ZoneStatus
+	Peers      []*ZoneStatus
+	Default    *ZoneStatus
+	Rendezvous *ZoneStatus
+	Leader     bool // whether this instance writes to the primary
+}
+
+// currentConfig provides the configuration in effect.
+func (e *Engine) currentConfig() *conf.Configuration {
+	e.configMutex.RLock()
+	defer e.configMutex.RUnlock()
+	return e.config
+}
+
+// currentServer provides the server of the listeners bound, or nil if not started.
+func (e *Engine) currentServer() *xform.Server {
+	e.serverMutex.Lock()
+	defer e.serverMutex.Unlock()
+	return e.server
+}
+
+func emptyZone(server net.Addr) *xform.Zone {
+	return &xform.Zone{
+		Server:       server,
+		ARecords:     map[string]net.IP{},
+		CNAMERecords: map[string]string{},
+	}
+}
+
+// NewEngine prepares an engine for a configuration, authenticating to the primary and peers with a TSIG key.
+func NewEngine(config *conf.Configuration, key *conf.TsigKey) *Engine {
+	e := &Engine{
+		config:         config,
+		key:            key,
+		defaultZone:    emptyZone(nil),
+		pending:        map[string]bool{},
+		overrides:      map[string]string{},
+		planned:        map[string]*PlannedUpdate{},
+		synchronized:   map[*xform.Zone]bool{},
+		dirty:          map[*xform.Zone]map[string]bool{},
+		writer:         xform.NewWriter(config.LocalZone.Server, key, config.WriteConcurrency, config.WriteTimeout),
+		forwarder:      xform.NewWriter(config.LocalZone.Server, key, config.WriteConcurrency, config.WriteTimeout),
+		probeStop:      make(chan struct{}),
+		probeDone:      make(chan struct{}),
+		dialer:         &net.Dialer{},
+		reachStop:      make(chan struct{}),
+		reachDone:      make(chan struct{}),
+		syncStop:       make(chan struct{}),
+		syncDone:       make(chan struct{}),
+		catalogRequest: make(chan struct{}, 1),
+		catalogStop:    make(chan struct{}),
+		catalogDone:    make(chan struct{}),
+		electStop:      make(chan struct{}),
+		electDone:      make(chan struct{}),
+	}
+	if ha := config.HighAvailability; ha != nil {
+		if ha.LockFile != "" {
+			e.elector = NewFileElector(ha.LockFile, ha.ID)
+		} else {
+			e.elector = NewZoneElector(config.LocalZone.Server, key, config.SearchSuffix, ha.ID)
+		}
+	}
+	e.reconciler = newReconciler(config.ReconcileDelay, config.ReconcileMaxDelay, e.localZoneUpdate)
+	return e
+}
+
+// Start transfers the primary and peer zones, begins serving peers, and performs the initial rendezvous update.
+func (e *Engine) Start() error {
+	// Operational sequence:
+	// 1) Zone transfer from the local primary DNS server to populate transient cache (no persistent caching in Hive)
+	// 2) Zone transfer from all configured peers and augment transient structures
+	if err := e.transferZones(); err != nil {
+		return err
+	}
+
+	// 3) Start listening for DNS update requests from peers (and/or DHCP servers)
+	server, err := xform.StartServer(e.currentConfig(), e.key, e)
+	if err != nil {
+		return err
+	}
+	e.serverMutex.Lock()
+	e.server = server
+	e.serverMutex.Unlock()
+
+	// 4) Determine whether this instance is the leader of its site (always, without high availability), then do an
+	//    initial update on startup, and coalesce subsequent changes
+	e.startElection()
+	e.localZoneUpdate()
+	e.reconciler.start()
+	e.startCatalog()
+	e.startProbing()
+	e.startReachability()
+	e.startAntiEntropy()
+	e.healthMutex.Lock()
+	e.started = true
+	e.healthMutex.Unlock()
+	return nil
+}
+
+// transferZones transfers the primary and rendezvous zones from the primary (starting a new rendezvous zone if it has
+// none), and the zone of each configured peer.
+func (e *Engine) transferZones() error {
+	var err error
+	config := e.currentConfig()
+	e.primaryZone, err = xform.ReadZoneEntries(config.LocalZone.Server, e.key, config.LocalZone.Suffix)
+	if err != nil {
+		return fmt.Errorf("zone transfer from primary failed: %v", err)
+	}
+	e.markSynchronized(e.primaryZone)
+	e.rendezvousZone, err = xform.ReadZoneEntries(config.LocalZone.Server, e.key, config.SearchSuffix)
+	if err != nil {
+		engineLog.Warn("initializing new rendezvous zone; transfer from primary failed",
+			logging.Zone, config.SearchSuffix, logging.Error, err)
+		e.rendezvousZone = emptyZone(config.LocalZone.Server)
+	}
+
+	var peers []*peerEntry
+	for _, zonePeer := range config.Peers {
+		peers = append(peers, newPeer(zonePeer, e.transferPeer(zonePeer), false))
+	}
+	e.peersMutex.Lock()
+	e.setPeers(peers)
+	e.peersMutex.Unlock()
+	return nil
+}
+
+// Stop drains requests in flight (and the updates they trigger), then writes any outstanding rendezvous changes to the
+// primary.
+func (e *Engine) Stop(ctx context.Context) error {
+	var err error
+	if server := e.currentServer(); server != nil {
+		err = server.Shutdown(ctx)
+		e.stopCatalog()
+		e.stopProbing()
+		e.stopReachability()
+		e.stopAntiEntropy()
+		e.reconciler.shutdown()
+		e.stopElection()
+	}
+	e.zoneUpdateMutex.Lock()
+	e.zoneUpdateMutex.Unlock()
+	e.writer.Close()
+	e.forwarder.Close()
+	return err
+}
+
+// proposerZone finds the zone a proposer is responsible for, or the default zone if it is not a known server.
+func (e *Engine) proposerZone(proposer net.Addr) *xform.Zone {
+	zone, present := e.serverZone(proposer.String())
+	if !present {
+		zone = e.defaultZone
+	}
+	return zone
+}
+
+// Propose records a mapping proposed for the proposer's zone, forwarding it to the primary if the proposer is the
+// primary, and updating the rendezvous zone if the mapping changed.
+func (e *Engine) Propose(proposer net.Addr, mapping *xform.Mapping) {
+	if mapping.IP != nil {
+		engineLog.Info("proposed address", logging.Proposer, proposer.String(), logging.Name, mapping.Name,
+			logging.Address, mapping.IP.String())
+	} else {
+		engineLog.Info("proposed CNAME", logging.Proposer, proposer.String(), logging.Name, mapping.Name,
+			logging.Target, mapping.Target)
+	}
+	mapping = &xform.Mapping{
+		Name:   strings.ToLower(mapping.Name),
+		Target: mapping.Target,
+		IP:     mapping.IP,
+	}
+	zone := e.proposerZone(proposer)
+	runUpdate := false
+
+	zone.Lock()
+	if mapping.IP != nil {
+		if !zone.ARecords[mapping.Name].Equal(mapping.IP) {
+			zone.ARecords[mapping.Name] = mapping.IP
+			runUpdate = true
+		}
+	} else if zone.CNAMERecords[mapping.Name] != mapping.Target {
+		zone.CNAMERecords[mapping.Name] = mapping.Target
+		runUpdate = true
+	}
+	if runUpdate {
+		zone.Version++
+	}
+	zone.Unlock()
+	if zone == e.primaryZone && e.IsLeader() {
+		config := e.currentConfig()
+		if e.dryRun {
+			e.plan(&PlannedUpdate{
+				Zone:   config.LocalZone.Suffix,
+				Name:   mapping.Name,
+				Type:   mappingType(mapping),
+				Action: "add",
+				Target: mappingTarget(mapping),
+				Record: xform.UpdateRecord(config.TTL, mapping, config.LocalZone.Suffix),
+				Reason: "forwarded from proposer " + proposer.String(),
+			})
+		} else {
+			engineLog.Info("forwarding primary update", logging.Zone, config.LocalZone.Suffix,
+				logging.Name, mapping.Name, logging.Target, mappingTarget(mapping))
+			err := e.forwarder.WriteUpdate(config.TTL, mapping, config.LocalZone.Suffix)
+			auditWrite(config.LocalZone.Suffix, "add", mappingType(mapping), mapping, err)
+			if err != nil {
+				engineLog.Error("unable to forward update to primary zone", logging.Zone, config.LocalZone.Suffix,
+					logging.Name, mapping.Name, logging.Error, err)
+				return
+			}
+		}
+	}
+	if runUpdate {
+		e.markDirty(zone, mapping.Name)
+	}
+}
+
+// Delete removes records proposed for deletion from the proposer's zone, forwarding the deletion to the primary if the
+// proposer is the primary, and updating the rendezvous zone if any record was removed.
+func (e *Engine) Delete(proposer net.Addr, rrtype uint16, mapping *xform.Mapping) {
+	engineLog.Info("proposed deletion", logging.Proposer, proposer.String(), logging.Name, mapping.Name,
+		"type", dns.TypeToString[rrtype])
+	mapping = &xform.Mapping{
+		Name:   strings.ToLower(mapping.Name),
+		Target: mapping.Target,
+		IP:     mapping.IP,
+	}
+	zone := e.proposerZone(proposer)
+	runUpdate := false
+
+	zone.Lock()
+	if ip, present := zone.ARecords[mapping.Name]; present && (mapping.IP == nil || mapping.IP.Equal(ip)) {
+		isV4 := ip.To4() != nil
+		if rrtype == dns.TypeANY || (rrtype == dns.TypeA && isV4) || (rrtype == dns.TypeAAAA && !isV4) {
+			delete(zone.ARecords, mapping.Name)
+			runUpdate = true
+		}
+	}
+	if target, present := zone.CNAMERecords[mapping.Name]; present && (mapping.Target == "" ||
+		strings.EqualFold(mapping.Target, target)) {
+		if rrtype == dns.TypeANY || rrtype == dns.TypeCNAME {
+			delete(zone.CNAMERecords, mapping.Name)
+			runUpdate = true
+		}
+	}
+	if runUpdate {
+		zone.Version++
+	}
+	zone.Unlock()
+	if zone == e.primaryZone && runUpdate && e.IsLeader() {
+		zoneName := e.currentConfig().LocalZone.Suffix
+		if e.dryRun {
+			e.plan(&PlannedUpdate{
+				Zone:   zoneName,
+				Name:   mapping.Name,
+				Type:   dns.TypeToString[rrtype],
+				Action: "delete",
+				Record: xform.DeletionRecord(rrtype, mapping.Name, zoneName),
+				Reason: "forwarded from proposer " + proposer.String(),
+			})
+		} else {
+			engineLog.Info("forwarding primary deletion", logging.Zone, zoneName, logging.Name, mapping.Name,
+				"type", dns.TypeToString[rrtype])
+			err := e.forwarder.WriteDeletion(rrtype, mapping.Name, zoneName)
+			auditWrite(zoneName, "delete", dns.TypeToString[rrtype], mapping, err)
+			if err != nil {
+				engineLog.Error("unable to forward deletion to primary zone", logging.Zone, zoneName,
+					logging.Name, mapping.Name, logging.Error, err)
+				return
+			}
+		}
+	}
+	if runUpdate {
+		e.markDirty(zone, mapping.Name)
+	}
+}
+
+// Notify transfers a zone again from its server after being notified of a change to it (or discovers peers again, for
+// the catalog zone).
+func (e *Engine) Notify(proposer net.Addr, zoneName string) {
+	config := e.currentConfig()
+	if config.Catalog != nil && dns.CanonicalName(zoneName) == dns.CanonicalName(config.Catalog.Zone) {
+		engineLog.Info("notified change to catalog zone", logging.Proposer, proposer.String(), logging.Zone, zoneName)
+		e.requestCatalog()
+		return
+	}
+	zone, present := e.nameZone(zoneName)
+	if !present {
+		return
+	}
+	engineLog.Info("notified change to zone", logging.Proposer, proposer.String(), logging.Zone, zoneName)
+	e.refreshZone(zone, zoneName)
+}
+
+// refreshZone transfers a zone again from its server, updating the rendezvous zone with any changes to it.
+func (e *Engine) refreshZone(zone *xform.Zone, zoneName string) error {
+	transferred, err := xform.ReadZoneEntries(zone.Server, e.key, zoneName)
+	if err != nil {
+		engineLog.Error("unable to transfer zone", logging.Zone, zoneName, logging.Server, zone.Server.String(),
+			logging.Error, err)
+		return err
+	}
+	e.markSynchronized(zone)
+	zone.Lock()
+	changed := changedNames(zone, transferred)
+	if len(changed) > 0 {
+		zone.ARecords = transferred.ARecords
+		zone.CNAMERecords = transferred.CNAMERecords
+		zone.Version++
+	}
+	zone.Unlock()
+	if len(changed) > 0 {
+		e.markDirty(zone, changed...)
+	}
+	return nil
+}
+
+// refreshRendezvous transfers the rendezvous zone again from the primary, then merges every zone in full at the next
+// pass, correcting any record that differs. If the transfer fails, the zones are merged against the current copy.
+func (e *Engine) refreshRendezvous() error {
+	config := e.currentConfig()
+	transferred, err := xform.ReadZoneEntries(config.LocalZone.Server, e.key, config.SearchSuffix)
+	if err != nil {
+		engineLog.Error("unable to transfer rendezvous zone from primary", logging.Zone, config.SearchSuffix,
+			logging.Error, err)
+	}
+	e.zoneUpdateMutex.Lock()
+	if err == nil {
+		e.rendezvousZone.Lock()
+		e.rendezvousZone.ARecords = transferred.ARecords
+		e.rendezvousZone.CNAMERecords = transferred.CNAMERecords
+		e.rendezvousZone.Version++
+		e.rendezvousZone.Unlock()
+	}
+	e.transposed = nil
+	e.zoneUpdateMutex.Unlock()
+	e.reconciler.request()
+	return err
+}
+
+func mappingTarget(mapping *xform.Mapping) string {
+	if mapping.IP != nil {
+		return mapping.IP.String()
+	}
+	return mapping.Target
+}
+
+// mappingType names the type of the record of a mapping: A or AAAA for an address, otherwise CNAME.
+func mappingType(mapping *xform.Mapping) string {
+	switch {
+	case mapping.IP == nil:
+		return "CNAME"
+	case mapping.IP.To4() != nil:
+		return "A"
+	}
+	return "AAAA"
+}
+
+// namedZone finds a zone by name, defaulting to the rendezvous zone.
+func (e *Engine) namedZone(zoneName string) *xform.Zone {
+	zone, present := e.nameZone(zoneName)
+	if !present {
+		zone = e.rendezvousZone
+	}
+	return zone
+}
+
+// Serial produces the SOA serial number of a zone by name, defaulting to the rendezvous zone.
+func (e *Engine) Serial(zoneName string) uint32 {
+	zone := e.namedZone(zoneName)
+	zone.RLock()
+	version := zone.Version
+	zone.RUnlock()
+	return versionSerial(version)
+}
+
+// versionSerial produces the SOA serial number of a zone version.
+func versionSerial(version uint32) uint32 {
+	// similar to RFC1912 (which presents an ISO 8601 date followed by a 2 digit revision number), this process
+	// uses a 2 digit year instead of a 4 digit year, so the revision number may be 4 digits. This similarly
+	// should guarantee monotonic increases, except on century crossings. Be sure to restart your hive on
+	// January 1st, 2100, and all subsequent century crossings.
+	index := version
+	if index >= 10000 {
+		index = 10000 - 1
+	}
+
+	now := time.Now()
+	dateIndex := now.Day() + int(now.Month())*100 + (now.Year()%100)*10000
+
+	return uint32(dateIndex)*10000 + index
+}
+
+// Transfer takes a snapshot of a zone by name, defaulting to the rendezvous zone.
+func (e *Engine) Transfer(zoneName string) *xform.ZoneSnapshot {
+	version, mappings := xform.ZoneMappings(e.namedZone(zoneName))
+	return &xform.ZoneSnapshot{
+		Serial:   versionSerial(version),
+		Mappings: mappings,
+	}
+}
+
+// Lookup finds the record of a name in a zone by name (defaulting to the rendezvous zone), or nil if there is none.
+func (e *Engine) Lookup(zoneName, name string) *xform.Mapping {
+	zone := e.namedZone(zoneName)
+	name = strings.ToLower(name)
+	zone.RLock()
+	defer zone.RUnlock()
+	// a name holds either an address or a CNAME; should a zone hold both, the address is answered, as in a transfer
+	if address, present := zone.ARecords[name]; present {
+		return &xform.Mapping{
+			Name: name,
+			IP:   address,
+		}
+	}
+	if target, present := zone.CNAMERecords[name]; present {
+		return &xform.Mapping{
+			Name:   name,
+			Target: target,
+		}
+	}
+	return nil
+}
+
+// Records lists the records of the zone a proposer is responsible for.
+func (e *Engine) Records(proposer net.Addr) []*xform.Mapping {
+	_, mappings := xform.ZoneMappings(e.proposerZone(proposer))
+	return mappings
+}
+
+func zoneStatus(name string, zone *xform.Zone) *ZoneStatus {
+	zone.RLock()
+	defer zone.RUnlock()
+	return &ZoneStatus{
+		Name:         name,
+		Server:       zone.Server,
+		Serial:       versionSerial(zone.Version),
+		ARecords:     len(zone.ARecords),
+		CNAMERecords: len(zone.CNAMERecords),
+	}
+}
+
+// Status summarizes the zones held by the engine. It is only meaningful once the engine has started.
+func (e *Engine) Status() *Status {
+	config := e.currentConfig()
+	status := &Status{
+		Primary:    zoneStatus(config.LocalZone.Suffix, e.primaryZone),
+		Default:    zoneStatus("", e.defaultZone),
+		Rendezvous: zoneStatus(config.SearchSuffix, e.rendezvousZone),
+		Leader:     e.IsLeader(),
+	}
+	for _, peer := range e.currentPeers() {
+		peerStatus := zoneStatus(peer.Suffix, peer.zone)
+		e.livenessMutex.Lock()
+		liveness := *peer.liveness
+		e.livenessMutex.Unlock()
+		peerStatus.Liveness = &liveness
+		status.Peers = append(status.Peers, peerStatus)
+	}
+	return status
+}
@@ -0,0 +1,227 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/internal/dnstest"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// engines log every proposal and update, which would drown out test failures
+	logging.Configure(&conf.Logging{Level: "error"})
+	os.Exit(m.Run())
+}
+
+// newPrimary starts a fake primary on 127.0.0.1 for the west site, with local zone records and an empty rendezvous zone.
+func newPrimary(t testing.TB, records ...string) *dnstest.Server {
+	primary := dnstest.NewServer(t, "127.0.0.1")
+	primary.AddZone("west.example.com.", records...)
+	primary.AddZone("rdvu.example.com.")
+	return primary
+}
+
+// newPeerServer starts a fake peer on a loopback address (other than that of the primary) serving the zone of a site.
+func newPeerServer(t testing.TB, host, suffix string, records ...string) *dnstest.Server {
+	peer := dnstest.NewServer(t, host)
+	peer.AddZone(suffix, records...)
+	return peer
+}
+
+// startEngine starts an engine for a configuration, stopping it when the test completes.
+func startEngine(t testing.TB, config *conf.Configuration) *Engine {
+	t.Helper()
+	e := NewEngine(config, dnstest.Key)
+	if err := e.Start(); err != nil {
+		t.Fatalf("unable to start engine: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		e.Stop(ctx)
+	})
+	return e
+}
+
+// waitFor polls a condition until it holds, failing the test if it does not within a few seconds.
+func waitFor(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rendezvousTarget provides the target of a rendezvous name on the primary, or an empty string if it has none.
+func rendezvousTarget(primary *dnstest.Server, name string) string {
+	records := primary.Lookup("rdvu.example.com.", name, dns.TypeCNAME)
+	if len(records) != 1 {
+		return ""
+	}
+	fields := strings.Fields(records[0])
+	return fields[len(fields)-1]
+}
+
+func TestEngineStart(t *testing.T) {
+	primary := newPrimary(t,
+		"foo.west.example.com. A 10.0.0.100",
+		"bar.west.example.com. A 192.168.0.100")
+	peer := newPeerServer(t, "127.0.0.2", "east.example.com.",
+		"foo.east.example.com. A 10.1.0.103",
+		"bar.east.example.com. A 10.1.0.104")
+	e := startEngine(t, dnstest.Config(t, primary, peer))
+
+	// the primary's own host is preferred; a host addressed outside the local nets is only a candidate from its peer
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == "foo.west.example.com." &&
+			rendezvousTarget(primary, "bar.rdvu.example.com.") == "bar.east.example.com."
+	})
+	if !e.IsLeader() {
+		t.Errorf("engine without high availability is not the leader")
+	}
+}
+
+// TestConcurrentChanges exercises proposals, deletions and notifications concurrently with transfers, serials and the
+// replacement of peers, for the race detector (go test -race); each transfer must observe a single version of its zone.
+func TestConcurrentChanges(t *testing.T) {
+	primary := newPrimary(t, "foo.west.example.com. A 10.0.0.5")
+	east := newPeerServer(t, "127.0.0.2", "east.example.com.", "foo.east.example.com. A 10.1.0.5")
+	north := newPeerServer(t, "127.0.0.3", "north.example.com.", "foo.north.example.com. A 10.2.0.5")
+	config := dnstest.Config(t, primary, east)
+	e := startEngine(t, config)
+
+	eastProposer := &net.IPAddr{IP: east.Addr.IP}
+	stranger := &net.IPAddr{IP: net.ParseIP("127.0.0.9")}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				e.Propose(eastProposer, &xform.Mapping{
+					Name: fmt.Sprintf("host%d-%d.east.example.com.", g, i),
+					IP:   net.IPv4(10, 1, byte(g), byte(i)),
+				})
+				e.Propose(stranger, &xform.Mapping{
+					Name:   fmt.Sprintf("other%d-%d.rdvu.example.com.", g, i),
+					Target: "www.example.org.",
+				})
+				if i%10 == 5 {
+					e.Delete(eastProposer, dns.TypeANY, &xform.Mapping{
+						Name: fmt.Sprintf("host%d-%d.east.example.com.", g, i-5),
+					})
+					e.Notify(eastProposer, "east.example.com.")
+				}
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		northPeer := &conf.ZonePeer{Suffix: "north.example.com.", Server: north.Addr}
+		for i := 0; i < 10; i++ {
+			e.addPeer(northPeer, true)
+			for _, peer := range e.currentPeers() {
+				if peer.ZonePeer == northPeer {
+					e.removePeer(peer)
+				}
+			}
+		}
+	}()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				for _, zone := range []string{"rdvu.example.com.", "east.example.com."} {
+					if err := checkTransfer(config.ListenAddresses[0], zone); err != nil {
+						t.Error(err)
+						return
+					}
+					e.Serial(zone)
+					e.Transfer(zone)
+				}
+				e.Status()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// once settled, the primary holds the rendezvous zone as the engine tracks it
+	waitFor(t, "rendezvous zone to settle", func() bool {
+		snapshot := e.Transfer("rdvu.example.com.")
+		records := primary.Records("rdvu.example.com.")
+		if len(records) != len(snapshot.Mappings) {
+			return false
+		}
+		for _, mapping := range snapshot.Mappings {
+			if rendezvousTarget(primary, mapping.Name) != mapping.Target {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// checkTransfer transfers a zone from an engine, checking that the SOA records opening and closing it agree.
+func checkTransfer(server net.Addr, zone string) error {
+	tr := &dns.Transfer{TsigSecret: map[string]string{dnstest.Key.ZoneName: dnstest.Key.Key}}
+	msg := &dns.Msg{}
+	msg.SetAxfr(zone)
+	msg.SetTsig(dnstest.Key.ZoneName, dnstest.Key.Algorithm, 300, time.Now().Unix())
+	envelopes, err := tr.In(msg, server.String())
+	if err != nil {
+		return err
+	}
+	var serials []uint32
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return envelope.Error
+		}
+		for _, rr := range envelope.RR {
+			if soa, ok := rr.(*dns.SOA); ok {
+				serials = append(serials, soa.Serial)
+			}
+		}
+	}
+	if len(serials) != 2 || serials[0] != serials[1] {
+		return fmt.Errorf("transfer of %s has inconsistent SOA serials %v", zone, serials)
+	}
+	return nil
+}
+
+func TestForwardedProposals(t *testing.T) {
+	primary := newPrimary(t, "foo.west.example.com. A 10.0.0.100")
+	e := startEngine(t, dnstest.Config(t, primary))
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == "foo.west.example.com."
+	})
+
+	// proposals from the primary's address are forwarded to its own zone, as well as merged
+	proposer := &net.IPAddr{IP: primary.Addr.IP}
+	e.Propose(proposer, &xform.Mapping{Name: "bar.west.example.com.", IP: net.ParseIP("10.0.0.101")})
+	e.Delete(proposer, dns.TypeA, &xform.Mapping{Name: "foo.west.example.com."})
+	if records := primary.Lookup("west.example.com.", "bar.west.example.com.", dns.TypeA); len(records) != 1 {
+		t.Errorf("proposal was not forwarded to the primary: %q", primary.Records("west.example.com."))
+	}
+	if records := primary.Lookup("west.example.com.", "foo.west.example.com.", dns.TypeANY); len(records) != 0 {
+		t.Errorf("deletion was not forwarded to the primary: %q", records)
+	}
+	waitFor(t, "rendezvous zone update", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == "" &&
+			rendezvousTarget(primary, "bar.rdvu.example.com.") == "bar.west.example.com."
+	})
+}
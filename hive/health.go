@@ -0,0 +1,86 @@
+package hive
+
+import (
+	"github.com/thyth/hive/xform"
+
+	"fmt"
+	"net"
+)
+
+// Health summarizes whether the engine is alive (serving, so need not be restarted) and ready (its rendezvous zone
+// reflects every peer), for orchestration.
+type Health struct {
+	Serving bool // whether every listener is serving requests
+	Started bool // whether the rendezvous zone was updated after the initial zone transfers
+	Peers   []*PeerHealth
+}
+
+// PeerHealth summarizes the health of a peer.
+type PeerHealth struct {
+	Zone         string
+	Server       net.Addr
+	Synchronized bool // whether its zone has been transferred (or synchronized by anti-entropy) at least once
+	Liveness     Liveness
+}
+
+// Health summarizes the health of the engine.
+func (e *Engine) Health() *Health {
+	server := e.currentServer()
+	health := &Health{
+		Serving: server != nil && server.Serving(),
+	}
+	e.healthMutex.Lock()
+	health.Started = e.started
+	e.healthMutex.Unlock()
+	for _, peer := range e.currentPeers() {
+		e.livenessMutex.Lock()
+		liveness := *peer.liveness
+		e.livenessMutex.Unlock()
+		health.Peers = append(health.Peers, &PeerHealth{
+			Zone:         peer.Suffix,
+			Server:       peer.Server,
+			Synchronized: e.isSynchronized(peer.zone),
+			Liveness:     liveness,
+		})
+	}
+	return health
+}
+
+// Alive reports whether the engine is serving requests.
+func (h *Health) Alive() bool {
+	return h.Serving
+}
+
+// Problems lists why the engine is not ready: listeners not serving, the initial update of the rendezvous zone not yet
+// made, or peers whose zones have been neither transferred nor withdrawn (as down). The engine is ready if there are
+// none.
+func (h *Health) Problems() []string {
+	var problems []string
+	if !h.Serving {
+		problems = append(problems, "listeners not serving")
+	}
+	if !h.Started {
+		problems = append(problems, "initial rendezvous update not made")
+	}
+	for _, peer := range h.Peers {
+		if !peer.Synchronized && !peer.Liveness.Withdrawn {
+			problems = append(problems, fmt.Sprintf("zone '%s' of peer %v not transferred (peer %v)", peer.Zone,
+				peer.Server, peer.Liveness.State))
+		}
+	}
+	return problems
+}
+
+// markSynchronized records that a zone was transferred (or synchronized by anti-entropy) from its server.
+func (e *Engine) markSynchronized(zone *xform.Zone) {
+	e.healthMutex.Lock()
+	defer e.healthMutex.Unlock()
+	e.synchronized[zone] = true
+}
+
+// isSynchronized reports whether a zone has been transferred (or synchronized by anti-entropy) from its server.
+func (e *Engine) isSynchronized(zone *xform.Zone) bool {
+	e.healthMutex.Lock()
+	defer e.healthMutex.Unlock()
+	return e.synchronized[zone]
+}
@@ -0,0 +1,175 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Candidate is a site host a rendezvous name may point to, as considered when merging it.
+type Candidate struct {
+	Zone      string        // the suffix of the primary or peer zone the host is in
+	Target    string        // the name of the host
+	Withdrawn bool          // whether the peer is down, so its mappings are not considered
+	Probed    bool          // whether the host has been probed for reachability
+	Reachable bool          // whether the host was reachable when last probed
+	Latency   time.Duration // how long the host took to reach when last probed
+}
+
+// MergeDecision explains the target of a rendezvous name: the candidates from the primary and peer zones in priority
+// order, the manual override and default zone target if any, and the target selected from them.
+type MergeDecision struct {
+	Name       string
+	Candidates []*Candidate
+	Override   string
+	Default    string
+	Target     string // as merged; empty if the name should not exist
+	Current    string // as held in the rendezvous zone
+}
+
+// ZoneSnapshot provides the records of a zone held by the engine by its name: the primary zone, a peer zone, the
+// rendezvous zone, or (by the empty name) the default zone.
+func (e *Engine) ZoneSnapshot(zoneName string) (*xform.ZoneSnapshot, bool) {
+	zone := e.defaultZone
+	if zoneName != "" {
+		var present bool
+		if zone, present = e.nameZone(zoneName); !present {
+			if dns.CanonicalName(zoneName) != dns.CanonicalName(e.currentConfig().SearchSuffix) {
+				return nil, false
+			}
+			zone = e.rendezvousZone
+		}
+	}
+	version, mappings := xform.ZoneMappings(zone)
+	return &xform.ZoneSnapshot{
+		Serial:   versionSerial(version),
+		Mappings: mappings,
+	}, true
+}
+
+// Retransfer transfers a zone again from its server by name: the primary zone, a peer zone, or the rendezvous zone
+// (which then merges every zone in full, correcting any record that differs).
+func (e *Engine) Retransfer(zoneName string) error {
+	if zone, present := e.nameZone(zoneName); present {
+		return e.refreshZone(zone, dns.Fqdn(zoneName))
+	}
+	if dns.CanonicalName(zoneName) == dns.CanonicalName(e.currentConfig().SearchSuffix) {
+		return e.refreshRendezvous()
+	}
+	return fmt.Errorf("zone '%s' unknown", zoneName)
+}
+
+// Explain determines how a rendezvous name is merged, without changing the rendezvous zone.
+func (e *Engine) Explain(name string) *MergeDecision {
+	name = strings.ToLower(dns.Fqdn(name))
+	decision := &MergeDecision{
+		Name: name,
+	}
+	e.zoneUpdateMutex.Lock()
+	if e.transposed != nil {
+		decision.Target = e.mergedTarget(name)
+		e.reachMutex.Lock()
+		if target, present := e.transposed[e.primaryZone][name]; present {
+			decision.Candidates = append(decision.Candidates, e.explainCandidate(e.primaryZone, target, false))
+		}
+		for _, peer := range e.currentPeers() {
+			if target, present := e.transposed[peer.zone][name]; present {
+				decision.Candidates = append(decision.Candidates,
+					e.explainCandidate(peer.zone, target, e.peerWithdrawn(peer)))
+			}
+		}
+		e.reachMutex.Unlock()
+	}
+	e.zoneUpdateMutex.Unlock()
+
+	decision.Override, _ = e.override(name)
+	e.defaultZone.RLock()
+	decision.Default = e.defaultZone.CNAMERecords[name]
+	e.defaultZone.RUnlock()
+	e.rendezvousZone.RLock()
+	decision.Current = e.rendezvousZone.CNAMERecords[name]
+	e.rendezvousZone.RUnlock()
+	return decision
+}
+
+// explainCandidate describes a candidate with its reachability. The caller must hold the reachMutex.
+func (e *Engine) explainCandidate(zone *xform.Zone, target string, withdrawn bool) *Candidate {
+	candidate := &Candidate{
+		Zone:      e.zoneName(zone),
+		Target:    target,
+		Withdrawn: withdrawn,
+	}
+	if result := e.reachability[target]; result != nil {
+		candidate.Probed = true
+		candidate.Reachable = result.reachable
+		candidate.Latency = result.latency
+	}
+	return candidate
+}
+
+// zoneName finds the suffix of the primary or a peer zone.
+func (e *Engine) zoneName(zone *xform.Zone) string {
+	if zone == e.primaryZone {
+		return e.currentConfig().LocalZone.Suffix
+	}
+	if peer := e.zonePeer(zone); peer != nil {
+		return peer.Suffix
+	}
+	return ""
+}
+
+// Overrides lists the manual overrides of rendezvous names, by name.
+func (e *Engine) Overrides() map[string]string {
+	e.overridesMutex.Lock()
+	defer e.overridesMutex.Unlock()
+	overrides := map[string]string{}
+	for name, target := range e.overrides {
+		overrides[name] = target
+	}
+	return overrides
+}
+
+// SetOverride points a rendezvous name at a target regardless of the primary, peer and default zones, until the
+// override is deleted (or the engine restarted; overrides are held in memory only).
+func (e *Engine) SetOverride(name, target string) error {
+	name = strings.ToLower(dns.Fqdn(name))
+	if !dns.IsSubDomain(e.currentConfig().SearchSuffix, name) {
+		return fmt.Errorf("name '%s' is not within the rendezvous zone '%s'", name, e.currentConfig().SearchSuffix)
+	}
+	if _, ok := dns.IsDomainName(target); !ok || target == "" {
+		return fmt.Errorf("target '%s' is not a valid domain name", target)
+	}
+	e.overridesMutex.Lock()
+	e.overrides[name] = dns.Fqdn(target)
+	e.overridesMutex.Unlock()
+	engineLog.Info("override set", logging.Name, name, logging.Target, dns.Fqdn(target))
+	// the names of the default zone are already rendezvous names, so its name is merged again as is
+	e.markDirty(e.defaultZone, name)
+	return nil
+}
+
+// DeleteOverride removes the manual override of a rendezvous name, reporting whether there was one.
+func (e *Engine) DeleteOverride(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	e.overridesMutex.Lock()
+	_, present := e.overrides[name]
+	delete(e.overrides, name)
+	e.overridesMutex.Unlock()
+	if present {
+		engineLog.Info("override deleted", logging.Name, name)
+		e.markDirty(e.defaultZone, name)
+	}
+	return present
+}
+
+// override finds the manual override of a rendezvous name, if any.
+func (e *Engine) override(name string) (string, bool) {
+	e.overridesMutex.Lock()
+	defer e.overridesMutex.Unlock()
+	target, present := e.overrides[name]
+	return target, present
+}
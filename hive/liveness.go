@@ -0,0 +1,168 @@
+package hive
+
+import (
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"fmt"
+	"sync"
+	"time"
+)
+
+var livenessLog = logging.For("liveness")
+
+// probeTimeout bounds how long a peer is given to reply to a probe (or the probe interval, if shorter).
+const probeTimeout = 5 * time.Second
+
+// PeerState is the liveness of a peer, as determined by probing it.
+type PeerState int
+
+const (
+	PeerUp       PeerState = iota
+	PeerDegraded           // the most recent probes failed, but fewer than are needed to consider the peer down
+	PeerDown
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerUp:
+		return "up"
+	case PeerDegraded:
+		return "degraded"
+	case PeerDown:
+		return "down"
+	}
+	return fmt.Sprintf("PeerState(%d)", int(s))
+}
+
+// Liveness summarizes the liveness of a peer.
+type Liveness struct {
+	State     PeerState
+	Since     time.Time // when the peer entered its state
+	Failures  int       // consecutive failed probes
+	Withdrawn bool      // whether the peer's mappings are withdrawn from the rendezvous zone
+}
+
+// startProbing probes each peer periodically in the background, until stopped.
+func (e *Engine) startProbing() {
+	if e.currentConfig().ProbeInterval <= 0 {
+		close(e.probeDone)
+		return
+	}
+	go func() {
+		defer close(e.probeDone)
+		ticker := time.NewTicker(e.currentConfig().ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.probePeers()
+			case <-e.probeStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopProbing stops probing peers, waiting for any probes in progress.
+func (e *Engine) stopProbing() {
+	close(e.probeStop)
+	<-e.probeDone
+}
+
+// probePeers probes every peer at once, and records the results.
+func (e *Engine) probePeers() {
+	config := e.currentConfig()
+	timeout := probeTimeout
+	if config.ProbeInterval < timeout {
+		timeout = config.ProbeInterval
+	}
+	var wg sync.WaitGroup
+	for _, peer := range e.currentPeers() {
+		wg.Add(1)
+		go func(peer *peerEntry) {
+			defer wg.Done()
+			e.recordProbe(peer, xform.ProbeSOA(peer.Server, e.key, peer.Suffix, timeout))
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// recordProbe advances the liveness of a peer with the result of a probe. A peer failing a probe is degraded, and down
+// once it has failed PeerDownAfter consecutive probes (if set). Once down for the grace period (if set), its mappings
+// are withdrawn from the rendezvous zone, until it next replies to a probe.
+func (e *Engine) recordProbe(peer *peerEntry, err error) {
+	config := e.currentConfig()
+	now := time.Now()
+
+	e.livenessMutex.Lock()
+	liveness := peer.liveness
+	wasWithdrawn := liveness.Withdrawn
+	if err == nil {
+		if liveness.State != PeerUp {
+			livenessLog.Info("peer is up", logging.Zone, peer.Suffix, logging.Peer, peer.Server.String())
+			liveness.State = PeerUp
+			liveness.Since = now
+		}
+		liveness.Failures = 0
+		liveness.Withdrawn = false
+	} else {
+		liveness.Failures++
+		if liveness.State == PeerUp {
+			livenessLog.Warn("peer is degraded", logging.Zone, peer.Suffix, logging.Peer, peer.Server.String(),
+				logging.Error, err)
+			liveness.State = PeerDegraded
+			liveness.Since = now
+		}
+		if liveness.State == PeerDegraded && config.PeerDownAfter > 0 && liveness.Failures >= config.PeerDownAfter {
+			livenessLog.Error("peer is down", logging.Zone, peer.Suffix, logging.Peer, peer.Server.String(),
+				"failures", liveness.Failures, logging.Error, err)
+			liveness.State = PeerDown
+			liveness.Since = now
+		}
+		if liveness.State == PeerDown && !liveness.Withdrawn && config.PeerGracePeriod > 0 &&
+			now.Sub(liveness.Since) >= config.PeerGracePeriod {
+			livenessLog.Warn("withdrawing mappings of peer", logging.Zone, peer.Suffix,
+				logging.Peer, peer.Server.String())
+			liveness.Withdrawn = true
+		}
+	}
+	withdrawn := liveness.Withdrawn
+	e.livenessMutex.Unlock()
+
+	if withdrawn == wasWithdrawn {
+		if err == nil && !e.isSynchronized(peer.zone) {
+			// the peer was unreachable when its zone was first transferred
+			livenessLog.Info("transferring zone of peer", logging.Zone, peer.Suffix, logging.Peer, peer.Server.String())
+			e.refreshZone(peer.zone, peer.Suffix)
+		}
+		return
+	}
+	// every name of the peer's zone is merged differently now
+	e.markDirty(peer.zone, zoneNames(peer.zone)...)
+	if !withdrawn {
+		livenessLog.Info("restoring mappings of peer", logging.Zone, peer.Suffix, logging.Peer, peer.Server.String())
+		// notifications sent while the peer was unreachable may have been lost
+		e.refreshZone(peer.zone, peer.Suffix)
+	}
+}
+
+// peerWithdrawn reports whether the mappings of a peer are withdrawn from the rendezvous zone.
+func (e *Engine) peerWithdrawn(peer *peerEntry) bool {
+	e.livenessMutex.Lock()
+	defer e.livenessMutex.Unlock()
+	return peer.liveness.Withdrawn
+}
+
+func zoneNames(zone *xform.Zone) []string {
+	zone.RLock()
+	defer zone.RUnlock()
+	names := make([]string, 0, len(zone.ARecords)+len(zone.CNAMERecords))
+	for name := range zone.ARecords {
+		names = append(names, name)
+	}
+	for name := range zone.CNAMERecords {
+		names = append(names, name)
+	}
+	return names
+}
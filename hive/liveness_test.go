@@ -0,0 +1,116 @@
+package hive
+
+import (
+	"github.com/thyth/hive/internal/dnstest"
+
+	"errors"
+	"testing"
+	"time"
+)
+
+var errProbe = errors.New("probe failed")
+
+// livenessEngine starts an engine whose peer east holds bar (only there) and foo (also at the primary). Probes are
+// recorded by the test rather than made periodically.
+func livenessEngine(t *testing.T, downAfter int, gracePeriod time.Duration) (*Engine, *peerEntry, func() string) {
+	primary := newPrimary(t, "foo.west.example.com. A 10.0.0.100")
+	east := newPeerServer(t, "127.0.0.2", "east.example.com.",
+		"foo.east.example.com. A 10.1.0.100",
+		"bar.east.example.com. A 10.1.0.101")
+	config := dnstest.Config(t, primary, east)
+	config.PeerDownAfter = downAfter
+	config.PeerGracePeriod = gracePeriod
+	e := startEngine(t, config)
+	bar := func() string {
+		return rendezvousTarget(primary, "bar.rdvu.example.com.")
+	}
+	waitFor(t, "rendezvous zone update", func() bool {
+		return bar() == "bar.east.example.com."
+	})
+	return e, e.currentPeers()[0], bar
+}
+
+// checkLiveness compares the liveness of a peer with that expected.
+func checkLiveness(t *testing.T, e *Engine, peer *peerEntry, state PeerState, failures int, withdrawn bool) {
+	t.Helper()
+	e.livenessMutex.Lock()
+	liveness := *peer.liveness
+	e.livenessMutex.Unlock()
+	if liveness.State != state || liveness.Failures != failures || liveness.Withdrawn != withdrawn {
+		t.Fatalf("expected %v after %d failures (withdrawn %v), got %v after %d failures (withdrawn %v)", state,
+			failures, withdrawn, liveness.State, liveness.Failures, liveness.Withdrawn)
+	}
+}
+
+func TestLivenessStates(t *testing.T) {
+	e, peer, bar := livenessEngine(t, 2, 50*time.Millisecond)
+	checkLiveness(t, e, peer, PeerUp, 0, false)
+
+	e.recordProbe(peer, errProbe)
+	checkLiveness(t, e, peer, PeerDegraded, 1, false)
+	e.recordProbe(peer, nil)
+	checkLiveness(t, e, peer, PeerUp, 0, false)
+
+	e.recordProbe(peer, errProbe)
+	e.recordProbe(peer, errProbe)
+	checkLiveness(t, e, peer, PeerDown, 2, false)
+	// within the grace period, the peer's mappings remain
+	e.recordProbe(peer, errProbe)
+	checkLiveness(t, e, peer, PeerDown, 3, false)
+	if target := bar(); target != "bar.east.example.com." {
+		t.Fatalf("mapping of a peer within its grace period was changed to '%s'", target)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	e.recordProbe(peer, errProbe)
+	checkLiveness(t, e, peer, PeerDown, 4, true)
+	waitFor(t, "mappings of the peer to be withdrawn", func() bool {
+		return bar() == ""
+	})
+
+	e.recordProbe(peer, nil)
+	checkLiveness(t, e, peer, PeerUp, 0, false)
+	waitFor(t, "mappings of the peer to be restored", func() bool {
+		return bar() == "bar.east.example.com."
+	})
+}
+
+func TestLivenessDisabled(t *testing.T) {
+	tests := []struct {
+		name        string
+		downAfter   int
+		gracePeriod time.Duration
+		state       PeerState
+	}{
+		{"never down", 0, time.Nanosecond, PeerDegraded},
+		{"never withdrawn", 1, 0, PeerDown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, peer, bar := livenessEngine(t, test.downAfter, test.gracePeriod)
+			for failures := 1; failures <= 5; failures++ {
+				e.recordProbe(peer, errProbe)
+			}
+			checkLiveness(t, e, peer, test.state, 5, false)
+			if target := bar(); target != "bar.east.example.com." {
+				t.Errorf("mapping of the peer was changed to '%s'", target)
+			}
+		})
+	}
+}
+
+func TestProbePeers(t *testing.T) {
+	primary := newPrimary(t)
+	east := newPeerServer(t, "127.0.0.2", "east.example.com.")
+	config := dnstest.Config(t, primary, east)
+	// probes are made by the test, but time out at the probe interval
+	config.ProbeInterval = time.Hour
+	e := startEngine(t, config)
+	peer := e.currentPeers()[0]
+
+	e.probePeers()
+	checkLiveness(t, e, peer, PeerUp, 0, false)
+	east.Close()
+	e.probePeers()
+	checkLiveness(t, e, peer, PeerDegraded, 1, false)
+}
@@ -0,0 +1,352 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/audit"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// markDirty records that names in a zone have changed, and schedules a (coalesced) rendezvous zone update.
+func (e *Engine) markDirty(zone *xform.Zone, names ...string) {
+	e.dirtyMutex.Lock()
+	if e.dirty[zone] == nil {
+		e.dirty[zone] = map[string]bool{}
+	}
+	for _, name := range names {
+		e.dirty[zone][strings.ToLower(name)] = true
+	}
+	e.dirtyMutex.Unlock()
+	e.reconciler.request()
+}
+
+// changedNames lists the names whose records differ between two versions of a zone (once each, even if a name changed
+// from an address to a CNAME or back). The caller must hold the lock of the current version.
+func changedNames(current, replacement *xform.Zone) []string {
+	var names []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for name, ip := range current.ARecords {
+		if !ip.Equal(replacement.ARecords[name]) {
+			add(name)
+		}
+	}
+	for name, ip := range replacement.ARecords {
+		if _, present := current.ARecords[name]; !present && ip != nil {
+			add(name)
+		}
+	}
+	for name, target := range current.CNAMERecords {
+		if replacementTarget, present := replacement.CNAMERecords[name]; !present || target != replacementTarget {
+			add(name)
+		}
+	}
+	for name := range replacement.CNAMERecords {
+		if _, present := current.CNAMERecords[name]; !present {
+			add(name)
+		}
+	}
+	return names
+}
+
+// transposeName maps a name within a site suffix onto the rendezvous suffix, reporting false if it is not in the site.
+func transposeName(name, siteSuffix, rendezvousSuffix string) (string, bool) {
+	if !dns.IsSubDomain(siteSuffix, name) {
+		return "", false
+	}
+	host := strings.TrimSuffix(strings.ToLower(name), strings.ToLower(siteSuffix))
+	return strings.ToLower(host + rendezvousSuffix), true
+}
+
+// retranspose recomputes the rendezvous CNAME record derived from one name of a primary or peer zone (the default
+// zone is already in the rendezvous suffix), returning the affected rendezvous name.
+func (e *Engine) retranspose(zone *xform.Zone, name string) (string, bool) {
+	config := e.currentConfig()
+	if zone == e.defaultZone {
+		return name, true
+	}
+	suffix := ""
+	if zone == e.primaryZone {
+		suffix = config.LocalZone.Suffix
+	} else if peer := e.zonePeer(zone); peer != nil {
+		suffix = peer.Suffix
+	}
+	transposedName, inSite := transposeName(name, suffix, config.SearchSuffix)
+	if suffix == "" || !inSite {
+		return "", false
+	}
+
+	zone.RLock()
+	target, present := zone.ARecords[name]
+	zone.RUnlock()
+	if present && zone == e.primaryZone {
+		// only hosts addressed within the local nets are rendezvous candidates from the primary
+		local := false
+		for _, localNet := range config.LocalNets {
+			if localNet.Contains(target) {
+				local = true
+				break
+			}
+		}
+		present = local
+	}
+	if present {
+		if e.transposed[zone] == nil {
+			e.transposed[zone] = map[string]string{}
+		}
+		e.transposed[zone][transposedName] = name
+	} else {
+		delete(e.transposed[zone], transposedName)
+	}
+	return transposedName, true
+}
+
+// mergedTarget determines the target of a rendezvous name: its manual override if any, otherwise the best of its
+// candidates from the primary zone and the peers (whose mappings are not withdrawn) if any, otherwise from the default
+// zone. An empty target means the name should not exist.
+func (e *Engine) mergedTarget(name string) string {
+	target, _ := e.mergeName(name)
+	return target
+}
+
+// mergeName determines the target of a rendezvous name (see mergedTarget), and describes why it was selected.
+func (e *Engine) mergeName(name string) (string, string) {
+	if target, overridden := e.override(name); overridden {
+		return target, "manual override"
+	}
+	if candidates := e.candidates(name); len(candidates) > 0 {
+		best := e.bestCandidate(candidates)
+		if best != candidates[0] {
+			return best.target, fmt.Sprintf("candidate of zone '%s' preferred by reachability over zone '%s'",
+				e.zoneName(best.zone), e.zoneName(candidates[0].zone))
+		}
+		return best.target, fmt.Sprintf("highest priority candidate, of zone '%s'", e.zoneName(best.zone))
+	}
+	e.defaultZone.RLock()
+	defer e.defaultZone.RUnlock()
+	if target, present := e.defaultZone.CNAMERecords[name]; present {
+		return target, "default zone"
+	}
+	return "", "no candidates"
+}
+
+// mergeChange is a change to the target of a rendezvous name to be written, with why its target was selected.
+type mergeChange struct {
+	target   string // empty to remove the name
+	previous string
+	reason   string
+}
+
+// auditWrite records an update written to the primary in the audit log, with its result.
+func auditWrite(zone, action, rrtype string, mapping *xform.Mapping, err error) {
+	event := &audit.Event{
+		Event:  audit.Write,
+		Zone:   zone,
+		Name:   mapping.Name,
+		Type:   rrtype,
+		Action: action,
+		Target: mapping.Target,
+	}
+	if mapping.IP != nil {
+		event.Address = mapping.IP.String()
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	audit.Record(event)
+}
+
+// localZoneUpdate brings the rendezvous zone up to date with the names changed since the last pass, and writes any
+// changes to it to the primary. The first pass (and the first after taking over as leader) transposes and merges every
+// zone in full.
+func (e *Engine) localZoneUpdate() {
+	config := e.currentConfig()
+	e.zoneUpdateMutex.Lock()
+	defer e.zoneUpdateMutex.Unlock()
+	started := time.Now()
+	defer func() {
+		mergeDuration.Observe(time.Since(started).Seconds())
+	}()
+
+	e.dirtyMutex.Lock()
+	dirty := e.dirty
+	e.dirty = map[*xform.Zone]map[string]bool{}
+	e.dirtyMutex.Unlock()
+
+	// A) determine the rendezvous names touched by the changes to the primary, peer and default zones
+	touched := e.pending
+	e.pending = map[string]bool{}
+	if e.transposed == nil {
+		e.transposed = map[*xform.Zone]map[string]string{
+			e.primaryZone: tranposePrimary(e.primaryZone, config).CNAMERecords,
+		}
+		for _, peer := range e.currentPeers() {
+			e.transposed[peer.zone] = tranposePeer(peer.zone, peer.Suffix, config.SearchSuffix).CNAMERecords
+		}
+		for _, transposed := range e.transposed {
+			for name := range transposed {
+				touched[name] = true
+			}
+		}
+		e.defaultZone.RLock()
+		for name := range e.defaultZone.CNAMERecords {
+			touched[name] = true
+		}
+		e.defaultZone.RUnlock()
+		e.rendezvousZone.RLock()
+		for name := range e.rendezvousZone.CNAMERecords {
+			touched[name] = true
+		}
+		e.rendezvousZone.RUnlock()
+		for name := range e.Overrides() {
+			touched[name] = true
+		}
+	} else {
+		for zone, names := range dirty {
+			if zone != e.primaryZone && zone != e.defaultZone && e.zonePeer(zone) == nil {
+				// the zone of a removed peer: merge the rendezvous names derived from it without it
+				for name := range e.transposed[zone] {
+					touched[name] = true
+				}
+				delete(e.transposed, zone)
+				continue
+			}
+			for name := range names {
+				if transposedName, affected := e.retranspose(zone, name); affected {
+					touched[transposedName] = true
+				}
+			}
+		}
+	}
+
+	// a standby keeps the transposed names current, but leaves writing to the leader (and merges in full on taking over)
+	if !e.IsLeader() {
+		return
+	}
+
+	// B) merge each touched name (primary zone first, through the peers in priority order, followed by the default
+	//    zone), and update the primary where the result differs from the rendezvous zone
+	targets := map[string]*mergeChange{}
+	for name := range touched {
+		target, reason := e.mergeName(name)
+		e.rendezvousZone.RLock()
+		current, present := e.rendezvousZone.CNAMERecords[name]
+		e.rendezvousZone.RUnlock()
+		if target != current || (!present && target != "") || (e.rewrite && target != "") {
+			targets[name] = &mergeChange{
+				target:   target,
+				previous: current,
+				reason:   reason,
+			}
+		}
+	}
+
+	// write the changes concurrently (pipelined by the writer, by as many workers as it has updates awaiting replies),
+	// retrying any that fail in the next pass
+	var mutex sync.Mutex
+	written := map[string]string{}
+	write := func(name string, change *mergeChange) {
+		target := change.target
+		mapping := &xform.Mapping{
+			Name:   name,
+			Target: target,
+		}
+		action := "add"
+		if target == "" {
+			action = "delete"
+		}
+		if e.dryRun {
+			// the rendezvous zone follows the plan as if it were written, so each later pass plans only what changes
+			// since
+			e.plan(&PlannedUpdate{
+				Zone:     config.SearchSuffix,
+				Name:     name,
+				Type:     "CNAME",
+				Action:   action,
+				Target:   target,
+				Previous: change.previous,
+				Record:   xform.UpdateRecord(config.TTL, mapping, config.SearchSuffix),
+				Reason:   change.reason,
+			})
+			mutex.Lock()
+			written[name] = target
+			mutex.Unlock()
+			return
+		}
+		engineLog.Info("writing rendezvous update", logging.Zone, config.SearchSuffix, logging.Name, name,
+			logging.Target, target)
+		err := e.writer.WriteUpdate(config.TTL, mapping, config.SearchSuffix)
+		auditWrite(config.SearchSuffix, action, "CNAME", mapping, err)
+		if err == nil && target != change.previous {
+			audit.Record(&audit.Event{
+				Event:    audit.Merge,
+				Zone:     config.SearchSuffix,
+				Name:     name,
+				Target:   target,
+				Previous: change.previous,
+				Reason:   change.reason,
+			})
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			engineLog.Error("unable to write rendezvous update", logging.Zone, config.SearchSuffix,
+				logging.Name, name, logging.Target, target, logging.Error, err)
+			e.pending[name] = true
+		} else {
+			rendezvousChanges.Inc()
+			written[name] = target
+		}
+	}
+	names := make(chan string, len(targets))
+	for name := range targets {
+		names <- name
+	}
+	close(names)
+	workers := config.WriteConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(targets) {
+		workers = len(targets)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				write(name, targets[name])
+			}
+		}()
+	}
+	wg.Wait()
+	if len(e.pending) == 0 {
+		e.rewrite = false
+	}
+
+	// C) track the written records as the state of the rendezvous zone, as a single new version
+	if len(written) == 0 {
+		return
+	}
+	e.rendezvousZone.Lock()
+	for name, target := range written {
+		if target == "" {
+			delete(e.rendezvousZone.CNAMERecords, name)
+		} else {
+			e.rendezvousZone.CNAMERecords[name] = target
+		}
+	}
+	e.rendezvousZone.Version++
+	e.rendezvousZone.Unlock()
+}
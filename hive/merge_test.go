@@ -0,0 +1,221 @@
+package hive
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/internal/dnstest"
+	"github.com/thyth/hive/xform"
+
+	"fmt"
+	"net"
+	"testing"
+)
+
+// benchmarkHosts is the number of hosts at each site of the benchmarks, roughly that of a large campus.
+const benchmarkHosts = 5000
+
+// mergeEngine prepares an engine in dry-run mode (so nothing is written) holding the zones of three sites, without
+// transferring them or serving peers: every west host is also at the east site, and every third at the north site.
+func mergeEngine(hosts int) *Engine {
+	_, localNet, _ := net.ParseCIDR("10.0.0.0/16")
+	primaryServer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	config := &conf.Configuration{
+		LocalNets: []*net.IPNet{localNet},
+		LocalZone: &conf.ZonePeer{
+			Suffix: "west.example.com.",
+			Server: primaryServer,
+		},
+		SearchSuffix: "rdvu.example.com.",
+		TTL:          300,
+	}
+	zones := map[string]*xform.Zone{}
+	for idx, suffix := range []string{"west.example.com.", "east.example.com.", "north.example.com."} {
+		zone := emptyZone(&net.UDPAddr{IP: net.IPv4(127, 0, 0, byte(idx+1)), Port: 53})
+		for host := 0; host < hosts; host++ {
+			if idx == 2 && host%3 != 0 {
+				continue
+			}
+			zone.ARecords[fmt.Sprintf("host%d.%s", host, suffix)] = net.IPv4(10, byte(idx), byte(host/250),
+				byte(host%250+1))
+		}
+		zones[suffix] = zone
+	}
+	for _, suffix := range []string{"east.example.com.", "north.example.com."} {
+		config.Peers = append(config.Peers, &conf.ZonePeer{
+			Suffix: suffix,
+			Server: zones[suffix].Server,
+		})
+	}
+
+	e := NewEngine(config, dnstest.Key)
+	e.SetDryRun(true)
+	e.leader = true
+	e.primaryZone = zones["west.example.com."]
+	e.rendezvousZone = emptyZone(primaryServer)
+	var peers []*peerEntry
+	for _, zonePeer := range config.Peers {
+		peers = append(peers, newPeer(zonePeer, zones[zonePeer.Suffix], false))
+	}
+	e.peersMutex.Lock()
+	e.setPeers(peers)
+	e.peersMutex.Unlock()
+	// the first pass merges in full, bringing the rendezvous zone up to date
+	e.localZoneUpdate()
+	return e
+}
+
+// moveHost changes the address of a host of a zone, and marks it dirty as a proposal would.
+func moveHost(e *Engine, zone *xform.Zone, name string, address net.IP) {
+	zone.Lock()
+	zone.ARecords[name] = address
+	zone.Version++
+	zone.Unlock()
+	e.markDirty(zone, name)
+}
+
+// mergeZones supplements the CNAME records of a canonical zone with those of a suggested zone not yet present, as the
+// rendezvous zone was merged before merging became incremental (from highest to lowest priority). It is kept as the
+// baseline of the benchmarks.
+func mergeZones(canonical, suggested map[string]string) map[string]string {
+	merged := make(map[string]string, len(canonical))
+	for name, target := range canonical {
+		merged[name] = target
+	}
+	for name, target := range suggested {
+		if _, present := merged[name]; !present {
+			merged[name] = target
+		}
+	}
+	return merged
+}
+
+// diffZones lists the changes transforming the CNAME records of a canonical zone into those of a comparison zone, a
+// deletion being an empty target, as the rendezvous zone was compared before merging became incremental.
+func diffZones(canonical, comparison map[string]string) map[string]string {
+	diff := map[string]string{}
+	for name, target := range canonical {
+		if comparisonTarget, present := comparison[name]; !present {
+			diff[name] = ""
+		} else if target != comparisonTarget {
+			diff[name] = comparisonTarget
+		}
+	}
+	for name, target := range comparison {
+		if _, present := canonical[name]; !present {
+			diff[name] = target
+		}
+	}
+	return diff
+}
+
+// baselineMerger recomputes the rendezvous zone as before merging became incremental: each zone changed is transposed
+// again, then every name of every zone is merged, and the result compared in full with the rendezvous zone.
+type baselineMerger struct {
+	e          *Engine
+	transposed map[*xform.Zone]map[string]string
+	rendezvous map[string]string
+}
+
+func newBaselineMerger(e *Engine) *baselineMerger {
+	m := &baselineMerger{
+		e:          e,
+		transposed: map[*xform.Zone]map[string]string{},
+		rendezvous: map[string]string{},
+	}
+	m.update(e.primaryZone)
+	for _, peer := range e.currentPeers() {
+		m.update(peer.zone)
+	}
+	return m
+}
+
+// update merges the zones after one has changed, returning the changes to the rendezvous zone.
+func (m *baselineMerger) update(changed *xform.Zone) map[string]string {
+	config := m.e.currentConfig()
+	if changed == m.e.primaryZone {
+		m.transposed[changed] = tranposePrimary(changed, config).CNAMERecords
+	}
+	merged := m.transposed[m.e.primaryZone]
+	for _, peer := range m.e.currentPeers() {
+		if peer.zone == changed {
+			m.transposed[changed] = tranposePeer(changed, peer.Suffix, config.SearchSuffix).CNAMERecords
+		}
+		if transposed, present := m.transposed[peer.zone]; present {
+			merged = mergeZones(merged, transposed)
+		}
+	}
+	merged = mergeZones(merged, m.e.defaultZone.CNAMERecords)
+	diff := diffZones(m.rendezvous, merged)
+	m.rendezvous = merged
+	return diff
+}
+
+func TestIncrementalMergeMatchesFull(t *testing.T) {
+	e := mergeEngine(100)
+	if target := e.rendezvousZone.CNAMERecords["host1.rdvu.example.com."]; target != "host1.west.example.com." {
+		t.Fatalf("expected the primary's host to be preferred, got '%s'", target)
+	}
+	// addressed outside the local nets, the west host is no longer a candidate
+	moveHost(e, e.primaryZone, "host1.west.example.com.", net.ParseIP("192.168.0.1"))
+	e.localZoneUpdate()
+	if target := e.rendezvousZone.CNAMERecords["host1.rdvu.example.com."]; target != "host1.east.example.com." {
+		t.Fatalf("expected the peer's host to be preferred, got '%s'", target)
+	}
+
+	incremental := map[string]string{}
+	for name, target := range e.rendezvousZone.CNAMERecords {
+		incremental[name] = target
+	}
+	// as merging before it became incremental would
+	if diff := diffZones(newBaselineMerger(e).rendezvous, incremental); len(diff) != 0 {
+		t.Errorf("incremental merge differs from the baseline: %v", diff)
+	}
+	e.transposed = nil
+	e.localZoneUpdate()
+	if len(e.rendezvousZone.CNAMERecords) != len(incremental) {
+		t.Fatalf("full merge holds %d names, incremental %d", len(e.rendezvousZone.CNAMERecords), len(incremental))
+	}
+	for name, target := range e.rendezvousZone.CNAMERecords {
+		if incremental[name] != target {
+			t.Errorf("%s: full merge targets '%s', incremental '%s'", name, target, incremental[name])
+		}
+	}
+}
+
+// BenchmarkLocalZoneUpdate measures an incremental pass, as made for a proposal changing one host.
+func BenchmarkLocalZoneUpdate(b *testing.B) {
+	e := mergeEngine(benchmarkHosts)
+	addresses := []net.IP{net.ParseIP("192.168.0.1"), net.ParseIP("10.0.0.1")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		moveHost(e, e.primaryZone, "host1.west.example.com.", addresses[i%2])
+		e.localZoneUpdate()
+	}
+}
+
+// BenchmarkMergeDiffBaseline measures a pass after one host changes as made before merging became incremental, which
+// transposed the changed zone again, then merged and compared every name of every zone (writing nothing).
+func BenchmarkMergeDiffBaseline(b *testing.B) {
+	e := mergeEngine(benchmarkHosts)
+	m := newBaselineMerger(e)
+	addresses := []net.IP{net.ParseIP("192.168.0.1"), net.ParseIP("10.0.0.1")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		moveHost(e, e.primaryZone, "host1.west.example.com.", addresses[i%2])
+		if diff := m.update(e.primaryZone); len(diff) != 1 {
+			b.Fatalf("expected one name changed, got %d", len(diff))
+		}
+	}
+}
+
+// BenchmarkLocalZoneUpdateFull measures a full pass (as made on startup, taking over as leader, or a periodic
+// reconciliation), which transposes and merges every name of every zone.
+func BenchmarkLocalZoneUpdateFull(b *testing.B) {
+	e := mergeEngine(benchmarkHosts)
+	addresses := []net.IP{net.ParseIP("192.168.0.1"), net.ParseIP("10.0.0.1")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		moveHost(e, e.primaryZone, "host1.west.example.com.", addresses[i%2])
+		e.transposed = nil
+		e.localZoneUpdate()
+	}
+}
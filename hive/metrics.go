@@ -0,0 +1,63 @@
+package hive
+
+import (
+	"github.com/thyth/hive/metrics"
+)
+
+var (
+	rendezvousChanges = metrics.Default.NewCounter("hive_rendezvous_changes_total",
+		"Changes to rendezvous names written to the primary.")
+	mergeDuration = metrics.Default.NewHistogram("hive_merge_duration_seconds",
+		"Duration of reconciliation passes merging the zones into the rendezvous zone.", metrics.DurationBuckets)
+)
+
+// RegisterMetrics registers gauges of the engine's state with a registry, collected each time the registry is written:
+// the records of each zone held, the liveness of each peer, and whether the engine is the leader. An engine's metrics
+// may only be registered once with a registry.
+func (e *Engine) RegisterMetrics(registry *metrics.Registry) {
+	registry.NewGaugeFunc("hive_zone_records", "Records of each zone held, by role, zone and type.",
+		[]string{"role", "zone", "type"}, func(emit func(float64, ...string)) {
+			status := e.Status()
+			emitZone := func(role string, zone *ZoneStatus) {
+				emit(float64(zone.ARecords), role, zone.Name, "A")
+				emit(float64(zone.CNAMERecords), role, zone.Name, "CNAME")
+			}
+			emitZone("primary", status.Primary)
+			for _, peer := range status.Peers {
+				emitZone("peer", peer)
+			}
+			emitZone("default", status.Default)
+			emitZone("rendezvous", status.Rendezvous)
+		})
+	registry.NewGaugeFunc("hive_peer_up", "Whether each peer is up (1), degraded or down (0), as determined by probing.",
+		[]string{"zone"}, func(emit func(float64, ...string)) {
+			for _, peer := range e.Status().Peers {
+				emit(boolValue(peer.Liveness.State == PeerUp), peer.Name)
+			}
+		})
+	registry.NewGaugeFunc("hive_peer_state", "The liveness state of each peer (1 for its current state, 0 otherwise).",
+		[]string{"zone", "state"}, func(emit func(float64, ...string)) {
+			for _, peer := range e.Status().Peers {
+				for _, state := range []PeerState{PeerUp, PeerDegraded, PeerDown} {
+					emit(boolValue(peer.Liveness.State == state), peer.Name, state.String())
+				}
+			}
+		})
+	registry.NewGaugeFunc("hive_peer_withdrawn", "Whether the mappings of each peer are withdrawn from the rendezvous "+
+		"zone.", []string{"zone"}, func(emit func(float64, ...string)) {
+		for _, peer := range e.Status().Peers {
+			emit(boolValue(peer.Liveness.Withdrawn), peer.Name)
+		}
+	})
+	registry.NewGaugeFunc("hive_leader", "Whether this instance is the leader, writing to the primary.", nil,
+		func(emit func(float64, ...string)) {
+			emit(boolValue(e.IsLeader()))
+		})
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"time"
+)
+
+var peersLog = logging.For("peers")
+
+// peerEntry is a configured or discovered peer, together with the engine's copy of its zone and its liveness.
+type peerEntry struct {
+	*conf.ZonePeer
+	zone       *xform.Zone
+	liveness   *Liveness // guarded by the livenessMutex
+	discovered bool      // from the catalog zone, rather than the configuration
+}
+
+func newPeer(zonePeer *conf.ZonePeer, zone *xform.Zone, discovered bool) *peerEntry {
+	return &peerEntry{
+		ZonePeer: zonePeer,
+		zone:     zone,
+		liveness: &Liveness{
+			State: PeerUp,
+			Since: time.Now(),
+		},
+		discovered: discovered,
+	}
+}
+
+// transferPeer transfers the zone of a peer, or starts it empty if the transfer fails (the peer may not be online yet).
+func (e *Engine) transferPeer(zonePeer *conf.ZonePeer) *xform.Zone {
+	zone, err := xform.ReadZoneEntries(zonePeer.Server, e.key, zonePeer.Suffix)
+	if err != nil {
+		peersLog.Warn("unable to transfer zone from peer", logging.Zone, zonePeer.Suffix,
+			logging.Peer, zonePeer.Server.String(), logging.Error, err)
+		return emptyZone(zonePeer.Server)
+	}
+	e.markSynchronized(zone)
+	return zone
+}
+
+// currentPeers lists the peers in priority order. The list is replaced (never modified) as peers are added or removed,
+// so may be used without holding the peersMutex.
+func (e *Engine) currentPeers() []*peerEntry {
+	e.peersMutex.RLock()
+	defer e.peersMutex.RUnlock()
+	return e.peers
+}
+
+// zonePeer finds the peer whose zone a zone is, if any.
+func (e *Engine) zonePeer(zone *xform.Zone) *peerEntry {
+	for _, peer := range e.currentPeers() {
+		if peer.zone == zone {
+			return peer
+		}
+	}
+	return nil
+}
+
+// setPeers replaces the peers, and the indices of the primary and peer zones by server and name. The caller must hold
+// the peersMutex.
+func (e *Engine) setPeers(peers []*peerEntry) {
+	config := e.currentConfig()
+	// keyed by address alone, as proposals and notifications are sent from ephemeral ports; the configuration (and the
+	// catalog) ensure no two servers share one
+	zoneByServer := map[string]*xform.Zone{
+		conf.AddrIP(config.LocalZone.Server).String(): e.primaryZone,
+	}
+	zoneByName := map[string]*xform.Zone{
+		dns.CanonicalName(config.LocalZone.Suffix): e.primaryZone,
+	}
+	for _, peer := range peers {
+		zoneByServer[conf.AddrIP(peer.Server).String()] = peer.zone
+		zoneByName[dns.CanonicalName(peer.Suffix)] = peer.zone
+	}
+	e.peers = peers
+	e.zoneByServer = zoneByServer
+	e.zoneByName = zoneByName
+
+	// forget the zones of removed peers
+	current := map[*xform.Zone]bool{}
+	for _, zone := range zoneByName {
+		current[zone] = true
+	}
+	e.healthMutex.Lock()
+	for zone := range e.synchronized {
+		if !current[zone] {
+			delete(e.synchronized, zone)
+		}
+	}
+	e.healthMutex.Unlock()
+}
+
+// serverZone finds the zone of the primary or a peer by the address of its server.
+func (e *Engine) serverZone(address string) (*xform.Zone, bool) {
+	e.peersMutex.RLock()
+	defer e.peersMutex.RUnlock()
+	zone, present := e.zoneByServer[address]
+	return zone, present
+}
+
+// nameZone finds the zone of the primary or a peer by its name.
+func (e *Engine) nameZone(zoneName string) (*xform.Zone, bool) {
+	e.peersMutex.RLock()
+	defer e.peersMutex.RUnlock()
+	zone, present := e.zoneByName[dns.CanonicalName(zoneName)]
+	return zone, present
+}
+
+// addPeer transfers the zone of a new peer, and merges it into the rendezvous zone at the lowest priority.
+func (e *Engine) addPeer(zonePeer *conf.ZonePeer, discovered bool) {
+	added := newPeer(zonePeer, e.transferPeer(zonePeer), discovered)
+	e.peersMutex.Lock()
+	peers := append(append([]*peerEntry{}, e.peers...), added)
+	e.setPeers(peers)
+	e.peersMutex.Unlock()
+	e.markDirty(added.zone, zoneNames(added.zone)...)
+}
+
+// removePeer stops merging the zone of a peer into the rendezvous zone.
+func (e *Engine) removePeer(removed *peerEntry) {
+	e.peersMutex.Lock()
+	var peers []*peerEntry
+	for _, peer := range e.peers {
+		if peer != removed {
+			peers = append(peers, peer)
+		}
+	}
+	e.setPeers(peers)
+	e.peersMutex.Unlock()
+	// the next pass merges the rendezvous names derived from the zone without it
+	e.markDirty(removed.zone)
+}
+
+// Peers lists the configured and discovered peers.
+func (e *Engine) Peers() []*conf.ZonePeer {
+	var zonePeers []*conf.ZonePeer
+	for _, peer := range e.currentPeers() {
+		zonePeers = append(zonePeers, peer.ZonePeer)
+	}
+	return zonePeers
+}
@@ -0,0 +1,95 @@
+package hive
+
+import (
+	"github.com/thyth/hive/logging"
+
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PlannedUpdate is an RFC2136 update to the primary computed in dry-run mode, which was not written. Updates planned
+// for the same name (and type) are combined, so that each describes the change from the primary's records.
+type PlannedUpdate struct {
+	Time     time.Time // when last planned
+	Zone     string
+	Name     string
+	Type     string // of the records added or deleted: A, AAAA, CNAME, or ANY
+	Action   string // add or delete
+	Target   string // of a CNAME record, or the address of an A or AAAA record; empty for a deletion
+	Previous string // the target of a rendezvous name on the primary, before the update
+	Record   string // as it would be sent in the update section, in presentation format
+	Reason   string // why the update is needed
+}
+
+// SetDryRun enables dry-run mode, in which the updates the engine would write to the primary (rendezvous changes, and
+// forwarded primary updates) are logged and held as planned, but never written. A dry run does not take part in
+// leader election, planning every update as the leader would. It must be called before Start.
+func (e *Engine) SetDryRun(dryRun bool) {
+	e.dryRun = dryRun
+}
+
+// PlannedUpdates lists the updates planned in dry-run mode, by zone and name.
+func (e *Engine) PlannedUpdates() []*PlannedUpdate {
+	e.planMutex.Lock()
+	updates := make([]*PlannedUpdate, 0, len(e.planned))
+	for _, update := range e.planned {
+		copied := *update
+		updates = append(updates, &copied)
+	}
+	e.planMutex.Unlock()
+	sort.Slice(updates, func(i, j int) bool {
+		if updates[i].Zone != updates[j].Zone {
+			return updates[i].Zone < updates[j].Zone
+		}
+		if updates[i].Name != updates[j].Name {
+			return updates[i].Name < updates[j].Name
+		}
+		return updates[i].Type < updates[j].Type
+	})
+	return updates
+}
+
+// Plan transfers the primary, rendezvous and peer zones (including those of the catalog zone's members, if configured),
+// then merges them in full, returning the updates that would bring the rendezvous zone up to date (as in dry-run mode,
+// writing nothing). The engine neither serves peers nor probes them, so every peer is considered up, and candidates are
+// preferred by priority alone.
+func (e *Engine) Plan() ([]*PlannedUpdate, error) {
+	e.SetDryRun(true)
+	if err := e.transferZones(); err != nil {
+		return nil, err
+	}
+	if catalog := e.currentConfig().Catalog; catalog != nil {
+		// without the peers of its members, their names would be planned for deletion
+		if err := e.refreshCatalog(); err != nil {
+			return nil, fmt.Errorf("unable to transfer catalog zone '%s': %v", catalog.Zone, err)
+		}
+	}
+	e.leaderMutex.Lock()
+	e.leader = true
+	e.leaderMutex.Unlock()
+	e.localZoneUpdate()
+	return e.PlannedUpdates(), nil
+}
+
+// plan logs an update that would be written to the primary, and holds it with the others planned: replacing any
+// earlier update of the same name and type (from whose previous target it then changes), or cancelling it if the name
+// returns to its previous target.
+func (e *Engine) plan(update *PlannedUpdate) {
+	engineLog.Info("dry run; not writing update", logging.Zone, update.Zone, logging.Name, update.Name,
+		"type", update.Type, "action", update.Action, logging.Target, update.Target, "record", update.Record,
+		"reason", update.Reason)
+	update.Time = time.Now()
+	key := update.Zone + " " + update.Name + " " + update.Type
+
+	e.planMutex.Lock()
+	defer e.planMutex.Unlock()
+	if earlier, present := e.planned[key]; present {
+		update.Previous = earlier.Previous
+		if update.Target == update.Previous {
+			delete(e.planned, key)
+			return
+		}
+	}
+	e.planned[key] = update
+}
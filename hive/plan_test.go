@@ -0,0 +1,69 @@
+package hive
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/internal/dnstest"
+
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// planUpdates plans the updates of an engine for a configuration, describing each as a line.
+func planUpdates(t *testing.T, config *conf.Configuration) ([]string, error) {
+	updates, err := NewEngine(config, dnstest.Key).Plan()
+	var described []string
+	for _, update := range updates {
+		described = append(described, fmt.Sprintf("%s %s %s %s -> %s", update.Action, update.Name, update.Type,
+			update.Previous, update.Target))
+	}
+	return described, err
+}
+
+func TestPlan(t *testing.T) {
+	primary := newPrimary(t, "foo.west.example.com. A 10.0.0.100", "bar.west.example.com. A 192.168.0.100")
+	primary.AddZone("rdvu.example.com.",
+		"bar.rdvu.example.com. CNAME bar.west.example.com.",
+		"old.rdvu.example.com. CNAME old.west.example.com.")
+	east := newPeerServer(t, "127.0.0.2", "east.example.com.", "bar.east.example.com. A 10.1.0.100")
+
+	planned, err := planUpdates(t, dnstest.Config(t, primary, east))
+	if err != nil {
+		t.Fatalf("unable to plan: %v", err)
+	}
+	expected := []string{
+		"add bar.rdvu.example.com. CNAME bar.west.example.com. -> bar.east.example.com.",
+		"add foo.rdvu.example.com. CNAME  -> foo.west.example.com.",
+		"delete old.rdvu.example.com. CNAME old.west.example.com. -> ",
+	}
+	if fmt.Sprint(planned) != fmt.Sprint(expected) {
+		t.Errorf("expected plan %q, got %q", expected, planned)
+	}
+	if updates := primary.Updates(); len(updates) != 0 {
+		t.Errorf("planning wrote %d updates", len(updates))
+	}
+}
+
+func TestPlanCatalog(t *testing.T) {
+	primary := newPrimary(t)
+	primary.AddZone("rdvu.example.com.", "bar.rdvu.example.com. CNAME bar.east.example.com.")
+	east := newPeerServer(t, "127.0.0.2", "east.example.com.", "bar.east.example.com. A 10.1.0.100")
+	setCatalog(primary, map[string]net.Addr{"east.example.com.": east.Addr})
+	config := dnstest.Config(t, primary)
+	config.Catalog = &conf.Catalog{
+		Zone:     "catalog.example.com.",
+		Server:   primary.Addr,
+		Interval: time.Hour,
+	}
+
+	// the names of members' peers are kept
+	if planned, err := planUpdates(t, config); err != nil || len(planned) != 0 {
+		t.Errorf("expected nothing planned, got %q (%v)", planned, err)
+	}
+	// rather than deleted, should the catalog not transfer
+	primary.AddZone("catalog.example.com.", "version.catalog.example.com. TXT \"1\"")
+	if planned, err := planUpdates(t, config); err == nil {
+		t.Errorf("planned %q without the catalog", planned)
+	}
+}
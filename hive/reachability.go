@@ -0,0 +1,253 @@
+package hive
+
+import (
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/xform"
+
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var reachLog = logging.For("reachability")
+
+const (
+	// latencyAdvantage is how many times faster the host of a lower priority peer must be reached to be preferred
+	latencyAdvantage = 2
+	// reachabilityConcurrency bounds how many hosts are probed at once
+	reachabilityConcurrency = 16
+	// echoPort is the port of the UDP echo service (RFC862)
+	echoPort = 7
+)
+
+// Dialer establishes the connections reachability probes are made with. A net.Dialer is used unless another (e.g. a
+// test double standing in for the network) is given to SetDialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// reachability is the result of probing a host.
+type reachability struct {
+	reachable bool
+	latency   time.Duration
+}
+
+// candidate is a site host a rendezvous name may point to.
+type candidate struct {
+	zone   *xform.Zone
+	target string
+}
+
+// SetDialer replaces the Dialer reachability probes are made with. It must be called before Start.
+func (e *Engine) SetDialer(dialer Dialer) {
+	e.dialer = dialer
+}
+
+// startReachability probes the hosts of contested rendezvous names periodically in the background, until stopped.
+func (e *Engine) startReachability() {
+	if e.currentConfig().Reachability == nil {
+		close(e.reachDone)
+		return
+	}
+	go func() {
+		defer close(e.reachDone)
+		ticker := time.NewTicker(e.currentConfig().Reachability.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.probeReachability()
+			case <-e.reachStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopReachability stops probing hosts, waiting for any probes in progress.
+func (e *Engine) stopReachability() {
+	close(e.reachStop)
+	<-e.reachDone
+}
+
+// candidates lists the site hosts a rendezvous name may point to in priority order: from the primary zone, then from
+// the peers whose mappings are not withdrawn. The caller must hold the zoneUpdateMutex.
+func (e *Engine) candidates(name string) []*candidate {
+	var candidates []*candidate
+	if target, present := e.transposed[e.primaryZone][name]; present {
+		candidates = append(candidates, &candidate{
+			zone:   e.primaryZone,
+			target: target,
+		})
+	}
+	for _, peer := range e.currentPeers() {
+		if e.peerWithdrawn(peer) {
+			continue
+		}
+		if target, present := e.transposed[peer.zone][name]; present {
+			candidates = append(candidates, &candidate{
+				zone:   peer.zone,
+				target: target,
+			})
+		}
+	}
+	return candidates
+}
+
+// bestCandidate selects the candidate a rendezvous name points to: the first in priority order, unless probes found it
+// unreachable and an alternative reachable, or found the host of a later peer reachable latencyAdvantage times faster
+// than that of an earlier peer. Hosts of the primary zone are never displaced while reachable, and hosts not (yet)
+// probed never displace another.
+func (e *Engine) bestCandidate(candidates []*candidate) *candidate {
+	best := candidates[0]
+	e.reachMutex.Lock()
+	defer e.reachMutex.Unlock()
+	bestResult := e.reachability[best.target]
+	for _, candidate := range candidates[1:] {
+		result := e.reachability[candidate.target]
+		if result == nil || !result.reachable || bestResult == nil {
+			continue
+		}
+		if !bestResult.reachable ||
+			(best.zone != e.primaryZone && result.latency*latencyAdvantage < bestResult.latency) {
+			best, bestResult = candidate, result
+		}
+	}
+	return best
+}
+
+// probeReachability probes the hosts of every rendezvous name several sites could answer, then merges those names
+// again with the results.
+func (e *Engine) probeReachability() {
+	e.zoneUpdateMutex.Lock()
+	contested := map[*candidate]bool{}
+	if e.transposed != nil {
+		names := map[string]bool{}
+		for _, transposed := range e.transposed {
+			for name := range transposed {
+				names[name] = true
+			}
+		}
+		for name := range names {
+			if candidates := e.candidates(name); len(candidates) > 1 {
+				for _, candidate := range candidates {
+					contested[candidate] = true
+				}
+			}
+		}
+	}
+	e.zoneUpdateMutex.Unlock()
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, reachabilityConcurrency)
+	results := map[string]*reachability{}
+	dirty := map[*xform.Zone][]string{}
+	for candidate := range contested {
+		dirty[candidate.zone] = append(dirty[candidate.zone], candidate.target)
+		candidate.zone.RLock()
+		address := candidate.zone.ARecords[candidate.target]
+		candidate.zone.RUnlock()
+		if address == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(target string, address net.IP) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			result := e.probeHost(address)
+			reachLog.Debug("probed host", logging.Target, target, logging.Address, address.String(),
+				"reachable", result.reachable, "latency", result.latency)
+			mutex.Lock()
+			results[target] = result
+			mutex.Unlock()
+		}(candidate.target, address)
+	}
+	wg.Wait()
+
+	e.reachMutex.Lock()
+	for target, result := range results {
+		if previous := e.reachability[target]; previous != nil && previous.reachable != result.reachable {
+			if result.reachable {
+				reachLog.Info("host became reachable", logging.Target, target)
+			} else {
+				reachLog.Warn("host became unreachable", logging.Target, target)
+			}
+		}
+	}
+	e.reachability = results
+	e.reachMutex.Unlock()
+	for zone, names := range dirty {
+		e.markDirty(zone, names...)
+	}
+}
+
+// probeHost checks whether a host is reachable by connecting to each configured TCP port in turn (a refused connection
+// is answered by the host, so also counts), then by its UDP echo service, if configured.
+func (e *Engine) probeHost(address net.IP) *reachability {
+	probes := e.currentConfig().Reachability
+	for _, port := range probes.TCPPorts {
+		ctx, cancel := context.WithTimeout(context.Background(), probes.Timeout)
+		start := time.Now()
+		conn, err := e.dialer.DialContext(ctx, "tcp", net.JoinHostPort(address.String(), strconv.Itoa(port)))
+		latency := time.Since(start)
+		cancel()
+		if err == nil {
+			conn.Close()
+		}
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			return &reachability{
+				reachable: true,
+				latency:   latency,
+			}
+		}
+	}
+	if probes.UDPEcho {
+		if latency, reachable := e.probeEcho(address); reachable {
+			return &reachability{
+				reachable: true,
+				latency:   latency,
+			}
+		}
+	}
+	return &reachability{}
+}
+
+// probeEcho checks whether a host echoes a datagram sent to its UDP echo service (a port unreachable error is sent by
+// the host, so also counts).
+func (e *Engine) probeEcho(address net.IP) (time.Duration, bool) {
+	timeout := e.currentConfig().Reachability.Timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := e.dialer.DialContext(ctx, "udp", net.JoinHostPort(address.String(), strconv.Itoa(echoPort)))
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	start := time.Now()
+	if _, err := conn.Write(nonce); err != nil {
+		return 0, false
+	}
+	reply := make([]byte, len(nonce))
+	for {
+		n, err := conn.Read(reply)
+		if err != nil {
+			return time.Since(start), errors.Is(err, syscall.ECONNREFUSED)
+		}
+		if bytes.Equal(reply[:n], nonce) {
+			return time.Since(start), true
+		}
+		// a stale or unrelated datagram; keep waiting for the echo until the deadline
+	}
+}
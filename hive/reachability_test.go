@@ -0,0 +1,167 @@
+package hive
+
+import (
+	"github.com/thyth/hive/conf"
+
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeHost is how a host answers the probes of a fakeDialer.
+type fakeHost struct {
+	tcp     error         // the error connecting to it fails with, if any (context.DeadlineExceeded waits out the probe)
+	latency time.Duration // how long connecting to it takes
+	echo    string        // "echo" to echo datagrams, "refuse" for port unreachable errors, otherwise silent
+}
+
+// fakeDialer stands in for the network, answering the probes of each host address as configured.
+type fakeDialer map[string]*fakeHost
+
+func (d fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	fake := d[host]
+	if fake == nil {
+		fake = &fakeHost{tcp: context.DeadlineExceeded}
+	}
+	if network == "udp" {
+		return &echoConn{mode: fake.echo, replies: make(chan []byte, 1)}, nil
+	}
+	if fake.tcp == context.DeadlineExceeded {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(fake.latency)
+	if fake.tcp != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fake.tcp}
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+// echoConn is the UDP socket of an echo probe to a fakeHost.
+type echoConn struct {
+	net.Conn
+	mode     string
+	replies  chan []byte
+	deadline time.Time
+}
+
+func (c *echoConn) Write(b []byte) (int, error) {
+	switch c.mode {
+	case "echo":
+		c.replies <- append([]byte{}, b...)
+	case "garble":
+		c.replies <- []byte("not the nonce")
+	}
+	return len(b), nil
+}
+
+func (c *echoConn) Read(b []byte) (int, error) {
+	if c.mode == "refuse" {
+		return 0, &net.OpError{Op: "read", Net: "udp", Err: syscall.ECONNREFUSED}
+	}
+	select {
+	case reply := <-c.replies:
+		return copy(b, reply), nil
+	case <-time.After(time.Until(c.deadline)):
+		return 0, context.DeadlineExceeded
+	}
+}
+
+func (c *echoConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *echoConn) Close() error {
+	return nil
+}
+
+func TestProbeHost(t *testing.T) {
+	tests := []struct {
+		name      string
+		tcpPorts  []int
+		udpEcho   bool
+		host      *fakeHost
+		reachable bool
+	}{
+		{"tcp connected", []int{22}, false, &fakeHost{}, true},
+		{"tcp refused", []int{22}, false, &fakeHost{tcp: syscall.ECONNREFUSED}, true},
+		{"tcp unreachable", []int{22, 443}, false, &fakeHost{tcp: syscall.EHOSTUNREACH}, false},
+		{"tcp timed out", []int{22}, false, &fakeHost{tcp: context.DeadlineExceeded}, false},
+		{"udp echoed", nil, true, &fakeHost{echo: "echo"}, true},
+		{"udp port unreachable", nil, true, &fakeHost{echo: "refuse"}, true},
+		{"udp garbled", nil, true, &fakeHost{echo: "garble"}, false},
+		{"udp silent", nil, true, &fakeHost{}, false},
+		{"udp after tcp timed out", []int{22}, true, &fakeHost{tcp: context.DeadlineExceeded, echo: "echo"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := mergeEngine(0)
+			e.currentConfig().Reachability = &conf.Reachability{
+				TCPPorts: test.tcpPorts,
+				UDPEcho:  test.udpEcho,
+				Timeout:  50 * time.Millisecond,
+			}
+			e.SetDialer(fakeDialer{"10.0.0.1": test.host})
+			if result := e.probeHost(net.ParseIP("10.0.0.1")); result.reachable != test.reachable {
+				t.Errorf("expected reachable %v, got %v", test.reachable, result.reachable)
+			}
+		})
+	}
+}
+
+// TestReachabilitySelection probes the hosts of a name at the primary's site (west) and two peer sites (east, then
+// north, in priority order), merging the name with the results.
+func TestReachabilitySelection(t *testing.T) {
+	const west, east, north = "10.0.0.1", "10.1.0.1", "10.2.0.1"
+	unreachable := &fakeHost{tcp: context.DeadlineExceeded}
+	// hosts reached in about the same time, so that none is markedly faster despite scheduling jitter
+	reachable := &fakeHost{latency: 20 * time.Millisecond}
+	tests := []struct {
+		name   string
+		hosts  fakeDialer
+		target string
+	}{
+		{"all reachable", fakeDialer{west: reachable, east: reachable, north: reachable}, "host0.west.example.com."},
+		{"primary unreachable", fakeDialer{west: unreachable, east: reachable, north: reachable},
+			"host0.east.example.com."},
+		{"only last reachable", fakeDialer{west: unreachable, east: unreachable, north: reachable},
+			"host0.north.example.com."},
+		{"none reachable", fakeDialer{west: unreachable, east: unreachable, north: unreachable},
+			"host0.west.example.com."},
+		{"later peer markedly faster", fakeDialer{
+			west:  unreachable,
+			east:  {latency: 100 * time.Millisecond},
+			north: {latency: 5 * time.Millisecond},
+		}, "host0.north.example.com."},
+		{"later peer slightly faster", fakeDialer{
+			west:  unreachable,
+			east:  {latency: 100 * time.Millisecond},
+			north: {latency: 70 * time.Millisecond},
+		}, "host0.east.example.com."},
+		{"primary slower but reachable", fakeDialer{
+			west: {latency: 100 * time.Millisecond},
+			east: {latency: 5 * time.Millisecond},
+		}, "host0.west.example.com."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := mergeEngine(1)
+			e.currentConfig().Reachability = &conf.Reachability{
+				TCPPorts: []int{22},
+				Timeout:  200 * time.Millisecond,
+			}
+			e.SetDialer(test.hosts)
+			e.probeReachability()
+			e.localZoneUpdate()
+			if target := e.rendezvousZone.CNAMERecords["host0.rdvu.example.com."]; target != test.target {
+				t.Errorf("expected '%s', got '%s'", test.target, target)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package hive
+
+import (
+	"time"
+)
+
+// reconciler coalesces requests to recompute the rendezvous zone into single passes. A pass runs once no further
+// request has arrived for the debounce delay, but no later than the maximum delay after the first outstanding request.
+type reconciler struct {
+	delay    time.Duration
+	maxDelay time.Duration
+	pass     func()
+
+	requests chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newReconciler(delay, maxDelay time.Duration, pass func()) *reconciler {
+	return &reconciler{
+		delay:    delay,
+		maxDelay: maxDelay,
+		pass:     pass,
+		requests: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start runs the reconciler in the background until it is stopped.
+func (r *reconciler) start() {
+	go r.run()
+}
+
+// request schedules a pass, without blocking the caller.
+func (r *reconciler) request() {
+	select {
+	case r.requests <- struct{}{}:
+	default:
+		// a request is already queued
+	}
+}
+
+// shutdown stops the reconciler, first running a pass for any outstanding request.
+func (r *reconciler) shutdown() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *reconciler) run() {
+	defer close(r.done)
+
+	debounce := time.NewTimer(r.delay)
+	stopTimer(debounce)
+	deadline := time.NewTimer(r.maxDelay)
+	stopTimer(deadline)
+	outstanding := false
+
+	for {
+		select {
+		case <-r.requests:
+			if !outstanding {
+				outstanding = true
+				deadline.Reset(r.maxDelay)
+			}
+			stopTimer(debounce)
+			debounce.Reset(r.delay)
+			continue
+		case <-debounce.C:
+		case <-deadline.C:
+		case <-r.stop:
+			select {
+			case <-r.requests:
+				outstanding = true
+			default:
+			}
+			if outstanding {
+				r.pass()
+			}
+			return
+		}
+
+		stopTimer(debounce)
+		stopTimer(deadline)
+		outstanding = false
+		r.pass()
+	}
+}
+
+// stopTimer stops a timer and discards any expiry already delivered, so that it may be safely reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package hive
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// passRecorder records when the passes of a reconciler run.
+type passRecorder struct {
+	mutex  sync.Mutex
+	passes []time.Time
+}
+
+func (p *passRecorder) pass() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.passes = append(p.passes, time.Now())
+}
+
+func (p *passRecorder) times() []time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]time.Time(nil), p.passes...)
+}
+
+func TestReconcilerDebounce(t *testing.T) {
+	recorder := &passRecorder{}
+	r := newReconciler(50*time.Millisecond, time.Second, recorder.pass)
+	r.start()
+	defer r.shutdown()
+
+	// a burst of requests is coalesced into one pass, once the delay has passed after the last
+	for i := 0; i < 20; i++ {
+		r.request()
+		time.Sleep(time.Millisecond)
+	}
+	last := time.Now()
+	time.Sleep(300 * time.Millisecond)
+	passes := recorder.times()
+	if len(passes) != 1 {
+		t.Fatalf("expected the burst coalesced into one pass, got %d", len(passes))
+	}
+	if waited := passes[0].Sub(last); waited < 40*time.Millisecond {
+		t.Errorf("pass ran %v after the last request, before the delay", waited)
+	}
+
+	// and a later request makes another
+	r.request()
+	time.Sleep(300 * time.Millisecond)
+	if passes := recorder.times(); len(passes) != 2 {
+		t.Errorf("expected a second pass, got %d", len(passes))
+	}
+}
+
+func TestReconcilerMaxDelay(t *testing.T) {
+	recorder := &passRecorder{}
+	r := newReconciler(50*time.Millisecond, 200*time.Millisecond, recorder.pass)
+	r.start()
+	defer r.shutdown()
+
+	// requests arriving more often than the delay never let it pass, but each still gets a pass within the maximum
+	first := time.Now()
+	for time.Since(first) < 700*time.Millisecond {
+		r.request()
+		time.Sleep(10 * time.Millisecond)
+	}
+	passes := recorder.times()
+	if len(passes) < 2 {
+		t.Fatalf("expected passes by the maximum delay during the stream, got %d", len(passes))
+	}
+	if waited := passes[0].Sub(first); waited < 190*time.Millisecond || waited > 350*time.Millisecond {
+		t.Errorf("first pass ran %v after the first request, rather than at the maximum delay", waited)
+	}
+	for idx := 1; idx < len(passes); idx++ {
+		if gap := passes[idx].Sub(passes[idx-1]); gap > 350*time.Millisecond {
+			t.Errorf("pass %d ran %v after the previous one, beyond the maximum delay", idx, gap)
+		}
+	}
+}
+
+func TestReconcilerShutdown(t *testing.T) {
+	// an outstanding request is passed on shutdown, rather than waiting out the delay
+	recorder := &passRecorder{}
+	r := newReconciler(time.Hour, time.Hour, recorder.pass)
+	r.start()
+	r.request()
+	r.shutdown()
+	if passes := recorder.times(); len(passes) != 1 {
+		t.Errorf("expected the outstanding request passed on shutdown, got %d passes", len(passes))
+	}
+
+	// without one, there is no pass
+	recorder = &passRecorder{}
+	r = newReconciler(time.Hour, time.Hour, recorder.pass)
+	r.start()
+	r.shutdown()
+	if passes := recorder.times(); len(passes) != 0 {
+		t.Errorf("expected no pass on shutdown, got %d", len(passes))
+	}
+}
@@ -0,0 +1,236 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/logging"
+
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var reloadLog = logging.For("reload")
+
+// rebindTimeout bounds how long requests in flight on the previous listeners are given to complete when rebinding.
+const rebindTimeout = 30 * time.Second
+
+// configChange describes a difference between two configurations.
+type configChange struct {
+	setting string
+	live    bool // applied on reload, rather than on restart
+}
+
+// configChanges lists the settings that differ between two configurations.
+func configChanges(old, new *conf.Configuration) []*configChange {
+	var changes []*configChange
+	compare := func(setting string, live bool, before, after interface{}) {
+		if fmt.Sprint(before) != fmt.Sprint(after) {
+			changes = append(changes, &configChange{
+				setting: setting,
+				live:    live,
+			})
+		}
+	}
+	compare("localNets", true, old.LocalNets, new.LocalNets)
+	compare("peers", true, zonePeerList(old.Peers), zonePeerList(new.Peers))
+	compare("ttl", true, old.TTL, new.TTL)
+	compare("listen", true, old.ListenAddresses, new.ListenAddresses)
+	compare("listenNetworks", true, old.ListenNetworks, new.ListenNetworks)
+	compare("answerQueries", true, old.AnswerQueries, new.AnswerQueries)
+	if !reflect.DeepEqual(old.Views, new.Views) {
+		changes = append(changes, &configChange{setting: "views", live: true})
+	}
+	compare("peerDownAfter", true, old.PeerDownAfter, new.PeerDownAfter)
+	compare("peerGracePeriod", true, old.PeerGracePeriod, new.PeerGracePeriod)
+	compare("reconcileDelay", false, old.ReconcileDelay, new.ReconcileDelay)
+	compare("reconcileMaxDelay", false, old.ReconcileMaxDelay, new.ReconcileMaxDelay)
+	compare("writeConcurrency", false, old.WriteConcurrency, new.WriteConcurrency)
+	compare("writeTimeout", false, old.WriteTimeout, new.WriteTimeout)
+	compare("probeInterval", false, old.ProbeInterval, new.ProbeInterval)
+	compare("antiEntropyInterval", false, old.AntiEntropyInterval, new.AntiEntropyInterval)
+	if !reflect.DeepEqual(old.Reachability, new.Reachability) {
+		changes = append(changes, &configChange{setting: "reachability"})
+	}
+	if fmt.Sprint(catalogSettings(old.Catalog)) != fmt.Sprint(catalogSettings(new.Catalog)) {
+		changes = append(changes, &configChange{setting: "catalog"})
+	}
+	if !reflect.DeepEqual(old.HighAvailability, new.HighAvailability) {
+		changes = append(changes, &configChange{setting: "highAvailability"})
+	}
+	if !reflect.DeepEqual(old.Admin, new.Admin) {
+		changes = append(changes, &configChange{setting: "admin"})
+	}
+	if !reflect.DeepEqual(old.Metrics, new.Metrics) {
+		changes = append(changes, &configChange{setting: "metrics"})
+	}
+	if !reflect.DeepEqual(old.Health, new.Health) {
+		changes = append(changes, &configChange{setting: "health"})
+	}
+	// applied by the host application (e.g. by logging.Configure and audit.Configure), rather than the engine
+	if !reflect.DeepEqual(old.Logging, new.Logging) {
+		changes = append(changes, &configChange{setting: "logging", live: true})
+	}
+	if !reflect.DeepEqual(old.Audit, new.Audit) {
+		changes = append(changes, &configChange{setting: "audit", live: true})
+	}
+	return changes
+}
+
+// zonePeerList formats peers for comparison.
+func zonePeerList(zonePeers []*conf.ZonePeer) []string {
+	var list []string
+	for _, zonePeer := range zonePeers {
+		list = append(list, dns.CanonicalName(zonePeer.Suffix)+"@"+zonePeer.Server.String())
+	}
+	return list
+}
+
+// catalogSettings formats the catalog configuration for comparison.
+func catalogSettings(catalog *conf.Catalog) []interface{} {
+	if catalog == nil {
+		return nil
+	}
+	return []interface{}{catalog.Zone, catalog.Server, catalog.Interval}
+}
+
+// Reload applies a new configuration to a running engine: peers added to or removed from it are added or removed
+// (with their zones), changes to the local nets, TTL or peers are merged into the rendezvous zone in full, and the
+// listeners are bound again only if the listen addresses or networks changed. Settings of the background tasks
+// (reconciliation, writing, probing, anti-entropy, reachability, the catalog, high availability, the admin API, metrics
+// and health checks) take effect on restart; until then, their previous values remain in effect. A configuration for
+// another local zone or rendezvous zone, or whose listeners cannot be bound, is rejected, leaving the previous
+// configuration in effect.
+func (e *Engine) Reload(config *conf.Configuration) error {
+	old := e.currentConfig()
+	if dns.CanonicalName(config.LocalZone.Suffix) != dns.CanonicalName(old.LocalZone.Suffix) ||
+		config.LocalZone.Server.String() != old.LocalZone.Server.String() {
+		return fmt.Errorf("local zone changed from '%s' at %v to '%s' at %v: restart required", old.LocalZone.Suffix,
+			old.LocalZone.Server, config.LocalZone.Suffix, config.LocalZone.Server)
+	}
+	if dns.CanonicalName(config.SearchSuffix) != dns.CanonicalName(old.SearchSuffix) {
+		return fmt.Errorf("search suffix changed from '%s' to '%s': restart required", old.SearchSuffix,
+			config.SearchSuffix)
+	}
+	changes := configChanges(old, config)
+	if len(changes) == 0 {
+		reloadLog.Info("configuration unchanged")
+		return nil
+	}
+
+	// keep the settings of the background tasks in effect until restart
+	applied := *config
+	applied.ReconcileDelay = old.ReconcileDelay
+	applied.ReconcileMaxDelay = old.ReconcileMaxDelay
+	applied.WriteConcurrency = old.WriteConcurrency
+	applied.WriteTimeout = old.WriteTimeout
+	applied.ProbeInterval = old.ProbeInterval
+	applied.AntiEntropyInterval = old.AntiEntropyInterval
+	applied.Reachability = old.Reachability
+	applied.Catalog = old.Catalog
+	applied.HighAvailability = old.HighAvailability
+	applied.Admin = old.Admin
+	applied.Metrics = old.Metrics
+	applied.Health = old.Health
+	config = &applied
+
+	changed := map[string]bool{}
+	for _, change := range changes {
+		changed[change.setting] = true
+		if change.live {
+			reloadLog.Info("configuration changed; applying", "setting", change.setting)
+		} else {
+			reloadLog.Warn("configuration changed; takes effect on restart", "setting", change.setting)
+		}
+	}
+
+	// bind the new listeners before anything else changes, so that failing to leaves the previous configuration intact
+	if changed["listen"] || changed["listenNetworks"] {
+		if err := e.rebind(config); err != nil {
+			return err
+		}
+	} else {
+		e.currentServer().SetConfig(config)
+	}
+
+	e.configMutex.Lock()
+	e.config = config
+	e.configMutex.Unlock()
+
+	if changed["peers"] {
+		e.reloadPeers(config)
+	}
+	if changed["localNets"] || changed["peers"] || changed["ttl"] {
+		// transpose and merge every zone again at the next pass (writing every name anew for a new TTL)
+		e.zoneUpdateMutex.Lock()
+		e.transposed = nil
+		if changed["ttl"] {
+			e.rewrite = true
+		}
+		e.zoneUpdateMutex.Unlock()
+		e.reconciler.request()
+	}
+	return nil
+}
+
+// rebind replaces the listeners bound for the previous configuration with those of the new. The new listeners are bound
+// (sharing the sockets of those the configurations have in common) before the previous are shut down, so that requests
+// to the addresses kept are served throughout, and failing to bind leaves the previous listeners serving.
+func (e *Engine) rebind(config *conf.Configuration) error {
+	previous := e.currentServer()
+	server, err := previous.Rebind(config)
+	if err != nil {
+		return fmt.Errorf("unable to bind listeners: %v", err)
+	}
+	e.serverMutex.Lock()
+	e.server = server
+	e.serverMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rebindTimeout)
+	defer cancel()
+	if err := previous.Shutdown(ctx); err != nil {
+		reloadLog.Warn("unable to shut down previous listeners", logging.Error, err)
+	}
+	return nil
+}
+
+// reloadPeers adds peers new to the configuration (in the configured priority order, ahead of discovered peers) and
+// removes those no longer configured, or configured with another server. A discovered peer for a newly configured
+// suffix is replaced by the configured one.
+func (e *Engine) reloadPeers(config *conf.Configuration) {
+	existing := map[string]*peerEntry{}
+	for _, peer := range e.currentPeers() {
+		if !peer.discovered {
+			existing[dns.CanonicalName(peer.Suffix)+"@"+peer.Server.String()] = peer
+		}
+	}
+	// transfer the zones of new peers before taking the lock
+	configured := map[string]bool{}
+	var peers []*peerEntry
+	for _, zonePeer := range config.Peers {
+		configured[dns.CanonicalName(zonePeer.Suffix)] = true
+		if peer := existing[dns.CanonicalName(zonePeer.Suffix)+"@"+zonePeer.Server.String()]; peer != nil {
+			peers = append(peers, peer)
+			continue
+		}
+		reloadLog.Info("adding peer", logging.Zone, zonePeer.Suffix, logging.Peer, zonePeer.Server.String())
+		peers = append(peers, newPeer(zonePeer, e.transferPeer(zonePeer), false))
+	}
+
+	e.peersMutex.Lock()
+	defer e.peersMutex.Unlock()
+	retained := map[*peerEntry]bool{}
+	for _, peer := range peers {
+		retained[peer] = true
+	}
+	for _, peer := range e.peers {
+		if peer.discovered && !configured[dns.CanonicalName(peer.Suffix)] {
+			// discovered peers may have changed meanwhile, so are carried over from the current list
+			peers = append(peers, peer)
+		} else if !retained[peer] {
+			reloadLog.Info("removing peer", logging.Zone, peer.Suffix, logging.Peer, peer.Server.String())
+		}
+	}
+	e.setPeers(peers)
+}
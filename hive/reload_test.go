@@ -0,0 +1,243 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/internal/dnstest"
+
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConfigChanges(t *testing.T) {
+	primary := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	_, localNet, _ := net.ParseCIDR("10.0.0.0/16")
+	old := &conf.Configuration{
+		LocalNets:    []*net.IPNet{localNet},
+		LocalZone:    &conf.ZonePeer{Suffix: "west.example.com.", Server: primary},
+		SearchSuffix: "rdvu.example.com.",
+		TTL:          300,
+		Peers: []*conf.ZonePeer{
+			{Suffix: "east.example.com.", Server: &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 53}},
+		},
+		WriteConcurrency: 8,
+	}
+	tests := []struct {
+		setting string
+		live    bool
+		change  func(config *conf.Configuration)
+	}{
+		{"localNets", true, func(config *conf.Configuration) {
+			_, otherNet, _ := net.ParseCIDR("10.9.0.0/16")
+			config.LocalNets = append(config.LocalNets, otherNet)
+		}},
+		{"peers", true, func(config *conf.Configuration) {
+			config.Peers = []*conf.ZonePeer{
+				{Suffix: "east.example.com.", Server: &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5353}},
+			}
+		}},
+		{"ttl", true, func(config *conf.Configuration) {
+			config.TTL = 60
+		}},
+		{"writeConcurrency", false, func(config *conf.Configuration) {
+			config.WriteConcurrency = 2
+		}},
+		{"probeInterval", false, func(config *conf.Configuration) {
+			config.ProbeInterval = time.Minute
+		}},
+		{"catalog", false, func(config *conf.Configuration) {
+			config.Catalog = &conf.Catalog{Zone: "catalog.example.com.", Server: primary, Interval: time.Hour}
+		}},
+		{"logging", true, func(config *conf.Configuration) {
+			config.Logging = &conf.Logging{Level: "debug"}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.setting, func(t *testing.T) {
+			config := *old
+			test.change(&config)
+			changes := configChanges(old, &config)
+			if len(changes) != 1 || changes[0].setting != test.setting || changes[0].live != test.live {
+				t.Errorf("expected only %s to change (live %v), got %v", test.setting, test.live, changes)
+			}
+		})
+	}
+
+	// peers compare by suffix regardless of case, and by server
+	config := *old
+	config.Peers = []*conf.ZonePeer{{Suffix: "EAST.example.com.", Server: old.Peers[0].Server}}
+	if changes := configChanges(old, &config); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	// the local zone holds a record, so that transferring it (to check the listeners) succeeds
+	primary := newPrimary(t, "foo.west.example.com. A 10.0.0.100")
+	config := dnstest.Config(t, primary)
+	e := startEngine(t, config)
+	listen := config.ListenAddresses[0]
+
+	localZone := *config
+	localZone.LocalZone = &conf.ZonePeer{Suffix: "south.example.com.", Server: primary.Addr}
+	searchSuffix := *config
+	searchSuffix.SearchSuffix = "elsewhere.example.com."
+	// the address is taken by a listener of another process
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer taken.Close()
+	unbindable := *config
+	unbindable.ListenAddresses = []net.Addr{taken.LocalAddr()}
+	unbindable.TTL = 60
+
+	server := e.currentServer()
+	for name, rejected := range map[string]*conf.Configuration{
+		"local zone":    &localZone,
+		"search suffix": &searchSuffix,
+		"unbindable":    &unbindable,
+	} {
+		if err := e.Reload(rejected); err == nil {
+			t.Errorf("configuration with another %s was accepted", name)
+		}
+		if e.currentConfig() != config {
+			t.Fatalf("configuration with another %s replaced the previous configuration", name)
+		}
+	}
+	// the previous listeners remain
+	if e.currentServer() != server || !server.Serving() {
+		t.Errorf("previous listeners replaced or stopped")
+	}
+	if err := checkTransfer(listen, "west.example.com."); err != nil {
+		t.Errorf("previous listener no longer answers: %v", err)
+	}
+}
+
+func TestReloadListenersContinuous(t *testing.T) {
+	primary := newPrimary(t, "foo.west.example.com. A 10.0.0.100")
+	config := dnstest.Config(t, primary)
+	e := startEngine(t, config)
+	kept := config.ListenAddresses[0]
+	added := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: dnstest.FreePort(t, "127.0.0.1")}
+
+	// connect to the address kept throughout the reloads, which must never be refused (connections already accepted
+	// may still be closed by the listeners shut down)
+	stop := make(chan struct{})
+	failures := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			conn, err := net.Dial("tcp", kept.String())
+			if err == nil {
+				conn.Close()
+			} else if errors.Is(err, syscall.ECONNREFUSED) {
+				select {
+				case failures <- err:
+				default:
+				}
+			}
+		}
+	}()
+
+	// an address added is bound alongside those kept, and one removed is no longer served
+	widened := *config
+	widened.ListenAddresses = []net.Addr{kept, added}
+	if err := e.Reload(&widened); err != nil {
+		t.Fatalf("unable to reload: %v", err)
+	}
+	for _, addr := range widened.ListenAddresses {
+		if err := checkTransfer(addr, "west.example.com."); err != nil {
+			t.Errorf("listener %v does not answer: %v", addr, err)
+		}
+	}
+	narrowed := widened
+	narrowed.ListenAddresses = []net.Addr{kept}
+	narrowed.ListenNetworks = []string{"tcp"}
+	if err := e.Reload(&narrowed); err != nil {
+		t.Fatalf("unable to reload: %v", err)
+	}
+	if err := checkTransfer(added, "west.example.com."); err == nil {
+		t.Errorf("removed listener still answers")
+	}
+	if err := checkTransfer(kept, "west.example.com."); err != nil {
+		t.Errorf("kept listener does not answer: %v", err)
+	}
+	close(stop)
+	<-done
+	select {
+	case err := <-failures:
+		t.Errorf("kept listener refused connections while reloading: %v", err)
+	default:
+	}
+	if !e.Health().Serving {
+		t.Errorf("not serving after reloads")
+	}
+}
+
+func TestReload(t *testing.T) {
+	primary := newPrimary(t, "foo.west.example.com. A 192.168.0.100")
+	east := newPeerServer(t, "127.0.0.2", "east.example.com.", "foo.east.example.com. A 10.1.0.100")
+	config := dnstest.Config(t, primary)
+	e := startEngine(t, config)
+
+	// a new peer is transferred and merged; restart-only settings keep their previous values
+	reloaded := dnstest.Config(t, primary, east)
+	reloaded.ListenAddresses = config.ListenAddresses
+	reloaded.WriteConcurrency = 2
+	if err := e.Reload(reloaded); err != nil {
+		t.Fatalf("unable to reload: %v", err)
+	}
+	waitFor(t, "peer to be merged", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == "foo.east.example.com."
+	})
+	if concurrency := e.currentConfig().WriteConcurrency; concurrency != 8 {
+		t.Errorf("write concurrency changed to %d before restart", concurrency)
+	}
+
+	// a new TTL rewrites every name; new listen addresses are bound in place of the old
+	retimed := *reloaded
+	retimed.TTL = 60
+	retimed.ListenAddresses = []net.Addr{
+		&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: dnstest.FreePort(t, "127.0.0.1")},
+	}
+	updates := len(primary.Updates())
+	if err := e.Reload(&retimed); err != nil {
+		t.Fatalf("unable to reload: %v", err)
+	}
+	waitFor(t, "names to be rewritten", func() bool {
+		for _, update := range primary.Updates()[updates:] {
+			for _, rr := range update.Ns {
+				if rr.Header().Class == dns.ClassINET && rr.Header().Ttl == 60 {
+					return true
+				}
+			}
+		}
+		return false
+	})
+	if err := checkTransfer(retimed.ListenAddresses[0], "east.example.com."); err != nil {
+		t.Errorf("new listener does not answer: %v", err)
+	}
+	if err := checkTransfer(config.ListenAddresses[0], "east.example.com."); err == nil {
+		t.Errorf("previous listener still answers")
+	}
+
+	// a peer removed is withdrawn
+	removed := retimed
+	removed.Peers = nil
+	if err := e.Reload(&removed); err != nil {
+		t.Fatalf("unable to reload: %v", err)
+	}
+	waitFor(t, "peer to be withdrawn", func() bool {
+		return rendezvousTarget(primary, "foo.rdvu.example.com.") == ""
+	})
+}
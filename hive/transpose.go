@@ -0,0 +1,64 @@
+package hive
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/xform"
+
+	"net"
+	"strings"
+)
+
+func tranposePrimary(zone *xform.Zone, config *conf.Configuration) *xform.Zone {
+	if zone == nil || config == nil {
+		return nil
+	}
+	// tranpose A/AAAA records into CNAME records to the rendezvous suffix
+	zone.RLock()
+	tranposed := &xform.Zone{
+		Server:       zone.Server,
+		ARecords:     map[string]net.IP{},
+		CNAMERecords: map[string]string{},
+	}
+
+	for name, target := range zone.ARecords {
+		tranposedName := ""
+		if !dns.IsSubDomain(config.LocalZone.Suffix, name) {
+			continue
+		} else {
+			tranposedName = strings.TrimSuffix(name, config.LocalZone.Suffix) + config.SearchSuffix
+			tranposedName = strings.ToLower(tranposedName)
+		}
+		for _, localNet := range config.LocalNets {
+			if localNet.Contains(target) {
+				tranposed.CNAMERecords[tranposedName] = strings.ToLower(name)
+				break
+			}
+		}
+	}
+	zone.RUnlock()
+	return tranposed
+}
+
+func tranposePeer(zone *xform.Zone, peerSuffix, rendezvousSuffix string) *xform.Zone {
+	// tranpose A/AAAA records into CNAME records to the rendezvous suffix
+	zone.RLock()
+	tranposed := &xform.Zone{
+		Server:       zone.Server,
+		ARecords:     map[string]net.IP{},
+		CNAMERecords: map[string]string{},
+	}
+
+	for name := range zone.ARecords {
+		tranposedName := ""
+		if !dns.IsSubDomain(peerSuffix, name) {
+			continue
+		} else {
+			tranposedName = strings.TrimSuffix(name, peerSuffix) + rendezvousSuffix
+			tranposedName = strings.ToLower(tranposedName)
+		}
+		tranposed.CNAMERecords[tranposedName] = strings.ToLower(name)
+	}
+	zone.RUnlock()
+	return tranposed
+}
@@ -0,0 +1,74 @@
+// Package dnstest provides a fake authoritative DNS server and other helpers for testing Hive against, in the manner of
+// net/http/httptest.
+package dnstest
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Key is a TSIG key for tests.
+var Key = &conf.TsigKey{
+	Algorithm: dns.HmacSHA256,
+	Key:       "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0",
+	ZoneName:  "hive.",
+}
+
+// FreePort finds a port that is free on a host for both UDP and TCP, skipping the test if the host's address cannot be
+// bound.
+func FreePort(t testing.TB, host string) int {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			t.Skipf("unable to listen on %s: %v", host, err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		listener.Close()
+		if err == nil {
+			conn.Close()
+			return port
+		}
+	}
+	t.Fatalf("unable to find a free port on %s", host)
+	return 0
+}
+
+// PeerSuffixes name the sites of the peers given to Config, in order.
+var PeerSuffixes = []string{"east.example.com.", "north.example.com."}
+
+// Config configures the west site of a test (the zone west.example.com. with the rendezvous zone rdvu.example.com.),
+// with a primary and peers (named by PeerSuffixes), listening on a free port of 127.0.0.1, and reconciling quickly.
+func Config(t testing.TB, primary *Server, peers ...*Server) *conf.Configuration {
+	t.Helper()
+	_, localNet, _ := net.ParseCIDR("10.0.0.0/16")
+	listen := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: FreePort(t, "127.0.0.1")}
+	config := &conf.Configuration{
+		LocalNets: []*net.IPNet{localNet},
+		LocalZone: &conf.ZonePeer{
+			Suffix: "west.example.com.",
+			Server: primary.Addr,
+		},
+		SearchSuffix:      "rdvu.example.com.",
+		TTL:               300,
+		ListenAddresses:   []net.Addr{listen},
+		ListenNetworks:    []string{"udp", "tcp"},
+		ReconcileDelay:    10 * time.Millisecond,
+		ReconcileMaxDelay: 100 * time.Millisecond,
+		WriteConcurrency:  8,
+		WriteTimeout:      time.Second,
+	}
+	for idx, peer := range peers {
+		config.Peers = append(config.Peers, &conf.ZonePeer{
+			Suffix: PeerSuffixes[idx],
+			Server: peer.Addr,
+		})
+	}
+	return config
+}
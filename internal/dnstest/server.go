@@ -0,0 +1,400 @@
+package dnstest
+
+import (
+	"github.com/miekg/dns"
+
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is a fake authoritative DNS server (e.g. a site's primary) listening on UDP and TCP at one address. It serves
+// zone transfers and queries of its zones, and applies RFC2136 updates to them, evaluating their prerequisites. Every
+// request must be signed with Key, and every reply is signed with it.
+type Server struct {
+	Addr *net.UDPAddr
+
+	t       testing.TB
+	mutex   sync.Mutex
+	zones   map[string]*zone
+	updates []*dns.Msg
+	rcode   int // if not NOERROR, the rcode every update is refused with
+	servers []*dns.Server
+}
+
+type zone struct {
+	serial  uint32
+	records []dns.RR
+}
+
+// NewServer starts a server on a free port of a host (e.g. 127.0.0.1), skipping the test if the host's address cannot
+// be bound (e.g. 127.0.0.2 on platforms without the whole loopback network). It is stopped when the test completes.
+func NewServer(t testing.TB, host string) *Server {
+	t.Helper()
+	s := &Server{
+		Addr:  &net.UDPAddr{IP: net.ParseIP(host), Port: FreePort(t, host)},
+		t:     t,
+		zones: map[string]*zone{},
+	}
+	s.start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) start() {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", s.handle)
+	for _, network := range []string{"tcp", "udp"} {
+		started := make(chan struct{})
+		server := &dns.Server{
+			Addr:              s.Addr.String(),
+			Net:               network,
+			Handler:           mux,
+			TsigSecret:        map[string]string{Key.ZoneName: Key.Key},
+			NotifyStartedFunc: func() { close(started) },
+			MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction {
+				return dns.MsgAccept
+			},
+		}
+		served := make(chan error, 1)
+		go func() {
+			served <- server.ListenAndServe()
+		}()
+		select {
+		case <-started:
+		case err := <-served:
+			s.t.Fatalf("unable to serve %s on %v: %v", network, s.Addr, err)
+		}
+		s.servers = append(s.servers, server)
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	for _, server := range s.servers {
+		server.Shutdown()
+	}
+	s.servers = nil
+}
+
+// Restart stops the server, closing any connections to it, then starts it again on the same address.
+func (s *Server) Restart() {
+	s.Close()
+	s.start()
+}
+
+// AddZone adds (or replaces) a zone holding records in zone file format, e.g. "foo.west.example.com. A 10.0.0.100".
+func (s *Server) AddZone(name string, records ...string) {
+	s.t.Helper()
+	added := &zone{serial: 1}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			s.t.Fatalf("invalid record '%s': %v", record, err)
+		}
+		added.records = append(added.records, rr)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.zones[dns.CanonicalName(name)] = added
+}
+
+// Records lists the records of a zone in zone file format, with single spaces between fields and TTLs of zero.
+func (s *Server) Records(name string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var records []string
+	if z := s.zones[dns.CanonicalName(name)]; z != nil {
+		for _, rr := range z.records {
+			records = append(records, Format(rr))
+		}
+	}
+	return records
+}
+
+// Lookup lists the records of a name in a zone, of a type (or of every type, for dns.TypeANY), in the format of Records.
+func (s *Server) Lookup(zoneName, name string, rrtype uint16) []string {
+	var records []string
+	for _, rr := range s.lookup(zoneName, name, rrtype) {
+		records = append(records, Format(rr))
+	}
+	return records
+}
+
+func (s *Server) lookup(zoneName, name string, rrtype uint16) []dns.RR {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var records []dns.RR
+	if z := s.zones[dns.CanonicalName(zoneName)]; z != nil {
+		for _, rr := range z.records {
+			if matches(rr, name, rrtype) {
+				records = append(records, rr)
+			}
+		}
+	}
+	return records
+}
+
+// Updates lists the updates the server has received (whether or not they were applied), in the order received.
+func (s *Server) Updates() []*dns.Msg {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*dns.Msg{}, s.updates...)
+}
+
+// RefuseUpdates makes the server reject every subsequent update with an rcode, or apply them again for NOERROR.
+func (s *Server) RefuseUpdates(rcode int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rcode = rcode
+}
+
+// Format renders a record as Records does.
+func Format(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	return strings.Join(strings.Fields(rr.String()), " ")
+}
+
+// matches determines whether a record is of a name, and of a type (or any type, for dns.TypeANY).
+func matches(rr dns.RR, name string, rrtype uint16) bool {
+	return strings.EqualFold(rr.Header().Name, name) && (rrtype == dns.TypeANY || rr.Header().Rrtype == rrtype)
+}
+
+// rdata renders the data of a record (without its header) for comparison.
+func rdata(rr dns.RR) string {
+	return strings.ToLower(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+func (s *Server) handle(w dns.ResponseWriter, request *dns.Msg) {
+	msg := &dns.Msg{}
+	if request.IsTsig() == nil || w.TsigStatus() != nil {
+		msg.SetRcode(request, dns.RcodeRefused)
+		w.WriteMsg(msg)
+		return
+	}
+	msg.SetReply(request)
+	if len(request.Question) != 1 {
+		msg.Rcode = dns.RcodeFormatError
+		s.reply(w, msg)
+		return
+	}
+	question := request.Question[0]
+	switch {
+	case request.Opcode == dns.OpcodeUpdate:
+		msg.Rcode = s.update(request)
+	case request.Opcode == dns.OpcodeNotify:
+		msg.Authoritative = true
+	case request.Opcode != dns.OpcodeQuery:
+		msg.Rcode = dns.RcodeNotImplemented
+	case question.Qtype == dns.TypeAXFR:
+		s.transfer(w, request)
+		return
+	default:
+		s.query(msg, question)
+	}
+	s.reply(w, msg)
+}
+
+func (s *Server) reply(w dns.ResponseWriter, msg *dns.Msg) {
+	msg.SetTsig(Key.ZoneName, Key.Algorithm, 300, time.Now().Unix())
+	w.WriteMsg(msg)
+}
+
+// soa synthesizes the SOA record of a zone. The caller must hold the mutex.
+func (s *Server) soa(name string) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+		Ns:      "ns." + name,
+		Mbox:    "hostmaster." + name,
+		Serial:  s.zones[name].serial,
+		Refresh: 300,
+		Retry:   30,
+		Expire:  600,
+		Minttl:  600,
+	}
+}
+
+func (s *Server) transfer(w dns.ResponseWriter, request *dns.Msg) {
+	name := dns.CanonicalName(request.Question[0].Name)
+	s.mutex.Lock()
+	z := s.zones[name]
+	if z == nil {
+		s.mutex.Unlock()
+		msg := &dns.Msg{}
+		msg.SetRcode(request, dns.RcodeNotAuth)
+		s.reply(w, msg)
+		return
+	}
+	soa := s.soa(name)
+	records := append(append([]dns.RR{soa}, z.records...), soa)
+	s.mutex.Unlock()
+
+	envelopes := make(chan *dns.Envelope, 1)
+	envelopes <- &dns.Envelope{RR: records}
+	close(envelopes)
+	tr := &dns.Transfer{TsigSecret: map[string]string{Key.ZoneName: Key.Key}}
+	tr.Out(w, request, envelopes)
+}
+
+// enclosing finds the zone containing a name, or an empty string. The caller must hold the mutex.
+func (s *Server) enclosing(name string) string {
+	enclosing := ""
+	for zoneName := range s.zones {
+		if dns.IsSubDomain(zoneName, name) && dns.CountLabel(zoneName) > dns.CountLabel(enclosing) {
+			enclosing = zoneName
+		}
+	}
+	return enclosing
+}
+
+func (s *Server) query(msg *dns.Msg, question dns.Question) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	zoneName := s.enclosing(question.Name)
+	if zoneName == "" {
+		msg.Rcode = dns.RcodeRefused
+		return
+	}
+	msg.Authoritative = true
+	if question.Qtype == dns.TypeSOA && strings.EqualFold(question.Name, zoneName) {
+		msg.Answer = append(msg.Answer, s.soa(zoneName))
+		return
+	}
+	exists := false
+	for _, rr := range s.zones[zoneName].records {
+		if matches(rr, question.Name, dns.TypeANY) {
+			exists = true
+			if matches(rr, question.Name, question.Qtype) {
+				msg.Answer = append(msg.Answer, rr)
+			}
+		}
+	}
+	if !exists && !strings.EqualFold(question.Name, zoneName) {
+		msg.Rcode = dns.RcodeNameError
+	}
+	if len(msg.Answer) == 0 {
+		msg.Ns = append(msg.Ns, s.soa(zoneName))
+	}
+}
+
+// update applies an RFC2136 update if its prerequisites are satisfied, returning the rcode to reply with.
+func (s *Server) update(request *dns.Msg) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.updates = append(s.updates, request.Copy())
+	if s.rcode != dns.RcodeSuccess {
+		return s.rcode
+	}
+	z := s.zones[dns.CanonicalName(request.Question[0].Name)]
+	if z == nil {
+		return dns.RcodeNotAuth
+	}
+	if rcode := z.check(request.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, rr := range request.Ns {
+		z.apply(rr)
+	}
+	z.serial++
+	return dns.RcodeSuccess
+}
+
+// check evaluates the prerequisites of an update against the zone.
+func (z *zone) check(prerequisites []dns.RR) int {
+	present := func(name string, rrtype uint16) bool {
+		for _, rr := range z.records {
+			if matches(rr, name, rrtype) {
+				return true
+			}
+		}
+		return false
+	}
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	expected := map[rrsetKey]map[string]bool{}
+	for _, rr := range prerequisites {
+		hdr := rr.Header()
+		switch hdr.Class {
+		case dns.ClassANY:
+			if !present(hdr.Name, hdr.Rrtype) {
+				if hdr.Rrtype == dns.TypeANY {
+					return dns.RcodeNameError
+				}
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if present(hdr.Name, hdr.Rrtype) {
+				if hdr.Rrtype == dns.TypeANY {
+					return dns.RcodeYXDomain
+				}
+				return dns.RcodeYXRrset
+			}
+		default:
+			key := rrsetKey{strings.ToLower(hdr.Name), hdr.Rrtype}
+			if expected[key] == nil {
+				expected[key] = map[string]bool{}
+			}
+			expected[key][rdata(rr)] = true
+		}
+	}
+	for key, values := range expected {
+		actual := map[string]bool{}
+		for _, rr := range z.records {
+			if matches(rr, key.name, key.rrtype) {
+				actual[rdata(rr)] = true
+			}
+		}
+		if len(actual) != len(values) {
+			return dns.RcodeNXRrset
+		}
+		for value := range values {
+			if !actual[value] {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// apply applies one record of the update section of an update to the zone.
+func (z *zone) apply(update dns.RR) {
+	hdr := update.Header()
+	var kept []dns.RR
+	switch hdr.Class {
+	case dns.ClassANY:
+		// delete an RRset, or all RRsets of a name
+		for _, rr := range z.records {
+			if !matches(rr, hdr.Name, hdr.Rrtype) {
+				kept = append(kept, rr)
+			}
+		}
+	case dns.ClassNONE:
+		// delete an RR from an RRset
+		for _, rr := range z.records {
+			if !matches(rr, hdr.Name, hdr.Rrtype) || rdata(rr) != rdata(update) {
+				kept = append(kept, rr)
+			}
+		}
+	default:
+		// add to an RRset, replacing a CNAME (of which a name holds at most one)
+		added := dns.Copy(update)
+		for _, rr := range z.records {
+			if matches(rr, hdr.Name, hdr.Rrtype) && (hdr.Rrtype == dns.TypeCNAME || rdata(rr) == rdata(update)) {
+				continue
+			}
+			kept = append(kept, rr)
+		}
+		kept = append(kept, added)
+	}
+	z.records = kept
+}
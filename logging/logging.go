@@ -0,0 +1,164 @@
+package logging
+
+import (
+	"github.com/thyth/hive/conf"
+
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// The names of the fields common to log records, so that e.g. every record about a zone can be found by its zone.
+const (
+	Subsystem = "subsystem"
+	Zone      = "zone"
+	Name      = "name"
+	Target    = "target"
+	Address   = "address"
+	Proposer  = "proposer"
+	Server    = "server"
+	Peer      = "peer"
+	Rcode     = "rcode"
+	Error     = "error"
+)
+
+// state is the logging configuration in effect: where records are written, and the levels they must reach.
+type state struct {
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level // by subsystem, overriding the level
+	closer  io.Closer             // of the connection to syslog, if any
+}
+
+// current is replaced (never modified) as logging is configured, so that loggers obtained beforehand (e.g. by package
+// variables) follow the configuration.
+var current atomic.Pointer[state]
+
+func init() {
+	current.Store(&state{
+		handler: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level:   slog.LevelInfo,
+	})
+}
+
+// Configure directs the records of every logger to the output, format and levels configured; a nil configuration
+// restores the default (logfmt to standard output, at the info level). It may be called again to reconfigure logging,
+// e.g. on reload.
+func Configure(config *conf.Logging) error {
+	next := &state{
+		level: slog.LevelInfo,
+	}
+	if config == nil {
+		config = &conf.Logging{}
+	}
+	var err error
+	if config.Level != "" {
+		if next.level, err = ParseLevel(config.Level); err != nil {
+			return err
+		}
+	}
+	if len(config.Levels) > 0 {
+		next.levels = map[string]slog.Level{}
+		for subsystem, level := range config.Levels {
+			if next.levels[subsystem], err = ParseLevel(level); err != nil {
+				return fmt.Errorf("subsystem '%s': %v", subsystem, err)
+			}
+		}
+	}
+
+	if config.Syslog != nil {
+		if next.handler, next.closer, err = newSyslogHandler(config.Syslog, config.Format); err != nil {
+			return err
+		}
+	} else if next.handler, err = newHandler(os.Stdout, config.Format, nil); err != nil {
+		return err
+	}
+	if previous := current.Swap(next); previous.closer != nil {
+		previous.closer.Close()
+	}
+	return nil
+}
+
+// newHandler creates a handler writing records as logfmt or JSON lines. Levels are checked per subsystem before
+// records reach it, so it accepts every level.
+func newHandler(w io.Writer, format string, replace func([]string, slog.Attr) slog.Attr) (slog.Handler, error) {
+	options := &slog.HandlerOptions{
+		Level:       slog.LevelDebug,
+		ReplaceAttr: replace,
+	}
+	switch strings.ToLower(format) {
+	case "", "logfmt", "text":
+		return slog.NewTextHandler(w, options), nil
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	}
+	return nil, fmt.Errorf("log format '%s' unknown (expected logfmt or json)", format)
+}
+
+// ParseLevel parses a level by name: debug, info, warn (or warning), or error.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("log level '%s' unknown (expected debug, info, warn or error)", name)
+}
+
+// For provides the logger of a subsystem, whose records carry its name and are filtered by its level.
+func For(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{
+		subsystem: subsystem,
+	})
+}
+
+// subsystemHandler filters the records of a subsystem by its level, then passes them to the handler in effect.
+type subsystemHandler struct {
+	subsystem string
+	// derivations (by WithAttrs or WithGroup) applied to the handler in effect for each record, in order
+	derive []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	s := current.Load()
+	if subsystemLevel, present := s.levels[h.subsystem]; present {
+		return level >= subsystemLevel
+	}
+	return level >= s.level
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := current.Load().handler.WithAttrs([]slog.Attr{slog.String(Subsystem, h.subsystem)})
+	for _, derive := range h.derive {
+		handler = derive(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *subsystemHandler) with(derive func(slog.Handler) slog.Handler) slog.Handler {
+	return &subsystemHandler{
+		subsystem: h.subsystem,
+		derive:    append(append([]func(slog.Handler) slog.Handler{}, h.derive...), derive),
+	}
+}
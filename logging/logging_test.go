@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"github.com/thyth/hive/conf"
+
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		level slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{"INFO", slog.LevelInfo},
+		{"warn", slog.LevelWarn},
+		{"Warning", slog.LevelWarn},
+		{"error", slog.LevelError},
+	}
+	for _, test := range tests {
+		if level, err := ParseLevel(test.name); err != nil || level != test.level {
+			t.Errorf("%s: expected %v, got %v (%v)", test.name, test.level, level, err)
+		}
+	}
+	for _, name := range []string{"", "trace", "fatal"} {
+		if _, err := ParseLevel(name); err == nil {
+			t.Errorf("unknown level '%s' was parsed", name)
+		}
+	}
+}
+
+func TestConfigureLevels(t *testing.T) {
+	defer Configure(nil)
+	if err := Configure(&conf.Logging{
+		Level:  "warn",
+		Levels: map[string]string{"engine": "debug", "server": "error"},
+	}); err != nil {
+		t.Fatalf("unable to configure logging: %v", err)
+	}
+	tests := []struct {
+		subsystem string
+		level     slog.Level
+		enabled   bool
+	}{
+		{"engine", slog.LevelDebug, true},
+		{"server", slog.LevelWarn, false},
+		{"server", slog.LevelError, true},
+		{"catalog", slog.LevelInfo, false},
+		{"catalog", slog.LevelWarn, true},
+	}
+	for _, test := range tests {
+		if enabled := For(test.subsystem).Enabled(context.Background(), test.level); enabled != test.enabled {
+			t.Errorf("%s at %v: expected enabled %v", test.subsystem, test.level, test.enabled)
+		}
+	}
+
+	// an invalid configuration is rejected, leaving the previous in effect
+	for _, invalid := range []*conf.Logging{
+		{Level: "verbose"},
+		{Levels: map[string]string{"engine": "verbose"}},
+		{Format: "xml"},
+	} {
+		if err := Configure(invalid); err == nil {
+			t.Errorf("invalid configuration %+v accepted", invalid)
+		}
+	}
+	if For("engine").Enabled(context.Background(), slog.LevelInfo) != true ||
+		For("catalog").Enabled(context.Background(), slog.LevelInfo) != false {
+		t.Errorf("rejected configuration changed the levels in effect")
+	}
+}
+
+func TestSubsystemRecords(t *testing.T) {
+	previous := current.Load()
+	defer current.Store(previous)
+	var written bytes.Buffer
+	handler, err := newHandler(&written, "json", nil)
+	if err != nil {
+		t.Fatalf("unable to create handler: %v", err)
+	}
+	// a logger obtained before logging is configured follows the configuration
+	logger := For("engine").With(Zone, "west.example.com.")
+	current.Store(&state{handler: handler, level: slog.LevelInfo})
+	logger.Info("zone transferred", Error, "none")
+	logger.Debug("filtered")
+
+	lines := strings.Split(strings.TrimSpace(written.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one record, got %q", lines)
+	}
+	for _, field := range []string{`"subsystem":"engine"`, `"zone":"west.example.com."`, `"msg":"zone transferred"`,
+		`"error":"none"`} {
+		if !strings.Contains(lines[0], field) {
+			t.Errorf("record %s lacks %s", lines[0], field)
+		}
+	}
+}
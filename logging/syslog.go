@@ -0,0 +1,107 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"github.com/thyth/hive/conf"
+
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"sync"
+)
+
+// syslogTag identifies the records of Hive to syslog, unless configured otherwise.
+const syslogTag = "hive"
+
+// syslogHandler formats records as logfmt or JSON, and sends each to syslog at the priority of its level. Syslog
+// timestamps records itself, so they are formatted without a time.
+type syslogHandler struct {
+	mutex  *sync.Mutex // serializes the level of a record with its formatted output
+	writer *levelWriter
+	inner  slog.Handler
+}
+
+// levelWriter sends each formatted record to syslog at the priority of the record's level.
+type levelWriter struct {
+	syslog *syslog.Writer
+	level  slog.Level
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	message := string(p)
+	var err error
+	switch {
+	case w.level >= slog.LevelError:
+		err = w.syslog.Err(message)
+	case w.level >= slog.LevelWarn:
+		err = w.syslog.Warning(message)
+	case w.level >= slog.LevelInfo:
+		err = w.syslog.Info(message)
+	default:
+		err = w.syslog.Debug(message)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func newSyslogHandler(config *conf.Syslog, format string) (slog.Handler, io.Closer, error) {
+	tag := config.Tag
+	if tag == "" {
+		tag = syslogTag
+	}
+	// the network and address are both empty for the local syslog daemon
+	writer, err := syslog.Dial(config.Network, config.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	levels := &levelWriter{
+		syslog: writer,
+	}
+	inner, err := newHandler(levels, format, func(groups []string, attr slog.Attr) slog.Attr {
+		if len(groups) == 0 && attr.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return attr
+	})
+	if err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+	return &syslogHandler{
+		mutex:  &sync.Mutex{},
+		writer: levels,
+		inner:  inner,
+	}, writer, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writer.level = record.Level
+	return h.inner.Handle(ctx, record)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{
+		mutex:  h.mutex,
+		writer: h.writer,
+		inner:  h.inner.WithAttrs(attrs),
+	}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{
+		mutex:  h.mutex,
+		writer: h.writer,
+		inner:  h.inner.WithGroup(name),
+	}
+}
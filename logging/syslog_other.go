@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"github.com/thyth/hive/conf"
+
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+func newSyslogHandler(config *conf.Syslog, format string) (slog.Handler, io.Closer, error) {
+	return nil, nil, fmt.Errorf("syslog is not supported on this platform")
+}
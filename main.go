@@ -1,26 +1,44 @@
 package main
 
 import (
-	"github.com/miekg/dns"
-
+	"github.com/thyth/hive/admin"
+	"github.com/thyth/hive/audit"
 	"github.com/thyth/hive/conf"
-	"github.com/thyth/hive/xform"
+	"github.com/thyth/hive/health"
+	"github.com/thyth/hive/hive"
+	"github.com/thyth/hive/logging"
+	"github.com/thyth/hive/metrics"
 
+	"context"
 	"flag"
 	"fmt"
-	"net"
 	"os"
-	"strings"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
+var mainLog = logging.For("main")
+
+// shutdownTimeout bounds how long requests in flight are given to complete on shutdown.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		os.Exit(plan(os.Args[2:]))
+	}
+
 	configFile := ""
 	dnsKeyFile := ""
+	dryRun := false
 
-	flag.StringVar(&configFile, "config", "", "Path to a JSON configuration file")
+	flag.StringVar(&configFile, "config", "", "Path to a JSON, YAML (.yaml/.yml) or TOML (.toml) configuration file")
 	flag.StringVar(&dnsKeyFile, "key", "", "Path to a DNS key file")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the updates that would be written to the primary, without writing them")
+	flag.Usage = usage
 
 	flag.Parse()
 	if configFile == "" || dnsKeyFile == "" {
@@ -30,301 +48,153 @@ func main() {
 
 	config, err := conf.ParseFile(configFile)
 	if err != nil {
-		fmt.Printf("Error processing config file: %v\n", err)
+		mainLog.Error("unable to process config file", "file", configFile, logging.Error, err)
+		os.Exit(1)
+	}
+	if err := logging.Configure(config.Logging); err != nil {
+		mainLog.Error("unable to configure logging", logging.Error, err)
+		os.Exit(1)
+	}
+	if err := audit.Configure(config.Audit); err != nil {
+		mainLog.Error("unable to configure audit log", logging.Error, err)
 		os.Exit(1)
 	}
 
 	key, err := conf.ParseKeyfile(dnsKeyFile)
 	if err != nil {
-		fmt.Printf("Error processing key file: %v\n", err)
+		mainLog.Error("unable to process key file", "file", dnsKeyFile, logging.Error, err)
 		os.Exit(1)
 	}
 
-	var primaryZone *xform.Zone
-	var rendezvousZone *xform.Zone
-	peerZones := make([]*xform.Zone, len(config.Peers))
-	// the defaultZone is populated by update requests not associated with configured peers, whose values are merged
-	// into the rendezvous zone at lowest priority (i.e. any peer configured value will take precedence).
-	defaultZone := &xform.Zone{
-		ARecords:     map[string]net.IP{},
-		CNAMERecords: map[string]string{},
+	warnConfig(config, key)
+
+	notifier, err := health.NewNotifier()
+	if err != nil {
+		mainLog.Error("unable to notify systemd", logging.Error, err)
+		os.Exit(1)
 	}
-	zoneByServer := map[string]*xform.Zone{}
-	zoneByName := map[string]*xform.Zone{}
 
-	updateByZoneMutex := &sync.Mutex{}
-	updateByZone := map[*xform.Zone]uint32{}
+	engine := hive.NewEngine(config, key)
+	if dryRun {
+		mainLog.Warn("dry run; no updates will be written to the primary")
+		engine.SetDryRun(true)
+	}
+	if err := engine.Start(); err != nil {
+		mainLog.Error("unable to start", logging.Error, err)
+		os.Exit(1)
+	}
 
-	zoneUpdateMutex := &sync.Mutex{}
-	localZoneUpdate := func() {
-		zoneUpdateMutex.Lock()
-		defer zoneUpdateMutex.Unlock()
-		// A) merge zones starting with the primary zone, through the peers in priority order, followed by the default
-		//    zone to determine the new rendezvous zone state
-		merged := tranposePrimary(primaryZone, config)
-		for idx, peer := range peerZones {
-			tranposed := tranposePeer(peer, config.Peers[idx].Suffix, config.SearchSuffix)
-			merged = xform.MergeZones(merged, tranposed)
+	var adminServer *admin.Server
+	if config.Admin != nil {
+		if adminServer, err = admin.Start(config.Admin, engine); err != nil {
+			mainLog.Error("unable to start admin API", logging.Error, err)
+			abort(engine)
 		}
-		merged = xform.MergeZones(merged, defaultZone)
-		// B) diff the new rendezvous zone with the existing one, and update the primary zone
-		diff := xform.DiffZones(rendezvousZone, merged)
-		if len(diff.CNAMERecords) > 0 {
-			// there is at least one record different... update CNAMEs in the rendezvous record
-			updateByZoneMutex.Lock()
-			updateByZone[defaultZone]++
-			updateByZoneMutex.Unlock()
-
-			// write updates
-			for name, target := range diff.CNAMERecords {
-				fmt.Printf("Writing rendezvous update '%s' -> '%s'\n", name, target)
-				if err := xform.WriteUpdate(config.LocalZone.Server, config.TTL, key, &xform.Mapping{
-					Name:   name,
-					Target: target,
-				}, config.SearchSuffix); err != nil {
-					fmt.Printf("Error writing update to rendezvous zone: %v\n", err)
-					return
-				}
-			}
-
-			// track the newly created record as the state of the rendezvous zone
-			rendezvousZone = merged
+	}
+	var metricsServer *metrics.Server
+	if config.Metrics != nil {
+		engine.RegisterMetrics(metrics.Default)
+		if metricsServer, err = metrics.Start(config.Metrics.Listen, metrics.Default); err != nil {
+			mainLog.Error("unable to start metrics", logging.Error, err)
+			abort(engine)
 		}
 	}
-
-	// Operational sequence:
-	// 1) Zone transfer from the local primary DNS server to populate transient cache (no persistent caching in Hive)
-	primaryZone, err = xform.ReadZoneEntries(config.LocalZone.Server, key, config.LocalZone.Suffix)
-	if err != nil {
-		fmt.Printf("Zone transfer from primary failed: %v\n", err)
-		os.Exit(1)
+	var healthServer *health.Server
+	if config.Health != nil {
+		if healthServer, err = health.Start(config.Health.Listen, engine); err != nil {
+			mainLog.Error("unable to start health checks", logging.Error, err)
+			abort(engine)
+		}
 	}
-	rendezvousZone, err = xform.ReadZoneEntries(config.LocalZone.Server, key, config.SearchSuffix)
-	if err != nil {
-		fmt.Printf("Initializing new rendezvous zone; transfer from primary failed: %v\n", err)
-		rendezvousZone = &xform.Zone{
-			Server:       config.LocalZone.Server,
-			ARecords:     map[string]net.IP{},
-			CNAMERecords: map[string]string{},
+	stopSupervising := notifier.Supervise(engine)
+
+	// run until interrupted or terminated (reloading the configuration file on hangup), then drain requests in flight
+	// (and the updates they trigger) before waiting out any rendezvous update still being written to the primary
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		notify(notifier, "RELOADING=1")
+		reload(engine, configFile)
+		notify(notifier, "READY=1")
+		sig = <-signals
+	}
+	mainLog.Info("shutting down", "signal", sig.String())
+	notify(notifier, "STOPPING=1")
+	stopSupervising()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			mainLog.Warn("unable to shut down admin API", logging.Error, err)
 		}
 	}
-	zoneByServer[config.LocalZone.Server.String()] = primaryZone
-	zoneByName[config.LocalZone.Suffix] = primaryZone
-
-	// 2) Zone transfer from all peers and augment transient structures
-	for idx, peer := range config.Peers {
-		zone, err := xform.ReadZoneEntries(peer.Server, key, peer.Suffix)
-		if err != nil {
-			peerZones[idx] = zone
-		} else {
-			fmt.Printf("Unable to transfer zone from peer %v: %v\n", peer.Server, err)
-			// store a blank zone -- the peer may not be online yet
-			peerZones[idx] = &xform.Zone{
-				Server:       peer.Server,
-				ARecords:     map[string]net.IP{},
-				CNAMERecords: map[string]string{},
-			}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			mainLog.Warn("unable to shut down metrics", logging.Error, err)
 		}
-		zoneByServer[peer.Server.String()] = peerZones[idx]
-		zoneByName[peer.Suffix] = peerZones[idx]
 	}
-	// 3) Start listening for DNS update requests from peers (and/or DHCP servers)
-	xform.StartServer(config, key, &xform.PeerCallbacks{
-		CNAME: func(proposer net.Addr, name string, target string) {
-			fmt.Printf("%v proposed '%s' CNAME '%s'\n", proposer, name, target)
-			zone, present := zoneByServer[proposer.String()]
-			if !present {
-				zone = defaultZone
-			}
-			runUpdate := false
-
-			zone.Lock()
-			if zone.CNAMERecords[name] != target {
-				zone.CNAMERecords[name] = target
-				updateByZoneMutex.Lock()
-				updateByZone[zone]++
-				updateByZoneMutex.Unlock()
-				runUpdate = true
-			}
-			zone.Unlock()
-			if zone == primaryZone {
-				fmt.Printf("Forwarding primary update '%s' -> '%s'\n", name, target) // TODO deletions?
-				if err := xform.WriteUpdate(config.LocalZone.Server, config.TTL, key, &xform.Mapping{
-					Name:   name,
-					Target: target,
-				}, config.LocalZone.Suffix); err != nil {
-					fmt.Printf("Error forwarding update to primary zone: %v\n", err)
-					return
-				}
-			}
-			if runUpdate {
-				localZoneUpdate()
-			}
-		},
-		A: func(proposer net.Addr, name string, target net.IP) {
-			fmt.Printf("%v proposed '%s' A '%v'\n", proposer, name, target)
-			zone, present := zoneByServer[proposer.String()]
-			if !present {
-				zone = defaultZone
-			}
-			runUpdate := false
-
-			zone.Lock()
-			if !zone.ARecords[name].Equal(target) {
-				zone.ARecords[name] = target
-				updateByZoneMutex.Lock()
-				updateByZone[zone]++
-				updateByZoneMutex.Unlock()
-				runUpdate = true
-			}
-			zone.Unlock()
-			if zone == primaryZone {
-				fmt.Printf("Forwarding primary update '%s' -> '%s'\n", name, target)
-				if err := xform.WriteUpdate(config.LocalZone.Server, config.TTL, key, &xform.Mapping{
-					Name: name,
-					IP:   target,
-				}, config.LocalZone.Suffix); err != nil {
-					fmt.Printf("Error forwarding update to primary zone: %v\n", err)
-					return
-				}
-			}
-			if runUpdate {
-				localZoneUpdate()
-			}
-		},
-		AAAA: func(proposer net.Addr, name string, target net.IP) {
-			fmt.Printf("%v proposed '%s' AAAA '%v'\n", proposer, name, target)
-			zone, present := zoneByServer[proposer.String()]
-			if !present {
-				zone = defaultZone
-			}
-			runUpdate := false
-
-			zone.Lock()
-			if !zone.ARecords[name].Equal(target) {
-				zone.ARecords[name] = target
-				updateByZoneMutex.Lock()
-				updateByZone[zone]++
-				updateByZoneMutex.Unlock()
-				runUpdate = true
-			}
-			zone.Unlock()
-			if zone == primaryZone {
-				fmt.Printf("Forwarding primary update '%s' -> '%s'\n", name, target)
-				if err := xform.WriteUpdate(config.LocalZone.Server, config.TTL, key, &xform.Mapping{
-					Name: name,
-					IP:   target,
-				}, config.LocalZone.Suffix); err != nil {
-					fmt.Printf("Error forwarding update to primary zone: %v\n", err)
-					return
-				}
-			}
-			if runUpdate {
-				localZoneUpdate()
-			}
-		},
-		Serial: func(zoneName string) uint32 {
-			// similar to RFC1912 (which presents an ISO 8601 date followed by a 2 digit revision number), this process
-			// uses a 2 digit year instead of a 4 digit year, so the revision number may be 4 digits. This similarly
-			// should guarantee monotonic increases, except on century crossings. Be sure to restart your hive on
-			// January 1st, 2100, and all subsequent century crossings.
-			zone, present := zoneByName[zoneName]
-			if !present {
-				zone = defaultZone
-			}
-			updateByZoneMutex.Lock()
-			index := updateByZone[zone]
-			updateByZoneMutex.Unlock()
-
-			if index >= 10000 {
-				index = 10000 - 1
-			}
-
-			now := time.Now()
-			dateIndex := now.Day() + int(now.Month())*100 + (now.Year()%100)*10000
-
-			return uint32(dateIndex)*10000 + index
-		},
-		Transfer: func(zoneName string) []*xform.Mapping {
-			zone, present := zoneByName[zoneName]
-			if !present {
-				zone = rendezvousZone
-			}
-			var mappings []*xform.Mapping
-			zone.Lock()
-			for name, target := range zone.CNAMERecords {
-				mappings = append(mappings, &xform.Mapping{
-					Name:   name,
-					Target: target,
-				})
-			}
-			for name, address := range zone.ARecords {
-				mappings = append(mappings, &xform.Mapping{
-					Name: name,
-					IP:   address,
-				})
-			}
-			zone.Unlock()
-			return mappings
-		},
-	})
+	if healthServer != nil {
+		if err := healthServer.Shutdown(ctx); err != nil {
+			mainLog.Warn("unable to shut down health checks", logging.Error, err)
+		}
+	}
+	if err := engine.Stop(ctx); err != nil {
+		mainLog.Error("unable to shut down cleanly", logging.Error, err)
+	}
+	// closes the audit log, once the engine can record no more events to it
+	audit.Configure(nil)
+}
 
-	// do an initial update on startup
-	localZoneUpdate()
+// abort stops an engine that has started, then exits with an error status.
+func abort(engine *hive.Engine) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	engine.Stop(ctx)
+	cancel()
+	os.Exit(1)
+}
 
-	select {}
+// notify notifies systemd of a change in the state of the service, if run by it.
+func notify(notifier *health.Notifier, state string) {
+	if err := notifier.Notify(state); err != nil {
+		mainLog.Warn("unable to notify systemd", logging.Error, err)
+	}
 }
 
-func tranposePrimary(zone *xform.Zone, config *conf.Configuration) *xform.Zone {
-	if zone == nil || config == nil {
-		return nil
+// reload parses the configuration file again and applies it to the engine, keeping the previous configuration if it
+// is invalid or cannot be applied.
+func reload(engine *hive.Engine, configFile string) {
+	mainLog.Info("reloading configuration", "file", configFile)
+	config, err := conf.ParseFile(configFile)
+	if err != nil {
+		mainLog.Error("unable to process config file; keeping previous configuration", "file", configFile,
+			logging.Error, err)
+		return
 	}
-	// tranpose A/AAAA records into CNAME records to the rendezvous suffix
-	zone.Lock()
-	tranposed := &xform.Zone{
-		Server:       zone.Server,
-		ARecords:     map[string]net.IP{},
-		CNAMERecords: map[string]string{},
+	warnConfig(config, nil)
+	if err := engine.Reload(config); err != nil {
+		mainLog.Error("unable to reload; keeping previous configuration", logging.Error, err)
+		return
 	}
-
-	for name, target := range zone.ARecords {
-		tranposedName := ""
-		if !dns.IsSubDomain(config.LocalZone.Suffix, name) {
-			continue
-		} else {
-			tranposedName = strings.TrimSuffix(name, config.LocalZone.Suffix) + config.SearchSuffix
-			tranposedName = strings.ToLower(tranposedName)
-		}
-		for _, localNet := range config.LocalNets {
-			if localNet.Contains(target) {
-				tranposed.CNAMERecords[tranposedName] = strings.ToLower(name)
-				break
-			}
-		}
+	if err := logging.Configure(config.Logging); err != nil {
+		mainLog.Error("unable to reconfigure logging; keeping previous logging configuration", logging.Error, err)
 	}
-	zone.Unlock()
-	return tranposed
-}
-
-func tranposePeer(zone *xform.Zone, peerSuffix, rendezvousSuffix string) *xform.Zone {
-	// tranpose A/AAAA records into CNAME records to the rendezvous suffix
-	zone.Lock()
-	tranposed := &xform.Zone{
-		Server:       zone.Server,
-		ARecords:     map[string]net.IP{},
-		CNAMERecords: map[string]string{},
+	if err := audit.Configure(config.Audit); err != nil {
+		mainLog.Error("unable to reconfigure audit log; keeping previous audit log", logging.Error, err)
 	}
+}
 
-	for name := range zone.ARecords {
-		tranposedName := ""
-		if !dns.IsSubDomain(peerSuffix, name) {
-			continue
-		} else {
-			tranposedName = strings.TrimSuffix(name, peerSuffix) + rendezvousSuffix
-			tranposedName = strings.ToLower(tranposedName)
-		}
-		tranposed.CNAMERecords[tranposedName] = strings.ToLower(name)
+// usage describes the command line, and the environment variables overriding the configuration file.
+func usage() {
+	output := flag.CommandLine.Output()
+	fmt.Fprintf(output, "Usage: %s -config <file> -key <file> [-dry-run]\n", os.Args[0])
+	fmt.Fprintf(output, "       %s check-config -config <file> [-key <file>]\n", os.Args[0])
+	fmt.Fprintf(output, "       %s plan -config <file> -key <file>\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(output, "\nSettings are taken from the environment variables below, then the configuration file, then the\n")
+	fmt.Fprintf(output, "defaults (lists are comma separated):\n")
+	for _, variable := range conf.EnvironmentVariables() {
+		fmt.Fprintf(output, "  %-40s %s\n", variable[0], variable[1])
 	}
-	zone.Unlock()
-	return tranposed
 }
@@ -0,0 +1,334 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DurationBuckets are the upper bounds (in seconds) of the buckets of a histogram of durations, from a millisecond to
+// half a minute.
+var DurationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Default is the registry the metrics of the hive packages are registered with.
+var Default = NewRegistry()
+
+// Registry holds metric families, and writes them in the Prometheus text exposition format.
+type Registry struct {
+	mutex    sync.Mutex
+	families []family
+}
+
+type family interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, registered := range r.families {
+		if registered.name() == f.name() {
+			panic(fmt.Sprintf("metric %s registered twice", f.name()))
+		}
+	}
+	r.families = append(r.families, f)
+}
+
+// WriteText writes every metric family in the Prometheus text exposition format, ordered by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	families := append([]family{}, r.families...)
+	r.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name() < families[j].name()
+	})
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// descriptor holds what every metric family has: a name, help text, and label names.
+type descriptor struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *descriptor) name() string {
+	return d.metricName
+}
+
+func (d *descriptor) writeHeader(w io.Writer, metricType string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, escapeHelp(d.help), d.metricName, metricType)
+	return err
+}
+
+// seriesKey joins label values into a key identifying a series.
+func (d *descriptor) seriesKey(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, given %d values", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the labels of a series, with any extra label (e.g. a histogram bucket's le) last.
+func (d *descriptor) labelPairs(values []string, extra ...string) string {
+	var pairs []string
+	for i, label := range d.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a family of monotonically increasing values, one series per combination of label values.
+type Counter struct {
+	descriptor
+	mutex  sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labels []string
+	value  float64
+}
+
+// NewCounter registers a counter family.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		descriptor: descriptor{name, help, labels},
+		series:     map[string]*counterSeries{},
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the series of the label values given.
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds a (non-negative) amount to the series of the label values given.
+func (c *Counter) Add(delta float64, labels ...string) {
+	key := c.seriesKey(labels)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s := c.series[key]
+	if s == nil {
+		s = &counterSeries{labels: append([]string{}, labels...)}
+		c.series[key] = s
+	}
+	s.value += delta
+}
+
+func (c *Counter) write(w io.Writer) error {
+	if err := c.writeHeader(w, "counter"); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelPairs(s.labels), formatValue(s.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gauge is a family of values that may go up and down, one series per combination of label values.
+type Gauge struct {
+	descriptor
+	mutex  sync.Mutex
+	series map[string]*counterSeries
+}
+
+// NewGauge registers a gauge family.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		descriptor: descriptor{name, help, labels},
+		series:     map[string]*counterSeries{},
+	}
+	r.register(g)
+	return g
+}
+
+// Set sets the series of the label values given.
+func (g *Gauge) Set(value float64, labels ...string) {
+	key := g.seriesKey(labels)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.series[key] = &counterSeries{labels: append([]string{}, labels...), value: value}
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	if err := g.writeHeader(w, "gauge"); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, key := range sortedKeys(g.series) {
+		s := g.series[key]
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelPairs(s.labels), formatValue(s.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeFunc is a family of gauges whose series are collected when written, e.g. from the state of an engine.
+type GaugeFunc struct {
+	descriptor
+	collect func(emit func(value float64, labels ...string))
+}
+
+// NewGaugeFunc registers a gauge family whose series are collected by a function each time the registry is written.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string,
+	collect func(emit func(value float64, labels ...string))) *GaugeFunc {
+	g := &GaugeFunc{
+		descriptor: descriptor{name, help, labels},
+		collect:    collect,
+	}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	if err := g.writeHeader(w, "gauge"); err != nil {
+		return err
+	}
+	series := map[string]*counterSeries{}
+	g.collect(func(value float64, labels ...string) {
+		series[g.seriesKey(labels)] = &counterSeries{labels: labels, value: value}
+	})
+	for _, key := range sortedKeys(series) {
+		s := series[key]
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelPairs(s.labels), formatValue(s.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram is a family of distributions of observed values in cumulative buckets, one series per combination of
+// label values.
+type Histogram struct {
+	descriptor
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram family with buckets of the (ascending) upper bounds given.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		descriptor: descriptor{name, help, labels},
+		buckets:    buckets,
+		series:     map[string]*histogramSeries{},
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records a value in the series of the label values given.
+func (h *Histogram) Observe(value float64, labels ...string) {
+	key := h.seriesKey(labels)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{
+			labels: append([]string{}, labels...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	if err := h.writeHeader(w, "histogram"); err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName,
+				h.labelPairs(s.labels, "le", formatValue(bound)), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.metricName, h.labelPairs(s.labels, "le", "+Inf"), s.count,
+			h.metricName, h.labelPairs(s.labels), formatValue(s.sum),
+			h.metricName, h.labelPairs(s.labels), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(series map[string]*counterSeries) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
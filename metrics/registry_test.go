@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("hive_requests_total", "Requests by \\ kind,\nand result.", "kind", "result")
+	requests.Inc("update", "ok")
+	requests.Add(2, "update", "ok")
+	requests.Inc(`path\to "zone"`, "line\nbreak")
+	r.NewGauge("hive_leader", "Whether leading.").Set(1)
+	r.NewGaugeFunc("hive_peer_up", "Peers up.", []string{"zone"}, func(emit func(value float64, labels ...string)) {
+		emit(0, "north.example.com.")
+		emit(1, "east.example.com.")
+	})
+	durations := r.NewHistogram("hive_write_seconds", "Write durations.", []float64{.01, .1}, "zone")
+	for _, value := range []float64{.005, .05, .05, 1} {
+		durations.Observe(value, "rdvu.example.com.")
+	}
+
+	var written strings.Builder
+	if err := r.WriteText(&written); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	expected := `# HELP hive_leader Whether leading.
+# TYPE hive_leader gauge
+hive_leader 1
+# HELP hive_peer_up Peers up.
+# TYPE hive_peer_up gauge
+hive_peer_up{zone="east.example.com."} 1
+hive_peer_up{zone="north.example.com."} 0
+# HELP hive_requests_total Requests by \\ kind,\nand result.
+# TYPE hive_requests_total counter
+hive_requests_total{kind="path\\to \"zone\"",result="line\nbreak"} 1
+hive_requests_total{kind="update",result="ok"} 3
+# HELP hive_write_seconds Write durations.
+# TYPE hive_write_seconds histogram
+hive_write_seconds_bucket{zone="rdvu.example.com.",le="0.01"} 1
+hive_write_seconds_bucket{zone="rdvu.example.com.",le="0.1"} 3
+hive_write_seconds_bucket{zone="rdvu.example.com.",le="+Inf"} 4
+hive_write_seconds_sum{zone="rdvu.example.com."} 1.105
+hive_write_seconds_count{zone="rdvu.example.com."} 4
+`
+	if written.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, written.String())
+	}
+}
+
+func TestRegistrationErrors(t *testing.T) {
+	expectPanic := func(what string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", what)
+			}
+		}()
+		f()
+	}
+	r := NewRegistry()
+	counter := r.NewCounter("hive_updates_total", "Updates.", "zone")
+	expectPanic("registering a name twice", func() {
+		r.NewGauge("hive_updates_total", "Updates.")
+	})
+	expectPanic("giving too few label values", func() {
+		counter.Inc()
+	})
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("hive_leader", "Whether leading.").Set(1)
+	handler := Handler(r)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != contentType ||
+		!strings.Contains(recorder.Body.String(), "hive_leader 1\n") {
+		t.Errorf("unexpected response %d (%s): %s", recorder.Code, recorder.Header().Get("Content-Type"),
+			recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("expected POST to be refused, got %d", recorder.Code)
+	}
+}
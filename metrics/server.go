@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"github.com/thyth/hive/logging"
+
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var metricsLog = logging.For("metrics")
+
+// contentType is that of the Prometheus text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Server serves the metrics of a registry at /metrics.
+type Server struct {
+	http *http.Server
+}
+
+// Handler serves the metrics of a registry in the Prometheus text exposition format.
+func Handler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		if err := registry.WriteText(w); err != nil {
+			metricsLog.Warn("unable to write metrics", logging.Error, err)
+		}
+	})
+}
+
+// Start binds a listener for the metrics of a registry and serves them in the background, until shut down.
+func Start(listen string, registry *Registry) (*Server, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", listen, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(registry))
+	s := &Server{
+		http: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+	go func() {
+		if err := s.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			metricsLog.Error("metrics server failed", logging.Error, err)
+		}
+	}()
+	metricsLog.Info("metrics listening", logging.Address, listener.Addr().String())
+	return s, nil
+}
+
+// Shutdown stops accepting requests, and waits for those in flight to complete (or the context to be done).
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
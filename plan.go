@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/hive"
+	"github.com/thyth/hive/logging"
+
+	"flag"
+	"fmt"
+)
+
+// plan implements the plan subcommand: it transfers every zone, merges them, and prints how the rendezvous zone on the
+// primary would change (without writing to it), returning the exit status.
+func plan(args []string) int {
+	configFile := ""
+	dnsKeyFile := ""
+
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	flags.StringVar(&configFile, "config", "", "Path to a JSON, YAML (.yaml/.yml) or TOML (.toml) configuration file")
+	flags.StringVar(&dnsKeyFile, "key", "", "Path to a DNS key file")
+	flags.Parse(args)
+	if configFile == "" || dnsKeyFile == "" {
+		flags.Usage()
+		return 2
+	}
+
+	config, err := conf.ParseFile(configFile)
+	if err != nil {
+		fmt.Printf("Error processing config file: %v\n", err)
+		return 1
+	}
+	key, err := conf.ParseKeyfile(dnsKeyFile)
+	if err != nil {
+		fmt.Printf("Error processing key file: %v\n", err)
+		return 1
+	}
+	// only warnings are logged (to standard output, or as configured), so that the plan stands out
+	logConfig := &conf.Logging{}
+	if config.Logging != nil {
+		*logConfig = *config.Logging
+		logConfig.Levels = nil
+	}
+	logConfig.Level = "warn"
+	if err := logging.Configure(logConfig); err != nil {
+		fmt.Printf("Error configuring logging: %v\n", err)
+		return 1
+	}
+
+	updates, err := hive.NewEngine(config, key).Plan()
+	if err != nil {
+		fmt.Printf("Error planning: %v\n", err)
+		return 1
+	}
+	for _, update := range updates {
+		fmt.Println(describeUpdate(update))
+	}
+	if len(updates) == 0 {
+		fmt.Printf("%s is up to date\n", config.SearchSuffix)
+	} else {
+		fmt.Printf("%d update(s) planned to %s\n", len(updates), config.SearchSuffix)
+	}
+	return 0
+}
+
+// describeUpdate describes a planned update as a line of a diff: + for a name added, - for a name deleted, and ~ for a
+// name whose target changes.
+func describeUpdate(update *hive.PlannedUpdate) string {
+	switch {
+	case update.Action == "delete":
+		return fmt.Sprintf("- %s %s %s (%s)", update.Name, update.Type, update.Previous, update.Reason)
+	case update.Previous == "":
+		return fmt.Sprintf("+ %s %s %s (%s)", update.Name, update.Type, update.Target, update.Reason)
+	}
+	return fmt.Sprintf("~ %s %s %s -> %s (%s)", update.Name, update.Type, update.Previous, update.Target, update.Reason)
+}
@@ -0,0 +1,62 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/audit"
+
+	"net"
+)
+
+// auditProposal records an update accepted from a proposer in the audit log.
+func auditProposal(proposer net.Addr, request *dns.Msg, zone, action string, rrtype uint16, mapping *Mapping) {
+	event := &audit.Event{
+		Event:    audit.Proposal,
+		Proposer: hostOf(proposer.String()),
+		Key:      tsigKeyName(request),
+		Zone:     zone,
+		Name:     mapping.Name,
+		Type:     dns.TypeToString[rrtype],
+		Action:   action,
+		Target:   mapping.Target,
+	}
+	if mapping.IP != nil {
+		event.Address = mapping.IP.String()
+	}
+	audit.Record(event)
+}
+
+// auditRejection records a request refused by policy in the audit log.
+func auditRejection(w dns.ResponseWriter, request *dns.Msg, rcode, reason string) {
+	event := &audit.Event{
+		Event:    audit.Rejection,
+		Proposer: hostOf(w.RemoteAddr().String()),
+		Key:      tsigKeyName(request),
+		Rcode:    rcode,
+		Reason:   reason,
+	}
+	if len(request.Question) > 0 {
+		event.Zone = request.Question[0].Name
+	}
+	audit.Record(event)
+}
+
+// hostOf strips the port from an address, if it has one.
+func hostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// tsigKeyName names the key a request was signed with, if any.
+func tsigKeyName(request *dns.Msg) string {
+	if tsig := request.IsTsig(); tsig != nil {
+		return tsig.Hdr.Name
+	}
+	return ""
+}
+
+// opcodeName names the opcode of a request, e.g. UPDATE.
+func opcodeName(request *dns.Msg) string {
+	return dns.OpcodeToString[request.Opcode]
+}
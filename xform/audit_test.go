@@ -0,0 +1,102 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/audit"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/internal/dnstest"
+	"github.com/thyth/hive/metrics"
+
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unsignedCount provides the number of unsigned requests of an opcode refused so far, as exposed to Prometheus.
+func unsignedCount(t *testing.T, opcode string) int {
+	var text strings.Builder
+	if err := metrics.Default.WriteText(&text); err != nil {
+		t.Fatalf("unable to write metrics: %v", err)
+	}
+	prefix := `hive_unsigned_requests_total{opcode="` + opcode + `"} `
+	for _, line := range strings.Split(text.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			count, _ := strconv.Atoi(strings.TrimPrefix(line, prefix))
+			return count
+		}
+	}
+	return 0
+}
+
+func TestUnsignedRequestsCounted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := audit.Configure(&conf.Audit{File: path, MaxSize: 1 << 20, MaxFiles: 1}); err != nil {
+		t.Fatalf("unable to configure audit log: %v", err)
+	}
+	defer audit.Configure(nil)
+
+	config := testQueryConfig()
+	config.AnswerQueries = false
+	listen := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: dnstest.FreePort(t, "127.0.0.1")}
+	config.ListenAddresses = []net.Addr{listen}
+	config.ListenNetworks = []string{"udp"}
+	server, err := StartServer(config, dnstest.Key, testQueryBackend())
+	if err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	updates, queries := unsignedCount(t, "UPDATE"), unsignedCount(t, "QUERY")
+	exchange := func(msg *dns.Msg, key *conf.TsigKey) {
+		t.Helper()
+		client := &dns.Client{Timeout: time.Second}
+		if key != nil {
+			client.TsigSecret = map[string]string{key.ZoneName: key.Key}
+			msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
+		}
+		reply, _, err := client.Exchange(msg, listen.String())
+		if key == nil && (err != nil || reply.Rcode != dns.RcodeRefused) {
+			t.Fatalf("expected the unsigned request refused, got %v (%v)", reply, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		update := &dns.Msg{}
+		update.SetUpdate("rdvu.example.com.")
+		exchange(update, nil)
+	}
+	query := &dns.Msg{}
+	query.SetQuestion("foo.west.example.com.", dns.TypeA)
+	exchange(query, nil)
+	// a request signed with another key is still audited
+	otherKey := *dnstest.Key
+	otherKey.Key = "b3RoZXJvdGhlcm90aGVyb3RoZXI="
+	update := &dns.Msg{}
+	update.SetUpdate("rdvu.example.com.")
+	exchange(update, &otherKey)
+
+	if counted := unsignedCount(t, "UPDATE") - updates; counted != 3 {
+		t.Errorf("expected 3 unsigned updates counted, got %d", counted)
+	}
+	if counted := unsignedCount(t, "QUERY") - queries; counted != 1 {
+		t.Errorf("expected 1 unsigned query counted, got %d", counted)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the TSIG failure audited, got %q", lines)
+	}
+	event := &audit.Event{}
+	if err := json.Unmarshal([]byte(lines[0]), event); err != nil || event.Event != audit.Rejection ||
+		event.Rcode != "BADSIG" {
+		t.Errorf("expected a BADSIG rejection, got %s", lines[0])
+	}
+}
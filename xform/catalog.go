@@ -0,0 +1,114 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/logging"
+
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+var catalogLog = logging.For("catalog")
+
+// catalogVersion is the version of the catalog zone schema (RFC9432 section 4.2) that Hive understands.
+const catalogVersion = "2"
+
+// catalogMember collects the records of one member zone of a catalog zone, by its unique ID.
+type catalogMember struct {
+	zone   string
+	server net.Addr
+}
+
+// ReadCatalog transfers an RFC9432 catalog zone, and lists its member zones as peers: each member zone is the suffix of
+// a peer, whose server is given by the member's "server" custom property (server.ext.<id>.zones.<catalog>) as a TXT
+// record holding a "host[:port]" address, or an A/AAAA record. Members without a server are skipped.
+func ReadCatalog(dnsServer net.Addr, key *conf.TsigKey, catalog string) ([]*conf.ZonePeer, error) {
+	axfr := &dns.Transfer{
+		TsigSecret: map[string]string{
+			key.ZoneName: key.Key,
+		},
+	}
+	msg := &dns.Msg{}
+	msg.SetAxfr(catalog)
+	msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
+	envelopes, err := axfr.In(msg, dnsServer.String())
+	if err != nil {
+		return nil, err
+	}
+
+	catalogLabels := dns.CountLabel(catalog)
+	version := ""
+	members := map[string]*catalogMember{}
+	member := func(id string) *catalogMember {
+		if members[id] == nil {
+			members[id] = &catalogMember{}
+		}
+		return members[id]
+	}
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		for _, record := range envelope.RR {
+			name := strings.ToLower(record.Header().Name)
+			if !dns.IsSubDomain(catalog, name) {
+				continue
+			}
+			// the labels of the name within the catalog zone, e.g. [server ext <id> zones]
+			labels := dns.SplitDomainName(name)
+			labels = labels[:len(labels)-catalogLabels]
+			switch {
+			case len(labels) == 1 && labels[0] == "version":
+				if txt, ok := record.(*dns.TXT); ok && len(txt.Txt) > 0 {
+					version = txt.Txt[0]
+				}
+			case len(labels) == 2 && labels[1] == "zones":
+				if ptr, ok := record.(*dns.PTR); ok {
+					member(labels[0]).zone = strings.ToLower(dns.Fqdn(ptr.Ptr))
+				}
+			case len(labels) == 4 && labels[0] == "server" && labels[1] == "ext" && labels[3] == "zones":
+				switch record := record.(type) {
+				case *dns.TXT:
+					if len(record.Txt) > 0 {
+						if addr, err := conf.ParseAddress(record.Txt[0]); err == nil {
+							member(labels[2]).server = addr
+						}
+					}
+				case *dns.A:
+					member(labels[2]).server = &net.UDPAddr{IP: record.A, Port: conf.DefaultPort}
+				case *dns.AAAA:
+					member(labels[2]).server = &net.UDPAddr{IP: record.AAAA, Port: conf.DefaultPort}
+				}
+			}
+		}
+	}
+	if version != catalogVersion {
+		return nil, fmt.Errorf("catalog zone '%s' version '%s' unsupported (expected %s)", catalog, version,
+			catalogVersion)
+	}
+
+	var peers []*conf.ZonePeer
+	for id, member := range members {
+		if member.zone == "" {
+			continue
+		}
+		if member.server == nil {
+			catalogLog.Warn("catalog zone member has no server; skipping", logging.Zone, member.zone,
+				"catalog", catalog, "member", id)
+			continue
+		}
+		peers = append(peers, &conf.ZonePeer{
+			Suffix: member.zone,
+			Server: member.server,
+		})
+	}
+	// in a stable order, since it is also the order of the peers' priority
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Suffix < peers[j].Suffix
+	})
+	return peers, nil
+}
@@ -0,0 +1,70 @@
+package xform
+
+import (
+	"github.com/thyth/hive/internal/dnstest"
+
+	"fmt"
+	"testing"
+)
+
+func TestReadCatalog(t *testing.T) {
+	catalog := "catalog.example.com."
+	server := dnstest.NewServer(t, "127.0.0.1")
+	member := func(id, zone string) string {
+		return fmt.Sprintf("%s.zones.%s PTR %s", id, catalog, zone)
+	}
+	property := func(id, record string) string {
+		return fmt.Sprintf("server.ext.%s.zones.%s %s", id, catalog, record)
+	}
+	server.AddZone(catalog,
+		"version."+catalog+" TXT \"2\"",
+		member("m1", "North.example.com."),
+		property("m1", "TXT \"10.2.0.2:5353\""),
+		member("m2", "east.example.com."),
+		property("m2", "TXT \"10.1.0.2\""),
+		member("m3", "south.example.com."),
+		property("m3", "A 10.3.0.2"),
+		member("m4", "west.example.org."),
+		property("m4", "AAAA fd00::2"),
+		// members without a (valid) server, properties without a member, and other custom properties are skipped
+		member("m5", "lost.example.com."),
+		member("m6", "garbled.example.com."),
+		property("m6", "TXT \"not an address\""),
+		property("m7", "A 10.7.0.2"),
+		"group.m1.zones."+catalog+" TXT \"sites\"",
+		"coo.m2.zones."+catalog+" PTR other.catalog.example.com.")
+
+	peers, err := ReadCatalog(server.Addr, dnstest.Key, catalog)
+	if err != nil {
+		t.Fatalf("unable to read catalog: %v", err)
+	}
+	var listed []string
+	for _, peer := range peers {
+		listed = append(listed, peer.Suffix+" "+peer.Server.String())
+	}
+	// sorted by suffix, which is also their order of priority
+	expected := []string{
+		"east.example.com. 10.1.0.2:53",
+		"north.example.com. 10.2.0.2:5353",
+		"south.example.com. 10.3.0.2:53",
+		"west.example.org. [fd00::2]:53",
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(expected) {
+		t.Errorf("expected peers %q, got %q", expected, listed)
+	}
+}
+
+func TestReadCatalogErrors(t *testing.T) {
+	catalog := "catalog.example.com."
+	server := dnstest.NewServer(t, "127.0.0.1")
+	server.AddZone(catalog,
+		"version."+catalog+" TXT \"1\"",
+		"m1.zones."+catalog+" PTR east.example.com.",
+		"server.ext.m1.zones."+catalog+" A 10.1.0.2")
+	if _, err := ReadCatalog(server.Addr, dnstest.Key, catalog); err == nil {
+		t.Errorf("catalog of an unsupported version was read")
+	}
+	if _, err := ReadCatalog(server.Addr, dnstest.Key, "other.example.com."); err == nil {
+		t.Errorf("catalog zone not served was read")
+	}
+}
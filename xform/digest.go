@@ -0,0 +1,189 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Zone digests let Hive peers find which records of a zone differ between them without transferring the whole zone.
+// The names of a zone are hashed into DigestBuckets buckets, each summarized by a digest of its records. Digests are
+// served (TSIG authenticated only) as the TXT record "_hive-digest.<zone>" holding one hex string per bucket, and the
+// records of one bucket as the answer to an ANY query for "<bucket>._hive-bucket.<zone>".
+const (
+	DigestBuckets = 64
+
+	digestLabel = "_hive-digest"
+	bucketLabel = "_hive-bucket"
+	// digestSize is the number of bytes of each bucket's SHA-256 digest that are kept
+	digestSize = 16
+)
+
+// Digest summarizes the records of a zone, one digest per bucket.
+type Digest [DigestBuckets][]byte
+
+// Bucket determines the bucket of a name.
+func Bucket(name string) int {
+	sum := sha256.Sum256([]byte(strings.ToLower(dns.Fqdn(name))))
+	return int(sum[0]) % DigestBuckets
+}
+
+// Digested determines whether a name of a zone is covered by its digest: every name except that of the "ns" host Hive
+// synthesizes for zone transfers, which is not a record of the zone.
+func Digested(zone, name string) bool {
+	return !strings.EqualFold(dns.Fqdn(name), "ns."+dns.Fqdn(zone))
+}
+
+// ZoneDigest summarizes the records of a zone, regardless of their order.
+func ZoneDigest(zone string, mappings []*Mapping) *Digest {
+	lines := make([][]string, DigestBuckets)
+	for _, mapping := range mappings {
+		if !Digested(zone, mapping.Name) {
+			continue
+		}
+		bucket := Bucket(mapping.Name)
+		lines[bucket] = append(lines[bucket], fmt.Sprintf("%s %s %s", strings.ToLower(dns.Fqdn(mapping.Name)),
+			dns.TypeToString[rrType(mapping)], mappingValue(mapping)))
+	}
+	digest := &Digest{}
+	for bucket := range digest {
+		sort.Strings(lines[bucket])
+		sum := sha256.Sum256([]byte(strings.Join(lines[bucket], "\n")))
+		digest[bucket] = sum[:digestSize]
+	}
+	return digest
+}
+
+// DifferingBuckets lists the buckets whose digests differ between two digests.
+func DifferingBuckets(a, b *Digest) []int {
+	var buckets []int
+	for bucket := range a {
+		if !bytes.Equal(a[bucket], b[bucket]) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// isDigestQuery determines whether a question asks for a zone digest or the records of a bucket.
+func isDigestQuery(question dns.Question) bool {
+	labels := dns.SplitDomainName(question.Name)
+	return (len(labels) > 1 && labels[0] == digestLabel && question.Qtype == dns.TypeTXT) ||
+		(len(labels) > 2 && labels[1] == bucketLabel && question.Qtype == dns.TypeANY)
+}
+
+// handleDigestQuery answers a question for a zone digest, or the records of a bucket, of a zone Hive serves.
+func handleDigestQuery(msg *dns.Msg, w dns.ResponseWriter, request *dns.Msg, config *conf.Configuration,
+	backend ZoneBackend) {
+	question := request.Question[0]
+	labels := dns.SplitDomainName(question.Name)
+	bucket := -1
+	if labels[0] != digestLabel {
+		var err error
+		bucket, err = strconv.Atoi(labels[0])
+		labels = labels[1:]
+		if err != nil || bucket < 0 || bucket >= DigestBuckets {
+			msg.Rcode = dns.RcodeNameError
+			return
+		}
+	}
+	zone := dns.Fqdn(strings.Join(labels[1:], "."))
+	if !servesZone(config, backend, zone) {
+		msg.Rcode = dns.RcodeNotAuth
+		return
+	}
+	msg.Authoritative = true
+	mappings := backend.Transfer(zone).Mappings
+	if bucket < 0 {
+		txt := &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+			},
+		}
+		for _, digest := range ZoneDigest(zone, mappings) {
+			txt.Txt = append(txt.Txt, hex.EncodeToString(digest))
+		}
+		msg.Answer = append(msg.Answer, txt)
+	} else {
+		for _, mapping := range mappings {
+			if Digested(zone, mapping.Name) && Bucket(mapping.Name) == bucket {
+				msg.Answer = append(msg.Answer, mappingRR(mapping, config.TTL))
+			}
+		}
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size := dns.MinMsgSize
+		if opt := request.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		msg.Truncate(size)
+	}
+}
+
+// ReadDigest requests the digest of a zone from a Hive server.
+func ReadDigest(dnsServer net.Addr, key *conf.TsigKey, zone string, timeout time.Duration) (*Digest, error) {
+	reply, err := exchangeDigestQuery(dnsServer, key, digestLabel+"."+dns.Fqdn(zone), dns.TypeTXT, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range reply.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && len(txt.Txt) == DigestBuckets {
+			digest := &Digest{}
+			for bucket, encoded := range txt.Txt {
+				if digest[bucket], err = hex.DecodeString(encoded); err != nil {
+					return nil, fmt.Errorf("digest of bucket %d invalid: %v", bucket, err)
+				}
+			}
+			return digest, nil
+		}
+	}
+	return nil, fmt.Errorf("no digest of zone '%s' in reply", zone)
+}
+
+// ReadBucket requests the records of one bucket of a zone from a Hive server.
+func ReadBucket(dnsServer net.Addr, key *conf.TsigKey, zone string, bucket int, timeout time.Duration) ([]*Mapping,
+	error) {
+	name := strconv.Itoa(bucket) + "." + bucketLabel + "." + dns.Fqdn(zone)
+	reply, err := exchangeDigestQuery(dnsServer, key, name, dns.TypeANY, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var mappings []*Mapping
+	for _, rr := range reply.Answer {
+		if mapping := rrMapping(rr); mapping != nil {
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings, nil
+}
+
+func exchangeDigestQuery(dnsServer net.Addr, key *conf.TsigKey, name string, qtype uint16,
+	timeout time.Duration) (*dns.Msg, error) {
+	cli := &dns.Client{Net: "tcp", Timeout: timeout}
+	cli.TsigSecret = map[string]string{key.ZoneName: key.Key}
+	msg := &dns.Msg{}
+	msg.SetQuestion(name, qtype)
+	msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
+	reply, _, err := cli.Exchange(msg, dnsServer.String())
+	if err != nil {
+		return nil, err
+	}
+	if reply.IsTsig() == nil {
+		return nil, fmt.Errorf("unsigned reply: %s", dns.RcodeToString[reply.Rcode])
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("query for '%s' failed: %s", name, dns.RcodeToString[reply.Rcode])
+	}
+	return reply, nil
+}
@@ -0,0 +1,100 @@
+package xform
+
+import (
+	"github.com/thyth/hive/internal/dnstest"
+
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestZoneDigest(t *testing.T) {
+	zone := "east.example.com."
+	mappings := []*Mapping{
+		{Name: "foo.east.example.com.", IP: net.ParseIP("10.1.0.100")},
+		{Name: "bar.east.example.com.", IP: net.ParseIP("fd00::100")},
+		{Name: "baz.east.example.com.", Target: "foo.east.example.com."},
+	}
+	digest := ZoneDigest(zone, mappings)
+
+	// the order of the records, the case of their names and the synthesized nameserver do not matter
+	reordered := []*Mapping{
+		{Name: "ns.east.example.com.", IP: net.ParseIP("10.1.0.2")},
+		{Name: "BAZ.east.example.com.", Target: "FOO.east.example.com."},
+		mappings[1],
+		mappings[0],
+	}
+	if differing := DifferingBuckets(digest, ZoneDigest(zone, reordered)); len(differing) != 0 {
+		t.Errorf("equivalent zones differ in buckets %v", differing)
+	}
+
+	changes := []struct {
+		name     string
+		mappings []*Mapping
+		bucket   int
+	}{
+		{"address changed", []*Mapping{
+			{Name: "foo.east.example.com.", IP: net.ParseIP("10.1.0.101")}, mappings[1], mappings[2],
+		}, Bucket("foo.east.example.com.")},
+		{"name removed", []*Mapping{mappings[0], mappings[2]}, Bucket("bar.east.example.com.")},
+		{"name added", append([]*Mapping{{Name: "qux.east.example.com.", IP: net.ParseIP("10.1.0.102")}},
+			mappings...), Bucket("qux.east.example.com.")},
+		{"address replaced by CNAME", []*Mapping{
+			mappings[0], mappings[1], {Name: "baz.east.example.com.", IP: net.ParseIP("10.1.0.100")},
+		}, Bucket("baz.east.example.com.")},
+	}
+	for _, change := range changes {
+		t.Run(change.name, func(t *testing.T) {
+			differing := DifferingBuckets(digest, ZoneDigest(zone, change.mappings))
+			if len(differing) != 1 || differing[0] != change.bucket {
+				t.Errorf("expected bucket %d to differ, got %v", change.bucket, differing)
+			}
+		})
+	}
+}
+
+func TestDigestQueries(t *testing.T) {
+	config := testQueryConfig()
+	host := "127.0.0.1"
+	listen := &net.UDPAddr{IP: net.ParseIP(host), Port: dnstest.FreePort(t, host)}
+	config.ListenAddresses = []net.Addr{listen}
+	config.ListenNetworks = []string{"udp", "tcp"}
+	backend := testQueryBackend()
+	server, err := StartServer(config, dnstest.Key, backend)
+	if err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	zone := "west.example.com."
+	digest, err := ReadDigest(listen, dnstest.Key, zone, time.Second)
+	if err != nil {
+		t.Fatalf("unable to read digest: %v", err)
+	}
+	if differing := DifferingBuckets(digest, ZoneDigest(zone, backend.zones[zone])); len(differing) != 0 {
+		t.Errorf("served digest differs from the zone in buckets %v", differing)
+	}
+
+	bucket := Bucket("foo.west.example.com.")
+	fetched, err := ReadBucket(listen, dnstest.Key, zone, bucket, time.Second)
+	if err != nil {
+		t.Fatalf("unable to read bucket: %v", err)
+	}
+	var expected []*Mapping
+	for _, mapping := range backend.zones[zone] {
+		if Bucket(mapping.Name) == bucket {
+			expected = append(expected, mapping)
+		}
+	}
+	if differing := DifferingBuckets(ZoneDigest(zone, expected), ZoneDigest(zone, fetched)); len(differing) != 0 {
+		t.Errorf("bucket %d holds %v, expected %v", bucket, fetched, expected)
+	}
+
+	if _, err := ReadDigest(listen, dnstest.Key, "example.org.", time.Second); err == nil {
+		t.Errorf("digest of a zone not served was read")
+	}
+	if _, err := ReadBucket(listen, dnstest.Key, zone, DigestBuckets, time.Second); err == nil {
+		t.Errorf("bucket beyond the last was read")
+	}
+}
@@ -0,0 +1,90 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// leaseLabel is the name (within the rendezvous zone) of the TXT record holding the leadership lease of a site's Hive
+// instances.
+const leaseLabel = "_hive-leader"
+
+// LeaseName is the name of the leadership lease record within a zone.
+func LeaseName(zone string) string {
+	return leaseLabel + "." + dns.Fqdn(zone)
+}
+
+// ReadLease queries a DNS server for the leadership lease record of a zone, returning an empty value if there is none.
+func ReadLease(dnsServer net.Addr, key *conf.TsigKey, zone string, timeout time.Duration) (string, error) {
+	cli := &dns.Client{Net: "tcp", Timeout: timeout}
+	cli.TsigSecret = map[string]string{key.ZoneName: key.Key}
+	msg := &dns.Msg{}
+	msg.SetQuestion(LeaseName(zone), dns.TypeTXT)
+	msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
+	reply, _, err := cli.Exchange(msg, dnsServer.String())
+	if err != nil {
+		return "", err
+	}
+	if reply.IsTsig() == nil {
+		return "", fmt.Errorf("unsigned reply: %s", dns.RcodeToString[reply.Rcode])
+	}
+	if reply.Rcode == dns.RcodeNameError {
+		return "", nil
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return "", fmt.Errorf("query for '%s' failed: %s", LeaseName(zone), dns.RcodeToString[reply.Rcode])
+	}
+	for _, rr := range reply.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			return strings.Join(txt.Txt, ""), nil
+		}
+	}
+	return "", nil
+}
+
+// SwapLease replaces the leadership lease record of a zone on a DNS server, provided it still holds the previous value
+// (or is absent, if the previous value is empty). An empty value removes the record. The replacement is made with
+// RFC2136 prerequisites, so that of several instances racing to replace the same value, only one succeeds; the others
+// report false.
+func SwapLease(dnsServer net.Addr, key *conf.TsigKey, zone, previous, value string, timeout time.Duration) (bool,
+	error) {
+	name := LeaseName(zone)
+	header := dns.RR_Header{
+		Name:   name,
+		Rrtype: dns.TypeTXT,
+		Class:  dns.ClassINET,
+	}
+	msg := &dns.Msg{}
+	msg.SetUpdate(dns.Fqdn(zone))
+	if previous == "" {
+		msg.RRsetNotUsed([]dns.RR{&dns.TXT{Hdr: header}})
+	} else {
+		msg.Used([]dns.RR{&dns.TXT{Hdr: header, Txt: []string{previous}}})
+	}
+	msg.RemoveRRset([]dns.RR{&dns.TXT{Hdr: header}})
+	if value != "" {
+		msg.Insert([]dns.RR{&dns.TXT{Hdr: header, Txt: []string{value}}})
+	}
+
+	cli := &dns.Client{Net: "tcp", Timeout: timeout}
+	cli.TsigSecret = map[string]string{key.ZoneName: key.Key}
+	msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
+	reply, _, err := cli.Exchange(msg, dnsServer.String())
+	if err != nil {
+		return false, err
+	}
+	if reply.IsTsig() == nil {
+		return false, fmt.Errorf("unsigned reply: %s", dns.RcodeToString[reply.Rcode])
+	}
+	switch reply.Rcode {
+	case dns.RcodeNXRrset, dns.RcodeYXRrset:
+		// the record was replaced by another instance first
+		return false, nil
+	}
+	return reply.Rcode == dns.RcodeSuccess, replyError(reply)
+}
@@ -0,0 +1,90 @@
+package xform
+
+import (
+	"github.com/thyth/hive/internal/dnstest"
+
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSwapLease(t *testing.T) {
+	zone := "rdvu.example.com."
+	server := dnstest.NewServer(t, "127.0.0.1")
+	server.AddZone(zone)
+	read := func() string {
+		t.Helper()
+		value, err := ReadLease(server.Addr, dnstest.Key, zone, time.Second)
+		if err != nil {
+			t.Fatalf("unable to read lease: %v", err)
+		}
+		return value
+	}
+	swap := func(previous, value string, expected bool) {
+		t.Helper()
+		swapped, err := SwapLease(server.Addr, dnstest.Key, zone, previous, value, time.Second)
+		if err != nil {
+			t.Fatalf("unable to swap lease '%s' for '%s': %v", previous, value, err)
+		}
+		if swapped != expected {
+			t.Fatalf("expected swapping lease '%s' for '%s' to be %v", previous, value, expected)
+		}
+	}
+
+	if value := read(); value != "" {
+		t.Fatalf("expected no lease, got '%s'", value)
+	}
+	swap("", "a 1", true)
+	// the lease is no longer absent, nor does it hold another value
+	swap("", "b 1", false)
+	swap("b 0", "b 1", false)
+	if value := read(); value != "a 1" {
+		t.Fatalf("expected lease 'a 1', got '%s'", value)
+	}
+	swap("a 1", "a 2", true)
+	swap("a 2", "", true)
+	if value := read(); value != "" {
+		t.Fatalf("expected the lease removed, got '%s'", value)
+	}
+	if records := server.Records(zone); len(records) != 0 {
+		t.Errorf("expected no records left, got %q", records)
+	}
+}
+
+func TestSwapLeaseRace(t *testing.T) {
+	zone := "rdvu.example.com."
+	server := dnstest.NewServer(t, "127.0.0.1")
+	server.AddZone(zone)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	acquired := 0
+	for _, id := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			swapped, err := SwapLease(server.Addr, dnstest.Key, zone, "", id+" 1", time.Second)
+			if err != nil {
+				t.Errorf("unable to swap lease: %v", err)
+			}
+			if swapped {
+				mutex.Lock()
+				acquired++
+				mutex.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	if acquired != 1 {
+		t.Errorf("expected one instance to acquire the lease, %d did", acquired)
+	}
+}
+
+func TestReadLeaseUnsigned(t *testing.T) {
+	server := dnstest.NewServer(t, "127.0.0.1")
+	server.AddZone("rdvu.example.com.")
+	key := *dnstest.Key
+	key.Key = "b3RoZXJvdGhlcm90aGVyb3RoZXI="
+	if _, err := ReadLease(server.Addr, &key, "rdvu.example.com.", time.Second); err == nil {
+		t.Errorf("lease was read with a key the server does not hold")
+	}
+}
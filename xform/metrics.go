@@ -0,0 +1,49 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/metrics"
+
+	"strings"
+	"time"
+)
+
+var (
+	updatesWritten = metrics.Default.NewCounter("hive_updates_written_total",
+		"RFC2136 updates written to a DNS server, by zone and response code (or error, if there was no valid reply).",
+		"zone", "rcode")
+	transferDuration = metrics.Default.NewHistogram("hive_transfer_duration_seconds",
+		"Duration of zone transfers, by zone and result.", metrics.DurationBuckets, "zone", "result")
+	transferRecords = metrics.Default.NewGauge("hive_transfer_records",
+		"Address and CNAME records received by the last successful transfer of a zone.", "zone")
+	inboundUpdates = metrics.Default.NewCounter("hive_inbound_updates_total",
+		"RFC2136 updates received, by proposer address and response code.", "proposer", "rcode")
+	tsigFailures = metrics.Default.NewCounter("hive_tsig_failures_total",
+		"Requests whose TSIG signature failed validation, by TSIG error.", "error")
+	unsignedRequests = metrics.Default.NewCounter("hive_unsigned_requests_total",
+		"Requests refused for lacking a TSIG signature, by opcode.", "opcode")
+)
+
+// recordWrite counts an update written to a DNS server by its outcome.
+func recordWrite(msg *dns.Msg, reply *dns.Msg, err error) {
+	zone := ""
+	if len(msg.Question) > 0 {
+		zone = strings.ToLower(msg.Question[0].Name)
+	}
+	if err != nil || reply == nil {
+		updatesWritten.Inc(zone, "error")
+		return
+	}
+	updatesWritten.Inc(zone, dns.RcodeToString[reply.Rcode])
+}
+
+// recordTransfer observes the duration (and if successful, the size) of a zone transfer.
+func recordTransfer(zoneName string, started time.Time, zone *Zone, err error) {
+	zoneName = strings.ToLower(dns.Fqdn(zoneName))
+	if err != nil {
+		transferDuration.Observe(time.Since(started).Seconds(), zoneName, "error")
+		return
+	}
+	transferDuration.Observe(time.Since(started).Seconds(), zoneName, "success")
+	transferRecords.Set(float64(len(zone.ARecords)+len(zone.CNAMERecords)), zoneName)
+}
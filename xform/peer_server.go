@@ -3,16 +3,18 @@ package xform
 import (
 	"github.com/miekg/dns"
 	"github.com/thyth/hive/conf"
+	"github.com/thyth/hive/logging"
 
+	"context"
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
-type CNAMECallback func(proposer net.Addr, name string, target string)
-type ACallback func(proposer net.Addr, name string, target net.IP)
-type SerialCallback func(zone string) uint32
-type TransferCallback func(zone string) []*Mapping
+var serverLog = logging.For("server")
 
 type Mapping struct {
 	Name   string
@@ -20,178 +22,745 @@ type Mapping struct {
 	IP     net.IP
 }
 
-type PeerCallbacks struct {
-	CNAME    CNAMECallback
-	A        ACallback
-	AAAA     ACallback
-	Serial   SerialCallback
-	Transfer TransferCallback
+// ZoneBackend holds the zone data Hive serves, and receives the changes its peers (and/or DHCP servers) send.
+type ZoneBackend interface {
+	// Propose records a mapping proposed by an RFC2136 update.
+	Propose(proposer net.Addr, mapping *Mapping)
+	// Delete removes the records of a name proposed for deletion by an RFC2136 update: all of them for dns.TypeANY,
+	// otherwise those of one type. If the mapping holds a value, only a record holding that value is removed.
+	Delete(proposer net.Addr, rrtype uint16, mapping *Mapping)
+	// Serial provides the SOA serial number of a zone.
+	Serial(zone string) uint32
+	// Transfer provides a consistent snapshot of the records of a zone, and the serial of the version they belong to.
+	Transfer(zone string) *ZoneSnapshot
+	// Lookup provides the record of a name in a zone, or nil if the zone holds none, without copying the whole zone.
+	Lookup(zone, name string) *Mapping
+	// Records provides the current contents of the zone associated with a proposer, against which RFC2136 update
+	// prerequisites are evaluated.
+	Records(proposer net.Addr) []*Mapping
+	// Notify signals that a zone has changed on its server per an RFC1996 notification.
+	Notify(proposer net.Addr, zone string)
+	// Peers provides the current peers, whose zones are served alongside the local and rendezvous zones.
+	Peers() []*conf.ZonePeer
 }
 
-func StartServer(config *conf.Configuration, key *conf.TsigKey, callbacks *PeerCallbacks) {
+// Server is a running set of DNS listeners serving Hive's peers.
+type Server struct {
+	servers []*dns.Server
+	key     *conf.TsigKey
+	backend ZoneBackend
+
+	mutex    sync.Mutex
+	config   *conf.Configuration
+	closing  bool
+	stopped  int            // listeners that stopped serving other than by shutdown
+	inflight sync.WaitGroup // requests being handled, including zone transfers and the updates they trigger
+}
+
+// StartServer binds every configured listen address and network, reporting any failure to do so, and begins serving
+// requests on them in the background.
+func StartServer(config *conf.Configuration, key *conf.TsigKey, backend ZoneBackend) (*Server, error) {
+	return startServer(config, key, backend, nil)
+}
+
+// Rebind starts a server in place of this one, for a configuration listening on other addresses or networks. The
+// listeners of addresses and networks this server also has share its sockets (so requests to them are served
+// throughout), and the others are bound anew. This server continues to serve until shut down, which the caller does
+// once the new server has started; if it cannot be, this server is unaffected.
+func (s *Server) Rebind(config *conf.Configuration) (*Server, error) {
+	inherited := map[string]*dns.Server{}
+	for _, dnsServer := range s.servers {
+		inherited[dnsServer.Net+" "+dnsServer.Addr] = dnsServer
+	}
+	return startServer(config, s.key, s.backend, inherited)
+}
+
+func startServer(config *conf.Configuration, key *conf.TsigKey, backend ZoneBackend,
+	inherited map[string]*dns.Server) (*Server, error) {
 	tsig := map[string]string{key.ZoneName: key.Key}
+	server := &Server{
+		key:     key,
+		backend: backend,
+		config:  config,
+	}
+	// each server has its own mux, so that several may coexist in one process
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", server.track(handlerGenerator(server.currentConfig, key, backend)))
+
+	// run each configured network (usually both UDP and TCP, since TCP is usually used for zone transfers) on every
+	// listen address
+	for _, address := range config.ListenAddresses {
+		for _, network := range config.ListenNetworks {
+			dnsServer := &dns.Server{
+				Addr:          address.String(),
+				Net:           network,
+				Handler:       mux,
+				TsigSecret:    tsig,
+				MsgAcceptFunc: acceptUpdates,
+			}
+			// bind synchronously, so failures are reported to the caller
+			if err := listen(dnsServer, inherited[network+" "+dnsServer.Addr]); err != nil {
+				server.close()
+				return nil, fmt.Errorf("failed to listen on %s %s: %v", network, dnsServer.Addr, err)
+			}
+
+			started := make(chan struct{})
+			dnsServer.NotifyStartedFunc = func() {
+				close(started)
+			}
+			served := make(chan error, 1)
+			go func() {
+				served <- dnsServer.ActivateAndServe()
+			}()
+			select {
+			case <-started:
+			case err := <-served:
+				server.close()
+				return nil, fmt.Errorf("failed to serve on %s %s: %v", network, dnsServer.Addr, err)
+			}
+			server.servers = append(server.servers, dnsServer)
+			go func() {
+				if err := <-served; err != nil {
+					serverLog.Error("listener stopped", "network", dnsServer.Net, logging.Address, dnsServer.Addr,
+						logging.Error, err)
+					server.mutex.Lock()
+					if !server.closing {
+						server.stopped++
+					}
+					server.mutex.Unlock()
+				}
+			}()
+		}
+	}
+
+	return server, nil
+}
+
+// filer is implemented by the listeners and packet connections whose socket can be duplicated.
+type filer interface {
+	File() (*os.File, error)
+}
 
-	// run both UDP and TCP, since TCP is usually used for zone transfers
-	serverUdp := &dns.Server{
-		Addr:       config.BindAddress.String() + ":53",
-		Net:        "udp",
-		TsigSecret: tsig,
+// listen binds the listener (for TCP) or packet connection (for UDP) of a DNS server, sharing the socket of an
+// inherited server of the same address and network if there is one, otherwise binding anew.
+func listen(dnsServer, inherited *dns.Server) error {
+	tcp := strings.HasPrefix(dnsServer.Net, "tcp")
+	if inherited != nil {
+		var socket interface{} = inherited.PacketConn
+		if tcp {
+			socket = inherited.Listener
+		}
+		if f, ok := socket.(filer); ok {
+			if file, err := f.File(); err == nil {
+				defer file.Close()
+				if tcp {
+					dnsServer.Listener, err = net.FileListener(file)
+				} else {
+					dnsServer.PacketConn, err = net.FilePacketConn(file)
+				}
+				if err == nil {
+					return nil
+				}
+			}
+		}
+		// e.g. the inherited listener stopped, or its socket cannot be duplicated on this platform
+		serverLog.Debug("unable to share socket; binding anew", "network", dnsServer.Net,
+			logging.Address, dnsServer.Addr)
 	}
-	serverTcp := &dns.Server{
-		Addr:       config.BindAddress.String() + ":53",
-		Net:        "tcp",
-		TsigSecret: tsig,
+	var err error
+	if tcp {
+		dnsServer.Listener, err = net.Listen(dnsServer.Net, dnsServer.Addr)
+	} else {
+		dnsServer.PacketConn, err = net.ListenPacket(dnsServer.Net, dnsServer.Addr)
 	}
+	return err
+}
 
-	go func() {
-		if err := serverUdp.ListenAndServe(); err != nil {
-			panic(err)
+// track wraps a handler to account for requests in flight, and refuse those that arrive while shutting down.
+func (s *Server) track(handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, request *dns.Msg) {
+		s.mutex.Lock()
+		if s.closing {
+			s.mutex.Unlock()
+			msg := &dns.Msg{}
+			msg.SetRcode(request, dns.RcodeRefused)
+			w.WriteMsg(msg)
+			return
 		}
-	}()
-	go func() {
-		if err := serverTcp.ListenAndServe(); err != nil {
-			panic(err)
+		s.inflight.Add(1)
+		s.mutex.Unlock()
+		defer s.inflight.Done()
+		handler(w, request)
+	}
+}
+
+// SetConfig replaces the configuration requests are served with, other than the listen addresses and networks (which
+// are only bound by StartServer or Rebind).
+func (s *Server) SetConfig(config *conf.Configuration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config = config
+}
+
+// Serving reports whether every listener is serving requests: none has stopped, and the server is not shutting down.
+func (s *Server) Serving() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.closing && s.stopped == 0
+}
+
+func (s *Server) currentConfig() *conf.Configuration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.config
+}
+
+// close releases listeners that were bound but not yet served.
+func (s *Server) close() {
+	for _, dnsServer := range s.servers {
+		dnsServer.Shutdown()
+	}
+}
+
+// Shutdown stops accepting requests on all listeners, then waits for requests in flight (including zone transfers and
+// any updates they triggered) to complete, or for the context to expire.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closing = true
+	s.mutex.Unlock()
+
+	var shutdownErr error
+	for _, dnsServer := range s.servers {
+		if err := dnsServer.ShutdownContext(ctx); err != nil && shutdownErr == nil {
+			shutdownErr = err
 		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
 	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return shutdownErr
+}
 
-	dns.HandleFunc(".", handlerGenerator(config, key, callbacks))
+// acceptUpdates extends the default message acceptance (which refuses the UPDATE opcode outright) to pass RFC2136
+// updates through to the handler, where the zone, prerequisite and update sections are validated.
+func acceptUpdates(dh dns.Header) dns.MsgAcceptAction {
+	const qrBit = 1 << 15
+	if dh.Bits&qrBit != 0 {
+		return dns.MsgIgnore
+	}
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
 }
 
-func handlerGenerator(config *conf.Configuration, key *conf.TsigKey, callbacks *PeerCallbacks) func(dns.ResponseWriter, *dns.Msg) {
+func handlerGenerator(currentConfig func() *conf.Configuration, key *conf.TsigKey, backend ZoneBackend) func(dns.ResponseWriter, *dns.Msg) {
 	return func(w dns.ResponseWriter, request *dns.Msg) {
-		msg := &dns.Msg{}
-		msg.SetReply(request)
-
-		// if tsig is absent or invalid...
-		if request.IsTsig() == nil || w.TsigStatus() != nil {
-			// ... abort further processing
+		config := currentConfig()
+		// if tsig is absent, refuse the request by policy (unless it is an ordinary query and Hive is configured to
+		// answer those); if invalid, report the specific TSIG error unsigned
+		if request.IsTsig() == nil {
+			if config.AnswerQueries && isStandardQuery(request) {
+				msg := &dns.Msg{}
+				msg.SetReply(request)
+				answerQuery(msg, w, request, config, backend)
+				w.WriteMsg(msg)
+				return
+			}
+			msg := &dns.Msg{}
+			msg.SetRcode(request, dns.RcodeRefused)
 			w.WriteMsg(msg)
+			// anyone can send these (e.g. scanners), so they are counted rather than audited
+			unsignedRequests.Inc(opcodeName(request))
+			serverLog.Debug("unsigned request refused", logging.Proposer, w.RemoteAddr().String(), "opcode",
+				opcodeName(request))
+			return
+		}
+		if err := w.TsigStatus(); err != nil {
+			tsigFailures.Inc(tsigErrorName(err))
+			serverLog.Warn("TSIG validation failed", logging.Proposer, w.RemoteAddr().String(),
+				logging.Rcode, tsigErrorName(err), logging.Error, err)
+			auditRejection(w, request, tsigErrorName(err),
+				fmt.Sprintf("TSIG validation of %s failed: %v", opcodeName(request), err))
+			writeTsigError(w, request, err)
 			return
 		}
 
-		if request.Opcode == dns.OpcodeUpdate {
-			// add/delete records
-			validZoneUpdate := false
-			for _, question := range request.Question {
-				if question.Qtype == dns.TypeSOA {
-					validZoneUpdate = true
-				}
+		switch request.Opcode {
+		case dns.OpcodeUpdate:
+			handleUpdate(w, request, config, key, backend)
+		case dns.OpcodeQuery:
+			handleQuery(w, request, config, key, backend)
+		case dns.OpcodeNotify:
+			handleNotify(w, request, key, backend)
+		default:
+			msg := &dns.Msg{}
+			msg.SetRcode(request, dns.RcodeNotImplemented)
+			writeSigned(w, msg, key)
+		}
+	}
+}
+
+// writeSigned signs a reply with the shared key before writing it.
+func writeSigned(w dns.ResponseWriter, msg *dns.Msg, key *conf.TsigKey) {
+	msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
+	w.WriteMsg(msg)
+}
+
+// writeTsigError replies NOTAUTH to a request whose TSIG failed validation. Per RFC8945 the reply is not signed, and
+// the TSIG error is carried in a TSIG record with an empty MAC.
+func writeTsigError(w dns.ResponseWriter, request *dns.Msg, tsigErr error) {
+	msg := &dns.Msg{}
+	msg.SetRcode(request, dns.RcodeNotAuth)
+	tsig := request.IsTsig()
+	errorCode := tsigErrorCode(tsigErr)
+	timeSigned := tsig.TimeSigned
+	if errorCode == dns.RcodeBadTime {
+		timeSigned = uint64(time.Now().Unix())
+	}
+	msg.Extra = append(msg.Extra, &dns.TSIG{
+		Hdr: dns.RR_Header{
+			Name:   tsig.Hdr.Name,
+			Rrtype: dns.TypeTSIG,
+			Class:  dns.ClassANY,
+		},
+		Algorithm:  tsig.Algorithm,
+		TimeSigned: timeSigned,
+		Fudge:      tsig.Fudge,
+		OrigId:     request.Id,
+		Error:      errorCode,
+	})
+	if data, err := msg.Pack(); err == nil {
+		w.Write(data)
+	}
+}
+
+// tsigErrorCode maps a TSIG validation error to the TSIG error code reported for it.
+func tsigErrorCode(tsigErr error) uint16 {
+	switch tsigErr {
+	case dns.ErrSecret:
+		return dns.RcodeBadKey
+	case dns.ErrTime:
+		return dns.RcodeBadTime
+	}
+	return dns.RcodeBadSig
+}
+
+// tsigErrorName names a TSIG validation error by its TSIG error code, e.g. BADSIG.
+func tsigErrorName(tsigErr error) string {
+	return dns.RcodeToString[int(tsigErrorCode(tsigErr))]
+}
+
+// servedZones lists the zones Hive is authoritative for: the local zone, the rendezvous zone, and the zone of each
+// configured or discovered peer.
+func servedZones(config *conf.Configuration, backend ZoneBackend) []string {
+	suffixes := []string{config.LocalZone.Suffix, config.SearchSuffix}
+	for _, peer := range backend.Peers() {
+		suffixes = append(suffixes, peer.Suffix)
+	}
+	return suffixes
+}
+
+// servesZone determines whether a zone name is one that Hive is authoritative for.
+func servesZone(config *conf.Configuration, backend ZoneBackend, zone string) bool {
+	for _, suffix := range servedZones(config, backend) {
+		if strings.EqualFold(dns.Fqdn(suffix), dns.Fqdn(zone)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrType returns the DNS record type a mapping represents.
+func rrType(mapping *Mapping) uint16 {
+	if mapping.IP == nil {
+		return dns.TypeCNAME
+	} else if mapping.IP.To4() != nil {
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
+
+// rrValue returns a comparable representation of the data held by an A, AAAA, or CNAME record.
+func rrValue(rr dns.RR) (string, bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String(), true
+	case *dns.AAAA:
+		return rr.AAAA.String(), true
+	case *dns.CNAME:
+		return strings.ToLower(rr.Target), true
+	}
+	return "", false
+}
+
+// mappingValue returns the same comparable representation as rrValue for a mapping.
+func mappingValue(mapping *Mapping) string {
+	if mapping.IP != nil {
+		return mapping.IP.String()
+	}
+	return strings.ToLower(mapping.Target)
+}
+
+// checkPrerequisites evaluates the prerequisite section of an RFC2136 update (section 3.2) against the records of the
+// proposer's zone, returning the RCODE that should terminate processing, or NOERROR if all prerequisites are met.
+func checkPrerequisites(zone string, prerequisites []dns.RR, records []*Mapping) int {
+	nameUsed := func(name string) bool {
+		for _, record := range records {
+			if strings.EqualFold(record.Name, name) {
+				return true
 			}
-			if validZoneUpdate {
-				for _, authority := range request.Ns {
-					proposerHost, _, err := net.SplitHostPort(w.RemoteAddr().String())
-					if err != nil {
-						continue
-					}
-					proposer := &net.IPAddr{IP: net.ParseIP(proposerHost)}
-
-					switch authority := authority.(type) {
-					case *dns.CNAME:
-						if callbacks != nil && callbacks.CNAME != nil {
-							callbacks.CNAME(proposer, authority.Hdr.Name, authority.Target)
-						}
-					case *dns.A:
-						if callbacks != nil && callbacks.A != nil {
-							callbacks.A(proposer, authority.Hdr.Name, authority.A)
-						}
-					case *dns.AAAA:
-						if callbacks != nil && callbacks.AAAA != nil {
-							callbacks.AAAA(proposer, authority.Hdr.Name, authority.AAAA)
-						}
-					}
+		}
+		return false
+	}
+	rrset := func(name string, rrtype uint16) map[string]bool {
+		values := map[string]bool{}
+		for _, record := range records {
+			if strings.EqualFold(record.Name, name) && rrType(record) == rrtype {
+				values[mappingValue(record)] = true
+			}
+		}
+		return values
+	}
+
+	// value dependent prerequisites are accumulated per RRset, and compared after all others are checked
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	expected := map[rrsetKey]map[string]bool{}
+
+	for _, rr := range prerequisites {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if !nameUsed(hdr.Name) {
+					return dns.RcodeNameError
 				}
-				// sign the reply
-				msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
-			}
-		} else if request.Opcode == dns.OpcodeQuery {
-			// zone transfers
-			for _, question := range request.Question {
-				if question.Qclass == dns.ClassINET &&
-					question.Qtype == dns.TypeAXFR {
-					zone := question.Name
-					var records []*Mapping
-					if callbacks != nil && callbacks.Transfer != nil {
-						records = callbacks.Transfer(zone)
-					}
-					if len(records) == 0 {
-						// not authoritative for this zone
-						continue
-					}
-					fmt.Printf("Transferring zone '%v'\n", zone)
-					ch := make(chan *dns.Envelope)
-					tr := &dns.Transfer{}
-					go tr.Out(w, request, ch)
-					soa := &dns.SOA{
-						Hdr: dns.RR_Header{
-							Name:   zone,
-							Rrtype: dns.TypeSOA,
-							Class:  dns.ClassINET,
-							Ttl:    config.TTL,
-						},
-						Ns:      "ns." + zone,
-						Mbox:    "ns." + zone,
-						Serial:  callbacks.Serial(zone),
-						Refresh: config.TTL,
-						Retry:   config.TTL / 10,
-						Expire:  config.TTL * 2,
-						Minttl:  config.TTL * 2,
-					}
-					ch <- &dns.Envelope{RR: []dns.RR{
-						soa,
-						&dns.A{
-							Hdr: dns.RR_Header{
-								Name:   "ns." + zone,
-								Rrtype: dns.TypeA,
-								Class:  dns.ClassINET,
-								Ttl:    config.TTL,
-							},
-							A: net.ParseIP(config.BindAddress.String()),
-						},
-					}}
-					// send records from callback
-					for _, record := range records {
-						var rr dns.RR
-						if record.IP != nil {
-							if len(record.IP) == net.IPv4len {
-								rr = &dns.A{
-									Hdr: dns.RR_Header{
-										Name:   record.Name,
-										Rrtype: dns.TypeA,
-										Class:  dns.ClassINET,
-										Ttl:    config.TTL,
-									},
-									A: record.IP,
-								}
-							} else {
-								rr = &dns.AAAA{
-									Hdr: dns.RR_Header{
-										Name:   record.Name,
-										Rrtype: dns.TypeAAAA,
-										Class:  dns.ClassINET,
-										Ttl:    config.TTL,
-									},
-									AAAA: record.IP,
-								}
-							}
-						} else {
-							rr = &dns.CNAME{
-								Hdr: dns.RR_Header{
-									Name:   record.Name,
-									Rrtype: dns.TypeCNAME,
-									Class:  dns.ClassINET,
-									Ttl:    config.TTL,
-								},
-								Target: record.Target,
-							}
-						}
-						ch <- &dns.Envelope{RR: []dns.RR{rr}}
-					}
-					ch <- &dns.Envelope{RR: []dns.RR{soa}}
-					close(ch)
-					w.Hijack()
+			} else if len(rrset(hdr.Name, hdr.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if nameUsed(hdr.Name) {
+					return dns.RcodeYXDomain
 				}
+			} else if len(rrset(hdr.Name, hdr.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := rrsetKey{name: strings.ToLower(hdr.Name), rrtype: hdr.Rrtype}
+			if expected[key] == nil {
+				expected[key] = map[string]bool{}
+			}
+			value, known := rrValue(rr)
+			if !known {
+				// Hive holds no records of this type, so this RRset can never exist
+				return dns.RcodeNXRrset
+			}
+			expected[key][value] = true
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for key, values := range expected {
+		actual := rrset(key.name, key.rrtype)
+		if len(actual) != len(values) {
+			return dns.RcodeNXRrset
+		}
+		for value := range values {
+			if !actual[value] {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescanUpdates validates the update section of an RFC2136 update (section 3.4.1.3) before any of it is applied.
+func prescanUpdates(zone string, updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			switch hdr.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			switch hdr.Rrtype {
+			case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			switch hdr.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func handleUpdate(w dns.ResponseWriter, request *dns.Msg, config *conf.Configuration, key *conf.TsigKey, backend ZoneBackend) {
+	msg := &dns.Msg{}
+	msg.SetReply(request)
+
+	proposerHost, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		inboundUpdates.Inc("unknown", dns.RcodeToString[dns.RcodeServerFailure])
+		msg.Rcode = dns.RcodeServerFailure
+		writeSigned(w, msg, key)
+		return
+	}
+	proposer := &net.IPAddr{IP: net.ParseIP(proposerHost)}
+	reason := ""
+	defer func() {
+		inboundUpdates.Inc(proposer.String(), dns.RcodeToString[msg.Rcode])
+		if msg.Rcode != dns.RcodeSuccess {
+			zone := ""
+			if len(request.Question) > 0 {
+				zone = request.Question[0].Name
+			}
+			serverLog.Warn("update rejected", logging.Proposer, proposer.String(), logging.Zone, zone,
+				logging.Rcode, dns.RcodeToString[msg.Rcode], "reason", reason)
+			auditRejection(w, request, dns.RcodeToString[msg.Rcode], reason)
+		}
+	}()
+
+	// the zone section must name exactly one zone, by its SOA in the internet class
+	if len(request.Question) != 1 ||
+		request.Question[0].Qtype != dns.TypeSOA ||
+		request.Question[0].Qclass != dns.ClassINET {
+		reason = "zone section does not name one zone by its SOA"
+		msg.Rcode = dns.RcodeFormatError
+		writeSigned(w, msg, key)
+		return
+	}
+	zone := request.Question[0].Name
+	if !servesZone(config, backend, zone) {
+		reason = "zone not served"
+		msg.Rcode = dns.RcodeNotAuth
+		writeSigned(w, msg, key)
+		return
+	}
+
+	// prerequisites are carried in the answer section
+	if rcode := checkPrerequisites(zone, request.Answer, backend.Records(proposer)); rcode != dns.RcodeSuccess {
+		reason = "prerequisites not satisfied"
+		msg.Rcode = rcode
+		writeSigned(w, msg, key)
+		return
+	}
+
+	// updates are carried in the authority section
+	if rcode := prescanUpdates(zone, request.Ns); rcode != dns.RcodeSuccess {
+		reason = "updates invalid for the zone"
+		msg.Rcode = rcode
+		writeSigned(w, msg, key)
+		return
+	}
+	for _, update := range request.Ns {
+		hdr := update.Header()
+		switch hdr.Class {
+		case dns.ClassINET:
+			if mapping := rrMapping(update); mapping != nil {
+				auditProposal(proposer, request, zone, "add", hdr.Rrtype, mapping)
+				backend.Propose(proposer, mapping)
+			}
+		case dns.ClassANY:
+			// delete an RRset, or all RRsets of a name
+			auditProposal(proposer, request, zone, "delete", hdr.Rrtype, &Mapping{Name: hdr.Name})
+			backend.Delete(proposer, hdr.Rrtype, &Mapping{Name: hdr.Name})
+		case dns.ClassNONE:
+			// delete an RR from an RRset
+			if mapping := rrMapping(update); mapping != nil {
+				auditProposal(proposer, request, zone, "delete", hdr.Rrtype, mapping)
+				backend.Delete(proposer, hdr.Rrtype, mapping)
 			}
 		}
-		w.WriteMsg(msg)
 	}
+	writeSigned(w, msg, key)
+}
+
+// rrMapping converts an A, AAAA, or CNAME record into the equivalent mapping, or nil for records of other types.
+func rrMapping(rr dns.RR) *Mapping {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return &Mapping{Name: rr.Hdr.Name, IP: rr.A}
+	case *dns.AAAA:
+		return &Mapping{Name: rr.Hdr.Name, IP: rr.AAAA}
+	case *dns.CNAME:
+		return &Mapping{Name: rr.Hdr.Name, Target: rr.Target}
+	}
+	return nil
+}
+
+// handleNotify acknowledges an RFC1996 notification that a zone has changed, then hands it to the backend (which will
+// usually transfer the zone again).
+func handleNotify(w dns.ResponseWriter, request *dns.Msg, key *conf.TsigKey, backend ZoneBackend) {
+	msg := &dns.Msg{}
+	msg.SetReply(request)
+	if len(request.Question) != 1 || request.Question[0].Qtype != dns.TypeSOA {
+		msg.Rcode = dns.RcodeFormatError
+		writeSigned(w, msg, key)
+		return
+	}
+	msg.Authoritative = true
+	writeSigned(w, msg, key)
+
+	proposerHost, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	backend.Notify(&net.IPAddr{IP: net.ParseIP(proposerHost)}, request.Question[0].Name)
+}
+
+func handleQuery(w dns.ResponseWriter, request *dns.Msg, config *conf.Configuration, key *conf.TsigKey, backend ZoneBackend) {
+	msg := &dns.Msg{}
+	msg.SetReply(request)
+
+	// zone digests for anti-entropy between peers
+	if len(request.Question) == 1 && isDigestQuery(request.Question[0]) {
+		handleDigestQuery(msg, w, request, config, backend)
+		writeSigned(w, msg, key)
+		return
+	}
+
+	// zone transfers
+	for _, question := range request.Question {
+		if question.Qclass == dns.ClassINET &&
+			question.Qtype == dns.TypeAXFR {
+			zone := question.Name
+			snapshot := &ZoneSnapshot{}
+			if servesZone(config, backend, zone) {
+				snapshot = backend.Transfer(zone)
+			}
+			if len(snapshot.Mappings) == 0 {
+				// not authoritative for this zone
+				msg.Rcode = dns.RcodeNotAuth
+				continue
+			}
+			serverLog.Debug("transferring zone", logging.Zone, zone, logging.Proposer, w.RemoteAddr().String())
+			soa := zoneSOA(config, zone, snapshot.Serial)
+			envelopes := []*dns.Envelope{{RR: append([]dns.RR{soa}, nameserverGlue(config, zone)...)}}
+			// send records from backend
+			for _, record := range snapshot.Mappings {
+				envelopes = append(envelopes, &dns.Envelope{RR: []dns.RR{mappingRR(record, config.TTL)}})
+			}
+			envelopes = append(envelopes, &dns.Envelope{RR: []dns.RR{soa}})
+			// buffer the whole transfer, so an aborted transfer never blocks this handler
+			ch := make(chan *dns.Envelope, len(envelopes))
+			for _, envelope := range envelopes {
+				ch <- envelope
+			}
+			close(ch)
+			// write the transfer within this handler, so it is accounted for as in flight until complete
+			tr := &dns.Transfer{}
+			if err := tr.Out(w, request, ch); err != nil {
+				serverLog.Warn("transfer of zone failed", logging.Zone, zone, logging.Proposer,
+					w.RemoteAddr().String(), logging.Error, err)
+			}
+			return
+		}
+	}
+	if config.AnswerQueries {
+		answerQuery(msg, w, request, config, backend)
+	}
+	writeSigned(w, msg, key)
+}
+
+// zoneSOA synthesizes the SOA record for a zone Hive serves, at a serial.
+func zoneSOA(config *conf.Configuration, zone string, serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    config.TTL,
+		},
+		Ns:      "ns." + zone,
+		Mbox:    "ns." + zone,
+		Serial:  serial,
+		Refresh: config.TTL,
+		Retry:   config.TTL / 10,
+		Expire:  config.TTL * 2,
+		Minttl:  config.TTL * 2,
+	}
+}
+
+// nameserverMappings synthesizes the addresses of the "ns" host named by a zone's SOA, pointing at each specific address
+// Hive listens on.
+func nameserverMappings(config *conf.Configuration, zone string) []*Mapping {
+	var mappings []*Mapping
+	for _, address := range config.ListenAddresses {
+		ip := conf.AddrIP(address)
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		mappings = append(mappings, &Mapping{
+			Name: "ns." + zone,
+			IP:   ip,
+		})
+	}
+	return mappings
+}
+
+// nameserverGlue synthesizes the address records of the "ns" host named by a zone's SOA.
+func nameserverGlue(config *conf.Configuration, zone string) []dns.RR {
+	var glue []dns.RR
+	for _, mapping := range nameserverMappings(config, zone) {
+		glue = append(glue, mappingRR(mapping, config.TTL))
+	}
+	return glue
+}
+
+// mappingRR converts a mapping into the equivalent internet class A, AAAA, or CNAME record.
+func mappingRR(mapping *Mapping, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{
+		Name:   mapping.Name,
+		Rrtype: rrType(mapping),
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	switch hdr.Rrtype {
+	case dns.TypeA:
+		return &dns.A{Hdr: hdr, A: mapping.IP}
+	case dns.TypeAAAA:
+		return &dns.AAAA{Hdr: hdr, AAAA: mapping.IP}
+	}
+	return &dns.CNAME{Hdr: hdr, Target: mapping.Target}
 }
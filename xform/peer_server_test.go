@@ -0,0 +1,363 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/internal/dnstest"
+
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testZone = "west.example.com."
+
+// testRR parses a record in zone file format, failing the test if it is invalid.
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("invalid record '%s': %v", s, err)
+	}
+	return rr
+}
+
+// wireSections packs and unpacks an update, so that its sections hold records as received (e.g. with the RDLENGTH set).
+func wireSections(t *testing.T, msg *dns.Msg) *dns.Msg {
+	t.Helper()
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("unable to pack update: %v", err)
+	}
+	unpacked := &dns.Msg{}
+	if err := unpacked.Unpack(packed); err != nil {
+		t.Fatalf("unable to unpack update: %v", err)
+	}
+	return unpacked
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	records := []*Mapping{
+		{Name: "foo.west.example.com.", IP: net.ParseIP("10.0.0.1")},
+		{Name: "bar.west.example.com.", IP: net.ParseIP("fd00::1")},
+		{Name: "baz.west.example.com.", Target: "foo.west.example.com."},
+	}
+	tests := []struct {
+		name    string
+		prepare func(msg *dns.Msg)
+		rcode   int
+	}{
+		{"none", func(msg *dns.Msg) {}, dns.RcodeSuccess},
+		{"name in use", func(msg *dns.Msg) {
+			msg.NameUsed([]dns.RR{testRR(t, "FOO.west.example.com. A 10.0.0.1")})
+		}, dns.RcodeSuccess},
+		{"name in use absent", func(msg *dns.Msg) {
+			msg.NameUsed([]dns.RR{testRR(t, "qux.west.example.com. A 10.0.0.1")})
+		}, dns.RcodeNameError},
+		{"name not in use", func(msg *dns.Msg) {
+			msg.NameNotUsed([]dns.RR{testRR(t, "qux.west.example.com. A 10.0.0.1")})
+		}, dns.RcodeSuccess},
+		{"name not in use present", func(msg *dns.Msg) {
+			msg.NameNotUsed([]dns.RR{testRR(t, "baz.west.example.com. A 10.0.0.1")})
+		}, dns.RcodeYXDomain},
+		{"rrset exists", func(msg *dns.Msg) {
+			msg.RRsetUsed([]dns.RR{testRR(t, "bar.west.example.com. AAAA fd00::2")})
+		}, dns.RcodeSuccess},
+		{"rrset exists of another type", func(msg *dns.Msg) {
+			msg.RRsetUsed([]dns.RR{testRR(t, "bar.west.example.com. A 10.0.0.1")})
+		}, dns.RcodeNXRrset},
+		{"rrset does not exist", func(msg *dns.Msg) {
+			msg.RRsetNotUsed([]dns.RR{testRR(t, "foo.west.example.com. CNAME baz.west.example.com.")})
+		}, dns.RcodeSuccess},
+		{"rrset does not exist present", func(msg *dns.Msg) {
+			msg.RRsetNotUsed([]dns.RR{testRR(t, "baz.west.example.com. CNAME baz.west.example.com.")})
+		}, dns.RcodeYXRrset},
+		{"rrset exists with value", func(msg *dns.Msg) {
+			msg.Used([]dns.RR{testRR(t, "baz.west.example.com. CNAME FOO.west.example.com.")})
+		}, dns.RcodeSuccess},
+		{"rrset exists with another value", func(msg *dns.Msg) {
+			msg.Used([]dns.RR{testRR(t, "foo.west.example.com. A 10.0.0.2")})
+		}, dns.RcodeNXRrset},
+		{"rrset exists with more values", func(msg *dns.Msg) {
+			msg.Used([]dns.RR{
+				testRR(t, "foo.west.example.com. A 10.0.0.1"),
+				testRR(t, "foo.west.example.com. A 10.0.0.2"),
+			})
+		}, dns.RcodeNXRrset},
+		{"rrset exists of a type Hive does not hold", func(msg *dns.Msg) {
+			msg.Used([]dns.RR{testRR(t, "foo.west.example.com. TXT value")})
+		}, dns.RcodeNXRrset},
+		{"outside the zone", func(msg *dns.Msg) {
+			msg.NameUsed([]dns.RR{testRR(t, "foo.east.example.com. A 10.0.0.1")})
+		}, dns.RcodeNotZone},
+		{"nonzero ttl", func(msg *dns.Msg) {
+			msg.Answer = append(msg.Answer, testRR(t, "foo.west.example.com. 300 IN A 10.0.0.1"))
+		}, dns.RcodeFormatError},
+		{"rdata with class any", func(msg *dns.Msg) {
+			rr := testRR(t, "foo.west.example.com. 0 IN A 10.0.0.1")
+			rr.Header().Class = dns.ClassANY
+			msg.Answer = append(msg.Answer, rr)
+		}, dns.RcodeFormatError},
+		{"unexpected class", func(msg *dns.Msg) {
+			rr := testRR(t, "foo.west.example.com. 0 IN A 10.0.0.1")
+			rr.Header().Class = dns.ClassCHAOS
+			msg.Answer = append(msg.Answer, rr)
+		}, dns.RcodeFormatError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &dns.Msg{}
+			msg.SetUpdate(testZone)
+			test.prepare(msg)
+			msg = wireSections(t, msg)
+			if rcode := checkPrerequisites(testZone, msg.Answer, records); rcode != test.rcode {
+				t.Errorf("expected %s, got %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+			}
+		})
+	}
+}
+
+func TestPrescanUpdates(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(msg *dns.Msg)
+		rcode   int
+	}{
+		{"insert", func(msg *dns.Msg) {
+			msg.Insert([]dns.RR{testRR(t, "foo.west.example.com. 300 IN A 10.0.0.1")})
+		}, dns.RcodeSuccess},
+		{"delete rrset", func(msg *dns.Msg) {
+			msg.RemoveRRset([]dns.RR{testRR(t, "foo.west.example.com. A 10.0.0.1")})
+		}, dns.RcodeSuccess},
+		{"delete name", func(msg *dns.Msg) {
+			msg.RemoveName([]dns.RR{testRR(t, "foo.west.example.com. A 10.0.0.1")})
+		}, dns.RcodeSuccess},
+		{"delete record", func(msg *dns.Msg) {
+			msg.Remove([]dns.RR{testRR(t, "foo.west.example.com. A 10.0.0.1")})
+		}, dns.RcodeSuccess},
+		{"outside the zone", func(msg *dns.Msg) {
+			msg.Insert([]dns.RR{testRR(t, "foo.east.example.com. 300 IN A 10.0.0.1")})
+		}, dns.RcodeNotZone},
+		{"insert of a meta type", func(msg *dns.Msg) {
+			msg.Insert([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "foo.west.example.com.", Rrtype: dns.TypeAXFR,
+				Class: dns.ClassINET, Ttl: 300}}})
+		}, dns.RcodeFormatError},
+		{"delete rrset with ttl", func(msg *dns.Msg) {
+			msg.Ns = append(msg.Ns, &dns.ANY{Hdr: dns.RR_Header{Name: "foo.west.example.com.", Rrtype: dns.TypeA,
+				Class: dns.ClassANY, Ttl: 300}})
+		}, dns.RcodeFormatError},
+		{"delete rrset with rdata", func(msg *dns.Msg) {
+			rr := testRR(t, "foo.west.example.com. 0 IN A 10.0.0.1")
+			rr.Header().Class = dns.ClassANY
+			msg.Ns = append(msg.Ns, rr)
+		}, dns.RcodeFormatError},
+		{"delete rrset of a meta type", func(msg *dns.Msg) {
+			msg.Ns = append(msg.Ns, &dns.ANY{Hdr: dns.RR_Header{Name: "foo.west.example.com.", Rrtype: dns.TypeIXFR,
+				Class: dns.ClassANY}})
+		}, dns.RcodeFormatError},
+		{"delete record with ttl", func(msg *dns.Msg) {
+			rr := testRR(t, "foo.west.example.com. 300 IN A 10.0.0.1")
+			rr.Header().Class = dns.ClassNONE
+			msg.Ns = append(msg.Ns, rr)
+		}, dns.RcodeFormatError},
+		{"delete record of type any", func(msg *dns.Msg) {
+			msg.Ns = append(msg.Ns, &dns.ANY{Hdr: dns.RR_Header{Name: "foo.west.example.com.", Rrtype: dns.TypeANY,
+				Class: dns.ClassNONE}})
+		}, dns.RcodeFormatError},
+		{"unexpected class", func(msg *dns.Msg) {
+			rr := testRR(t, "foo.west.example.com. 300 IN A 10.0.0.1")
+			rr.Header().Class = dns.ClassCHAOS
+			msg.Ns = append(msg.Ns, rr)
+		}, dns.RcodeFormatError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &dns.Msg{}
+			msg.SetUpdate(testZone)
+			test.prepare(msg)
+			msg = wireSections(t, msg)
+			if rcode := prescanUpdates(testZone, msg.Ns); rcode != test.rcode {
+				t.Errorf("expected %s, got %s", dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+			}
+		})
+	}
+}
+
+// startTestServer serves a backend's queries on a free port of 127.0.0.1 over UDP and TCP, shutting it down when the
+// test completes.
+func startTestServer(t *testing.T, backend ZoneBackend) (*Server, *net.UDPAddr) {
+	t.Helper()
+	config := testQueryConfig()
+	listen := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: dnstest.FreePort(t, "127.0.0.1")}
+	config.ListenAddresses = []net.Addr{listen}
+	config.ListenNetworks = []string{"udp", "tcp"}
+	server, err := StartServer(config, dnstest.Key, backend)
+	if err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+	return server, listen
+}
+
+// lookupA queries a server for the addresses of a name over UDP.
+func lookupA(server net.Addr, name string) ([]string, error) {
+	request := &dns.Msg{}
+	request.SetQuestion(name, dns.TypeA)
+	client := &dns.Client{Timeout: time.Second}
+	reply, _, err := client.Exchange(request, server.String())
+	if err != nil {
+		return nil, err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("query refused with %s", dns.RcodeToString[reply.Rcode])
+	}
+	return answers(reply.Answer), nil
+}
+
+// blockingBackend holds lookups until released, signalling each as it begins.
+type blockingBackend struct {
+	*testBackend
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) Lookup(zone, name string) *Mapping {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.testBackend.Lookup(zone, name)
+}
+
+func TestStartServerBindError(t *testing.T) {
+	// a TCP listener already on the port keeps the server from binding it, which is reported synchronously
+	port := dnstest.FreePort(t, "127.0.0.1")
+	taken, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer taken.Close()
+	config := testQueryConfig()
+	config.ListenAddresses = []net.Addr{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}}
+	config.ListenNetworks = []string{"udp", "tcp"}
+	server, err := StartServer(config, dnstest.Key, testQueryBackend())
+	if err == nil {
+		server.Shutdown(context.Background())
+		t.Fatalf("expected binding an address in use to fail")
+	}
+	if !strings.Contains(err.Error(), "failed to listen on tcp") {
+		t.Errorf("expected the TCP listener reported, got: %v", err)
+	}
+
+	// and the UDP listener bound before it is released
+	conn, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("UDP listener not released: %v", err)
+	}
+	conn.Close()
+}
+
+func TestServerShutdown(t *testing.T) {
+	backend := &blockingBackend{
+		testBackend: testQueryBackend(),
+		entered:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	server, listen := startTestServer(t, backend)
+	if !server.Serving() {
+		t.Fatalf("started server not serving")
+	}
+
+	// hold a query in flight while shutting down
+	answered := make(chan error, 1)
+	go func() {
+		answer, err := lookupA(listen, "foo.west.example.com.")
+		if err == nil && (len(answer) != 1 || answer[0] != "foo.west.example.com. 0 IN A 10.0.0.100") {
+			err = fmt.Errorf("unexpected answer %q", answer)
+		}
+		answered <- err
+	}()
+	<-backend.entered
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned (%v) with a query in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if server.Serving() {
+		t.Errorf("server shutting down still serving")
+	}
+
+	// once released, the query is answered and shutdown completes
+	close(backend.release)
+	if err := <-answered; err != nil {
+		t.Errorf("query in flight not answered: %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("shutdown failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown did not complete once the query was answered")
+	}
+	if server.Serving() {
+		t.Errorf("server serving after shutdown")
+	}
+	if _, err := lookupA(listen, "foo.west.example.com."); err == nil {
+		t.Errorf("query answered after shutdown")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	backend := &blockingBackend{
+		testBackend: testQueryBackend(),
+		entered:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	server, listen := startTestServer(t, backend)
+	defer close(backend.release)
+	go lookupA(listen, "foo.west.example.com.")
+	<-backend.entered
+
+	// a request that does not complete in time is abandoned, reporting the context's error
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the shutdown to time out, got %v", err)
+	}
+}
+
+func TestServersSideBySide(t *testing.T) {
+	// two servers in one process, each with its own backend
+	west, east := testQueryBackend(), testQueryBackend()
+	east.zones["west.example.com."] = []*Mapping{{Name: "foo.west.example.com.", IP: net.ParseIP("10.0.0.200")}}
+	westServer, westListen := startTestServer(t, west)
+	_, eastListen := startTestServer(t, east)
+
+	for listen, expected := range map[*net.UDPAddr]string{
+		westListen: "foo.west.example.com. 0 IN A 10.0.0.100",
+		eastListen: "foo.west.example.com. 0 IN A 10.0.0.200",
+	} {
+		answer, err := lookupA(listen, "foo.west.example.com.")
+		if err != nil {
+			t.Errorf("server on %v failed: %v", listen, err)
+		} else if len(answer) != 1 || answer[0] != expected {
+			t.Errorf("server on %v answered %q, expected %s", listen, answer, expected)
+		}
+	}
+
+	// shutting one down leaves the other serving
+	if err := westServer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unable to shut down: %v", err)
+	}
+	if answer, err := lookupA(eastListen, "foo.west.example.com."); err != nil || len(answer) != 1 {
+		t.Errorf("remaining server failed: %q (%v)", answer, err)
+	}
+}
@@ -0,0 +1,28 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+
+	"fmt"
+	"net"
+	"time"
+)
+
+// ProbeSOA checks that a DNS server is alive by querying it for the SOA record of a zone. Any authenticated reply is
+// taken as proof of life, regardless of its response code.
+func ProbeSOA(dnsServer net.Addr, key *conf.TsigKey, zone string, timeout time.Duration) error {
+	cli := &dns.Client{Timeout: timeout}
+	cli.TsigSecret = map[string]string{key.ZoneName: key.Key}
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
+	reply, _, err := cli.Exchange(msg, dnsServer.String())
+	if err != nil {
+		return err
+	}
+	if reply.IsTsig() == nil {
+		return fmt.Errorf("unsigned reply: %s", dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+
+	"net"
+	"strings"
+)
+
+// maxCNAMEChase bounds how many CNAME records are followed within the zones Hive serves when answering a query.
+const maxCNAMEChase = 8
+
+// isStandardQuery determines whether a request is an ordinary QUERY (i.e. not a zone transfer).
+func isStandardQuery(request *dns.Msg) bool {
+	if request.Opcode != dns.OpcodeQuery || len(request.Question) != 1 {
+		return false
+	}
+	switch request.Question[0].Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		return false
+	}
+	return true
+}
+
+// enclosingZone finds the most specific zone Hive serves that contains a name, or an empty string if there is none.
+func enclosingZone(config *conf.Configuration, backend ZoneBackend, name string) string {
+	enclosing := ""
+	for _, zone := range servedZones(config, backend) {
+		zone = dns.Fqdn(zone)
+		if dns.IsSubDomain(zone, name) && dns.CountLabel(zone) > dns.CountLabel(enclosing) {
+			enclosing = zone
+		}
+	}
+	return enclosing
+}
+
+// zoneRecord finds the record of a name in a zone (as supplied by the backend's Lookup), including the synthesized
+// address of the zone's nameserver.
+func zoneRecord(config *conf.Configuration, backend ZoneBackend, zone, name string) (*Mapping, bool) {
+	if record := backend.Lookup(zone, name); record != nil {
+		return record, true
+	}
+	for _, mapping := range nameserverMappings(config, zone) {
+		// zone records hold a single address per name, so only the first listen address is answered directly
+		if strings.EqualFold(mapping.Name, name) {
+			return mapping, true
+		}
+	}
+	return nil, false
+}
+
+// querierAddress determines the address a query should be answered for: the EDNS Client Subnet address when the query
+// carries one, otherwise the address the query arrived from.
+func querierAddress(w dns.ResponseWriter, request *dns.Msg) (net.IP, *dns.EDNS0_SUBNET) {
+	if opt := request.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return subnet.Address, subnet
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return nil, nil
+	}
+	return net.ParseIP(host), nil
+}
+
+// matchView finds the first configured view with a subnet containing an address.
+func matchView(config *conf.Configuration, address net.IP) (*conf.View, *net.IPNet) {
+	if address == nil {
+		return nil, nil
+	}
+	for _, view := range config.Views {
+		for _, subnet := range view.Subnets {
+			if subnet.Contains(address) {
+				return view, subnet
+			}
+		}
+	}
+	return nil, nil
+}
+
+// viewTarget selects the target of a rendezvous name for a view: the corresponding name in the first preferred site
+// zone holding an address for it. Local zone addresses must be within the local nets, as for the merged zone.
+func viewTarget(config *conf.Configuration, backend ZoneBackend, view *conf.View, name string) string {
+	host := strings.TrimSuffix(strings.ToLower(name), strings.ToLower(dns.Fqdn(config.SearchSuffix)))
+	for _, suffix := range view.Prefer {
+		suffix = dns.Fqdn(suffix)
+		record, present := zoneRecord(config, backend, suffix, host+strings.ToLower(suffix))
+		if !present || record.IP == nil {
+			continue
+		}
+		if strings.EqualFold(suffix, dns.Fqdn(config.LocalZone.Suffix)) {
+			local := false
+			for _, localNet := range config.LocalNets {
+				if localNet.Contains(record.IP) {
+					local = true
+					break
+				}
+			}
+			if !local {
+				continue
+			}
+		}
+		return record.Name
+	}
+	return ""
+}
+
+// answerQuery populates the reply to a standard query with authoritative data from the zones Hive serves. CNAME records
+// are chased while their targets remain inside those zones; otherwise the querier's resolver continues from the CNAME.
+// Rendezvous names are answered according to the view matching the querier, when there is one.
+func answerQuery(msg *dns.Msg, w dns.ResponseWriter, request *dns.Msg, config *conf.Configuration, backend ZoneBackend) {
+	querier, subnet := querierAddress(w, request)
+	view, viewSubnet := matchView(config, querier)
+	scoped := false
+	defer func() {
+		if opt := request.IsEdns0(); opt != nil {
+			msg.SetEdns0(opt.UDPSize(), opt.Do())
+			if subnet != nil {
+				// echo the client subnet, scoped to the view it selected if the answer depended upon one
+				reply := *subnet
+				reply.SourceScope = 0
+				if scoped && viewSubnet != nil {
+					ones, _ := viewSubnet.Mask.Size()
+					reply.SourceScope = uint8(ones)
+				} else if scoped {
+					reply.SourceScope = subnet.SourceNetmask
+				}
+				edns := msg.IsEdns0()
+				edns.Option = append(edns.Option, &reply)
+			}
+		}
+	}()
+
+	question := request.Question[0]
+	zone := enclosingZone(config, backend, question.Name)
+	if question.Qclass != dns.ClassINET || zone == "" {
+		msg.Rcode = dns.RcodeRefused
+		return
+	}
+	msg.Authoritative = true
+
+	name := question.Name
+	for chased := 0; chased <= maxCNAMEChase; chased++ {
+		if strings.EqualFold(name, zone) {
+			// zone apex
+			switch question.Qtype {
+			case dns.TypeSOA:
+				msg.Answer = append(msg.Answer, zoneSOA(config, zone, backend.Serial(zone)))
+			case dns.TypeNS:
+				msg.Answer = append(msg.Answer, &dns.NS{
+					Hdr: dns.RR_Header{
+						Name:   zone,
+						Rrtype: dns.TypeNS,
+						Class:  dns.ClassINET,
+						Ttl:    config.TTL,
+					},
+					Ns: "ns." + zone,
+				})
+				msg.Extra = append(msg.Extra, nameserverGlue(config, zone)...)
+			default:
+				msg.Ns = append(msg.Ns, zoneSOA(config, zone, backend.Serial(zone)))
+			}
+			return
+		}
+
+		record, present := zoneRecord(config, backend, zone, name)
+		if strings.EqualFold(zone, dns.Fqdn(config.SearchSuffix)) && len(config.Views) > 0 {
+			// the answer for a rendezvous name depends on the querier when views are configured
+			scoped = true
+			if view != nil {
+				if target := viewTarget(config, backend, view, name); target != "" {
+					record, present = &Mapping{
+						Name:   name,
+						Target: target,
+					}, true
+				}
+			}
+		}
+		if !present {
+			msg.Rcode = dns.RcodeNameError
+			msg.Ns = append(msg.Ns, zoneSOA(config, zone, backend.Serial(zone)))
+			return
+		}
+		rr := mappingRR(record, config.TTL)
+		rrtype := rr.Header().Rrtype
+		if rrtype == question.Qtype || question.Qtype == dns.TypeANY {
+			msg.Answer = append(msg.Answer, rr)
+			return
+		}
+		if rrtype != dns.TypeCNAME {
+			// the name exists, but holds no data of the requested type
+			msg.Ns = append(msg.Ns, zoneSOA(config, zone, backend.Serial(zone)))
+			return
+		}
+		msg.Answer = append(msg.Answer, rr)
+		name = record.Target
+		if zone = enclosingZone(config, backend, name); zone == "" {
+			return
+		}
+	}
+}
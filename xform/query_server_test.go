@@ -0,0 +1,313 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testBackend serves fixed zones, counting the transfers made of them.
+type testBackend struct {
+	zones     map[string][]*Mapping
+	peers     []*conf.ZonePeer
+	transfers int32
+}
+
+func (b *testBackend) Propose(proposer net.Addr, mapping *Mapping) {}
+
+func (b *testBackend) Delete(proposer net.Addr, rrtype uint16, mapping *Mapping) {}
+
+func (b *testBackend) Serial(zone string) uint32 {
+	return 1
+}
+
+func (b *testBackend) Transfer(zone string) *ZoneSnapshot {
+	atomic.AddInt32(&b.transfers, 1)
+	return &ZoneSnapshot{
+		Serial:   1,
+		Mappings: b.zones[dns.CanonicalName(zone)],
+	}
+}
+
+func (b *testBackend) Lookup(zone, name string) *Mapping {
+	for _, mapping := range b.zones[dns.CanonicalName(zone)] {
+		if strings.EqualFold(mapping.Name, name) {
+			return mapping
+		}
+	}
+	return nil
+}
+
+func (b *testBackend) Records(proposer net.Addr) []*Mapping {
+	return nil
+}
+
+func (b *testBackend) Notify(proposer net.Addr, zone string) {}
+
+func (b *testBackend) Peers() []*conf.ZonePeer {
+	return b.peers
+}
+
+// testWriter captures the reply written to a request from a remote address.
+type testWriter struct {
+	remote net.Addr
+	reply  *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 53}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *testWriter) WriteMsg(msg *dns.Msg) error {
+	w.reply = msg
+	return nil
+}
+
+func (w *testWriter) Write(data []byte) (int, error) {
+	w.reply = &dns.Msg{}
+	return len(data), w.reply.Unpack(data)
+}
+
+func (w *testWriter) Close() error {
+	return nil
+}
+
+func (w *testWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *testWriter) TsigTimersOnly(bool) {}
+
+func (w *testWriter) Hijack() {}
+
+func testQueryConfig() *conf.Configuration {
+	return &conf.Configuration{
+		LocalZone: &conf.ZonePeer{
+			Suffix: "west.example.com.",
+			Server: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53},
+		},
+		SearchSuffix:    "rdvu.example.com.",
+		TTL:             300,
+		ListenAddresses: []net.Addr{&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 53}},
+		AnswerQueries:   true,
+	}
+}
+
+func testQueryBackend() *testBackend {
+	return &testBackend{
+		zones: map[string][]*Mapping{
+			"west.example.com.": {
+				{Name: "foo.west.example.com.", IP: net.ParseIP("10.0.0.100")},
+				{Name: "bar.west.example.com.", IP: net.ParseIP("fd00::100")},
+				{Name: "alias.west.example.com.", Target: "foo.west.example.com."},
+				{Name: "outside.west.example.com.", Target: "www.example.org."},
+			},
+			"east.example.com.": {
+				{Name: "foo.east.example.com.", IP: net.ParseIP("10.1.0.103")},
+			},
+			"rdvu.example.com.": {
+				{Name: "foo.rdvu.example.com.", Target: "foo.west.example.com."},
+				{Name: "bar.rdvu.example.com.", Target: "bar.west.example.com."},
+			},
+		},
+		peers: []*conf.ZonePeer{{
+			Suffix: "east.example.com.",
+			Server: &net.UDPAddr{IP: net.ParseIP("10.1.0.2"), Port: 53},
+		}},
+	}
+}
+
+// query answers a standard query as the peer server would, from a querier address.
+func query(config *conf.Configuration, backend ZoneBackend, querier string, request *dns.Msg) *dns.Msg {
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(querier), Port: 5353}}
+	msg := &dns.Msg{}
+	msg.SetReply(request)
+	answerQuery(msg, w, request, config, backend)
+	return msg
+}
+
+// answers renders the records of a section in zone file format, without TTLs.
+func answers(rrs []dns.RR) []string {
+	var rendered []string
+	for _, rr := range rrs {
+		rr.Header().Ttl = 0
+		rendered = append(rendered, strings.ReplaceAll(rr.String(), "\t", " "))
+	}
+	return rendered
+}
+
+func TestAnswerQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		rcode     int
+		answer    []string
+		authority int
+	}{
+		{"address", "FOO.west.example.com.", dns.TypeA, dns.RcodeSuccess,
+			[]string{"foo.west.example.com. 0 IN A 10.0.0.100"}, 0},
+		{"ipv6 address", "bar.west.example.com.", dns.TypeAAAA, dns.RcodeSuccess,
+			[]string{"bar.west.example.com. 0 IN AAAA fd00::100"}, 0},
+		{"no data", "foo.west.example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil, 1},
+		{"nonexistent name", "qux.west.example.com.", dns.TypeA, dns.RcodeNameError, nil, 1},
+		{"cname chased", "foo.rdvu.example.com.", dns.TypeA, dns.RcodeSuccess, []string{
+			"foo.rdvu.example.com. 0 IN CNAME foo.west.example.com.",
+			"foo.west.example.com. 0 IN A 10.0.0.100",
+		}, 0},
+		{"cname leaving the served zones", "outside.west.example.com.", dns.TypeA, dns.RcodeSuccess,
+			[]string{"outside.west.example.com. 0 IN CNAME www.example.org."}, 0},
+		{"cname queried", "alias.west.example.com.", dns.TypeCNAME, dns.RcodeSuccess,
+			[]string{"alias.west.example.com. 0 IN CNAME foo.west.example.com."}, 0},
+		{"peer zone", "foo.east.example.com.", dns.TypeA, dns.RcodeSuccess,
+			[]string{"foo.east.example.com. 0 IN A 10.1.0.103"}, 0},
+		{"nameserver", "ns.rdvu.example.com.", dns.TypeA, dns.RcodeSuccess,
+			[]string{"ns.rdvu.example.com. 0 IN A 10.0.0.2"}, 0},
+		{"apex nameserver", "rdvu.example.com.", dns.TypeNS, dns.RcodeSuccess,
+			[]string{"rdvu.example.com. 0 IN NS ns.rdvu.example.com."}, 0},
+		{"apex no data", "rdvu.example.com.", dns.TypeA, dns.RcodeSuccess, nil, 1},
+		{"zone not served", "foo.example.org.", dns.TypeA, dns.RcodeRefused, nil, 0},
+	}
+	config := testQueryConfig()
+	backend := testQueryBackend()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &dns.Msg{}
+			request.SetQuestion(test.qname, test.qtype)
+			reply := query(config, backend, "10.0.0.50", request)
+			if reply.Rcode != test.rcode {
+				t.Fatalf("expected %s, got %s", dns.RcodeToString[test.rcode], dns.RcodeToString[reply.Rcode])
+			}
+			if got := answers(reply.Answer); strings.Join(got, "\n") != strings.Join(test.answer, "\n") {
+				t.Errorf("expected answer %q, got %q", test.answer, got)
+			}
+			if len(reply.Ns) != test.authority {
+				t.Errorf("expected %d authority records, got %d", test.authority, len(reply.Ns))
+			}
+		})
+	}
+	if transfers := atomic.LoadInt32(&backend.transfers); transfers != 0 {
+		t.Errorf("answering queries transferred zones %d times", transfers)
+	}
+}
+
+func testViewConfig() *conf.Configuration {
+	config := testQueryConfig()
+	_, westNet, _ := net.ParseCIDR("10.0.0.0/16")
+	_, eastNet, _ := net.ParseCIDR("10.1.0.0/16")
+	config.LocalNets = []*net.IPNet{westNet}
+	config.Views = []*conf.View{
+		{Name: "west", Subnets: []*net.IPNet{westNet}, Prefer: []string{"west.example.com.", "east.example.com."}},
+		{Name: "east", Subnets: []*net.IPNet{eastNet}, Prefer: []string{"east.example.com.", "west.example.com."}},
+	}
+	return config
+}
+
+func TestAnswerQueryViews(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		querier string
+		target  string
+	}{
+		{"west querier", "foo.rdvu.example.com.", "10.0.0.50", "foo.west.example.com."},
+		{"east querier", "foo.rdvu.example.com.", "10.1.0.50", "foo.east.example.com."},
+		// bar is only held by the west site, at an address outside its local nets, so no view selects it
+		{"east querier without a preferred site", "bar.rdvu.example.com.", "10.1.0.50", "bar.west.example.com."},
+		{"querier without a view", "foo.rdvu.example.com.", "192.168.1.1", "foo.west.example.com."},
+	}
+	config := testViewConfig()
+	backend := testQueryBackend()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &dns.Msg{}
+			request.SetQuestion(test.qname, dns.TypeCNAME)
+			reply := query(config, backend, test.querier, request)
+			if len(reply.Answer) != 1 {
+				t.Fatalf("expected one answer, got %q", answers(reply.Answer))
+			}
+			if cname, ok := reply.Answer[0].(*dns.CNAME); !ok || cname.Target != test.target {
+				t.Errorf("expected CNAME to %s, got %q", test.target, answers(reply.Answer))
+			}
+		})
+	}
+}
+
+func TestAnswerQueryClientSubnet(t *testing.T) {
+	tests := []struct {
+		name    string
+		qname   string
+		querier string
+		subnet  string // the client subnet carried by the query, if any
+		target  string
+		scope   uint8
+	}{
+		{"client subnet selects a view", "foo.rdvu.example.com.", "10.0.0.50", "10.1.0.0/24",
+			"foo.east.example.com.", 16},
+		{"client subnet without a view", "foo.rdvu.example.com.", "10.1.0.50", "192.168.1.0/24",
+			"foo.west.example.com.", 24},
+		{"name outside the rendezvous zone", "foo.east.example.com.", "10.0.0.50", "10.1.0.0/24", "", 0},
+		{"querier address selects a view", "foo.rdvu.example.com.", "10.1.0.50", "", "foo.east.example.com.", 0},
+	}
+	config := testViewConfig()
+	backend := testQueryBackend()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &dns.Msg{}
+			request.SetQuestion(test.qname, dns.TypeCNAME)
+			request.SetEdns0(1232, false)
+			var subnet *net.IPNet
+			if test.subnet != "" {
+				_, subnet, _ = net.ParseCIDR(test.subnet)
+				ones, _ := subnet.Mask.Size()
+				opt := request.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        1,
+					SourceNetmask: uint8(ones),
+					Address:       subnet.IP,
+				})
+			}
+			reply := query(config, backend, test.querier, request)
+			if test.target != "" {
+				if len(reply.Answer) != 1 || reply.Answer[0].(*dns.CNAME).Target != test.target {
+					t.Errorf("expected CNAME to %s, got %q", test.target, answers(reply.Answer))
+				}
+			}
+
+			opt := reply.IsEdns0()
+			if opt == nil {
+				t.Fatalf("reply to a query with EDNS has no OPT record")
+			}
+			var echoed *dns.EDNS0_SUBNET
+			for _, option := range opt.Option {
+				if option, ok := option.(*dns.EDNS0_SUBNET); ok {
+					echoed = option
+				}
+			}
+			if subnet == nil {
+				if echoed != nil {
+					t.Errorf("reply carries a client subnet the query did not: %v", echoed)
+				}
+				return
+			}
+			if echoed == nil {
+				t.Fatalf("reply does not echo the client subnet")
+			}
+			if !echoed.Address.Equal(subnet.IP) {
+				t.Errorf("expected client subnet address %v, got %v", subnet.IP, echoed.Address)
+			}
+			if echoed.SourceScope != test.scope {
+				t.Errorf("expected scope /%d, got /%d", test.scope, echoed.SourceScope)
+			}
+		})
+	}
+}
@@ -2,61 +2,53 @@ package xform
 
 import (
 	"github.com/miekg/dns"
-	"github.com/thyth/hive/conf"
 
-	"net"
-	"time"
+	"fmt"
 )
 
-func WriteUpdate(dnsServer net.Addr, ttl uint32, key *conf.TsigKey, mapping *Mapping, zone string) error {
+// UpdateRecord provides the record Writer.WriteUpdate would send in its update section to add a mapping to a zone (or
+// remove the CNAME record of its name), in presentation format.
+func UpdateRecord(ttl uint32, mapping *Mapping, zone string) string {
+	return updateMsg(ttl, mapping, zone).Ns[0].String()
+}
+
+// DeletionRecord provides the record Writer.WriteDeletion would send in its update section to remove the records of a
+// name from a zone, in presentation format.
+func DeletionRecord(rrtype uint16, name string, zone string) string {
+	return deletionMsg(rrtype, name, zone).Ns[0].String()
+}
+
+// updateMsg builds an update adding a mapping to a zone, or removing the CNAME record of its name if it holds neither an
+// address nor a target.
+func updateMsg(ttl uint32, mapping *Mapping, zone string) *dns.Msg {
 	msg := &dns.Msg{}
-	msg.Opcode = dns.OpcodeUpdate
-	msg.SetQuestion(zone, dns.TypeSOA)
-	var rr dns.RR
-	class := uint16(dns.ClassINET)
+	msg.SetUpdate(zone)
+	rr := mappingRR(mapping, ttl)
 	if mapping.IP == nil && mapping.Target == "" {
-		class = uint16(dns.ClassANY)
-		ttl = 0
-	}
-	if mapping.IP != nil {
-		if len(mapping.IP) == net.IPv4len {
-			rr = &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   mapping.Name,
-					Rrtype: dns.TypeA,
-					Class:  class,
-					Ttl:    ttl,
-				},
-				A: mapping.IP,
-			}
-		} else {
-			rr = &dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   mapping.Name,
-					Rrtype: dns.TypeAAAA,
-					Class:  class,
-					Ttl:    ttl,
-				},
-				AAAA: mapping.IP,
-			}
-		}
-	} else {
-		rr = &dns.CNAME{
-			Hdr: dns.RR_Header{
-				Name:   mapping.Name,
-				Rrtype: dns.TypeCNAME,
-				Class:  class,
-				Ttl:    ttl,
-			},
-			Target: mapping.Target,
-		}
+		rr.Header().Class = dns.ClassANY
+		rr.Header().Ttl = 0
 	}
 	msg.Ns = []dns.RR{rr}
+	return msg
+}
 
-	cli := &dns.Client{}
-	cli.TsigSecret = map[string]string{key.ZoneName: key.Key}
-	msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
-	_, _, err := cli.Exchange(msg, dnsServer.String()+":53")
-	// read success status from reply?
-	return err
+func deletionMsg(rrtype uint16, name string, zone string) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetUpdate(zone)
+	msg.Ns = []dns.RR{&dns.ANY{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: rrtype,
+			Class:  dns.ClassANY,
+		},
+	}}
+	return msg
+}
+
+// replyError reports an update the server did not apply.
+func replyError(reply *dns.Msg) error {
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update rejected: %s", dns.RcodeToString[reply.Rcode])
+	}
+	return nil
 }
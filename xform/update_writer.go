@@ -0,0 +1,224 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/conf"
+
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// writeAttempts bounds how many times an update is sent before giving up on it
+	writeAttempts = 4
+	// writeBackoff is the delay before the first retry of an update, doubling for each subsequent retry
+	writeBackoff = 250 * time.Millisecond
+	// defaultWriteTimeout is how long a reply is awaited when no timeout is given
+	defaultWriteTimeout = 5 * time.Second
+)
+
+// ErrWriterClosed is returned for updates sent through (or still awaiting a reply from) a closed Writer.
+var ErrWriterClosed = errors.New("writer closed")
+
+// Writer sends RFC2136 updates to a DNS server over a persistent TCP connection, which is reestablished as required.
+// Updates from concurrent callers are pipelined on the connection (up to a bounded number awaiting replies at once) and
+// matched to their replies by message ID. Updates that time out, or whose connection fails, are retried with
+// exponential backoff; updates the server rejects are not.
+type Writer struct {
+	server  net.Addr
+	key     *conf.TsigKey
+	timeout time.Duration
+	slots   chan struct{}
+
+	mutex   sync.Mutex
+	conn    *dns.Conn
+	waiting map[uint16]chan *writeReply // updates sent on conn awaiting replies, by message ID
+	closed  bool
+}
+
+type writeReply struct {
+	msg *dns.Msg
+	raw []byte // the reply as received, over which its TSIG is verified
+	err error
+}
+
+// NewWriter prepares a Writer for a DNS server, authenticating with a TSIG key. The connection is established by the
+// first update. Unset (zero) concurrency or timeout values are replaced with one update and defaultWriteTimeout.
+func NewWriter(dnsServer net.Addr, key *conf.TsigKey, concurrency int, timeout time.Duration) *Writer {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+	return &Writer{
+		server:  dnsServer,
+		key:     key,
+		timeout: timeout,
+		slots:   make(chan struct{}, concurrency),
+		waiting: map[uint16]chan *writeReply{},
+	}
+}
+
+// WriteUpdate adds a mapping to a zone, or removes the CNAME record of its name if it holds neither an address nor a
+// target.
+func (w *Writer) WriteUpdate(ttl uint32, mapping *Mapping, zone string) error {
+	return w.write(updateMsg(ttl, mapping, zone))
+}
+
+// WriteDeletion removes the records of a name from a zone: all of them for dns.TypeANY, otherwise those of one type.
+func (w *Writer) WriteDeletion(rrtype uint16, name string, zone string) error {
+	return w.write(deletionMsg(rrtype, name, zone))
+}
+
+// Close closes the connection, failing any updates awaiting replies.
+func (w *Writer) Close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = true
+	if w.conn != nil {
+		w.reset(w.conn, ErrWriterClosed)
+	}
+}
+
+func (w *Writer) write(msg *dns.Msg) error {
+	w.slots <- struct{}{}
+	defer func() { <-w.slots }()
+
+	var err error
+	for attempt := 0; attempt < writeAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(writeBackoff << (attempt - 1))
+		}
+		var reply *dns.Msg
+		var retry bool
+		reply, retry, err = w.exchange(msg)
+		if err == nil {
+			recordWrite(msg, reply, nil)
+			return replyError(reply)
+		} else if !retry {
+			recordWrite(msg, nil, err)
+			return err
+		}
+	}
+	recordWrite(msg, nil, err)
+	return fmt.Errorf("no reply after %d attempts: %v", writeAttempts, err)
+}
+
+// exchange sends an update once, and waits for its reply. Errors are reported as retryable unless the update could not
+// have been applied, or the reply could not be trusted.
+func (w *Writer) exchange(msg *dns.Msg) (*dns.Msg, bool, error) {
+	request := msg.Copy()
+	replies := make(chan *writeReply, 1)
+
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return nil, false, ErrWriterClosed
+	}
+	conn, err := w.connect()
+	if err != nil {
+		w.mutex.Unlock()
+		return nil, true, err
+	}
+	request.Id = dns.Id()
+	for w.waiting[request.Id] != nil {
+		request.Id = dns.Id()
+	}
+	request.SetTsig(w.key.ZoneName, w.key.Algorithm, 300, time.Now().Unix())
+	packed, mac, err := dns.TsigGenerate(request, w.key.Key, "", false)
+	if err != nil {
+		w.mutex.Unlock()
+		return nil, false, err
+	}
+	w.waiting[request.Id] = replies
+	conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	if _, err := conn.Write(packed); err != nil {
+		w.reset(conn, err)
+		w.mutex.Unlock()
+		return nil, true, err
+	}
+	w.mutex.Unlock()
+
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-replies:
+		if reply.err != nil {
+			return nil, reply.err != ErrWriterClosed, reply.err
+		}
+		if reply.msg.IsTsig() == nil {
+			return nil, false, fmt.Errorf("unsigned reply: %s", dns.RcodeToString[reply.msg.Rcode])
+		}
+		if err := dns.TsigVerify(reply.raw, w.key.Key, mac, false); err != nil {
+			return nil, false, fmt.Errorf("reply signature invalid: %v", err)
+		}
+		return reply.msg, false, nil
+	case <-timer.C:
+		// the connection may be silently broken (e.g. by a stateful firewall), so abandon it for a fresh one
+		err := fmt.Errorf("timed out after %v", w.timeout)
+		w.mutex.Lock()
+		if w.waiting[request.Id] == replies {
+			delete(w.waiting, request.Id)
+		}
+		w.reset(conn, err)
+		w.mutex.Unlock()
+		return nil, true, err
+	}
+}
+
+// connect returns the connection to the server, dialing it if not connected. The caller must hold the mutex.
+func (w *Writer) connect() (*dns.Conn, error) {
+	if w.conn != nil {
+		return w.conn, nil
+	}
+	conn, err := dns.DialTimeout("tcp", w.server.String(), w.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %v: %v", w.server, err)
+	}
+	w.conn = conn
+	go w.read(conn)
+	return conn, nil
+}
+
+// reset closes a connection if it is still current, failing the updates awaiting replies on it. The caller must hold
+// the mutex.
+func (w *Writer) reset(conn *dns.Conn, err error) {
+	if w.conn != conn {
+		return
+	}
+	conn.Close()
+	w.conn = nil
+	for id, replies := range w.waiting {
+		replies <- &writeReply{err: err}
+		delete(w.waiting, id)
+	}
+}
+
+// read delivers the replies received on a connection to the updates awaiting them, until the connection fails.
+func (w *Writer) read(conn *dns.Conn) {
+	for {
+		raw, err := conn.ReadMsgHeader(nil)
+		if err != nil {
+			w.mutex.Lock()
+			w.reset(conn, fmt.Errorf("connection to %v lost: %v", w.server, err))
+			w.mutex.Unlock()
+			return
+		}
+		reply := &dns.Msg{}
+		if err := reply.Unpack(raw); err != nil {
+			// without a message ID, the reply cannot be delivered; its update will time out and be retried
+			continue
+		}
+		w.mutex.Lock()
+		replies := w.waiting[reply.Id]
+		delete(w.waiting, reply.Id)
+		w.mutex.Unlock()
+		if replies != nil {
+			replies <- &writeReply{msg: reply, raw: raw}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package xform
+
+import (
+	"github.com/miekg/dns"
+	"github.com/thyth/hive/internal/dnstest"
+
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rawPrimary accepts TCP connections, handing each to a function serving it, and counts the connections accepted.
+type rawPrimary struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	accepted int
+}
+
+func newRawPrimary(t *testing.T, serve func(conn *dns.Conn)) *rawPrimary {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	p := &rawPrimary{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			p.mutex.Lock()
+			p.accepted++
+			p.mutex.Unlock()
+			go func() {
+				defer conn.Close()
+				serve(&dns.Conn{Conn: conn})
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return p
+}
+
+func (p *rawPrimary) connections() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.accepted
+}
+
+// readUpdate reads an update from a connection, without verifying its signature.
+func readUpdate(conn *dns.Conn) (*dns.Msg, error) {
+	raw, err := conn.ReadMsgHeader(nil)
+	if err != nil {
+		return nil, err
+	}
+	request := &dns.Msg{}
+	return request, request.Unpack(raw)
+}
+
+// replyUpdate replies to an update with an rcode, signed with a secret (or unsigned, if empty).
+func replyUpdate(conn *dns.Conn, request *dns.Msg, rcode int, secret string) error {
+	reply := &dns.Msg{}
+	reply.SetRcode(request, rcode)
+	if secret == "" {
+		packed, err := reply.Pack()
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(packed)
+		return err
+	}
+	reply.SetTsig(dnstest.Key.ZoneName, dnstest.Key.Algorithm, 300, time.Now().Unix())
+	packed, _, err := dns.TsigGenerate(reply, secret, request.IsTsig().MAC, false)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(packed)
+	return err
+}
+
+func testMapping(host int) *Mapping {
+	return &Mapping{
+		Name:   fmt.Sprintf("host%d.rdvu.example.com.", host),
+		Target: fmt.Sprintf("host%d.west.example.com.", host),
+	}
+}
+
+func TestWriterPipelining(t *testing.T) {
+	const concurrency = 4
+	primary := newRawPrimary(t, func(conn *dns.Conn) {
+		// reply only once every update has arrived on this connection, in reverse order
+		var requests []*dns.Msg
+		for len(requests) < concurrency {
+			request, err := readUpdate(conn)
+			if err != nil {
+				return
+			}
+			requests = append(requests, request)
+		}
+		for idx := len(requests) - 1; idx >= 0; idx-- {
+			replyUpdate(conn, requests[idx], dns.RcodeSuccess, dnstest.Key.Key)
+		}
+	})
+
+	writer := NewWriter(primary.listener.Addr(), dnstest.Key, concurrency, 5*time.Second)
+	defer writer.Close()
+	var wg sync.WaitGroup
+	for host := 0; host < concurrency; host++ {
+		wg.Add(1)
+		go func(host int) {
+			defer wg.Done()
+			if err := writer.WriteUpdate(300, testMapping(host), "rdvu.example.com."); err != nil {
+				t.Errorf("update %d failed: %v", host, err)
+			}
+		}(host)
+	}
+	wg.Wait()
+	if connections := primary.connections(); connections != 1 {
+		t.Errorf("expected updates pipelined on one connection, got %d connections", connections)
+	}
+}
+
+func TestWriterReconnect(t *testing.T) {
+	primary := dnstest.NewServer(t, "127.0.0.1")
+	primary.AddZone("rdvu.example.com.")
+	writer := NewWriter(primary.Addr, dnstest.Key, 2, time.Second)
+	defer writer.Close()
+
+	if err := writer.WriteUpdate(300, testMapping(1), "rdvu.example.com."); err != nil {
+		t.Fatalf("first update failed: %v", err)
+	}
+	// the connection is closed by the server restarting; the next update reconnects
+	primary.Restart()
+	if err := writer.WriteUpdate(300, testMapping(2), "rdvu.example.com."); err != nil {
+		t.Fatalf("update after reconnecting failed: %v", err)
+	}
+	if err := writer.WriteDeletion(dns.TypeANY, testMapping(1).Name, "rdvu.example.com."); err != nil {
+		t.Fatalf("deletion failed: %v", err)
+	}
+	expected := []string{"host2.rdvu.example.com. 0 IN CNAME host2.west.example.com."}
+	if records := primary.Records("rdvu.example.com."); strings.Join(records, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected records %q, got %q", expected, records)
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    func(conn *dns.Conn, request *dns.Msg) // nil to never reply
+		err      string
+		attempts int
+	}{
+		{"rejected", func(conn *dns.Conn, request *dns.Msg) {
+			replyUpdate(conn, request, dns.RcodeRefused, dnstest.Key.Key)
+		}, "update rejected: REFUSED", 1},
+		{"unsigned", func(conn *dns.Conn, request *dns.Msg) {
+			replyUpdate(conn, request, dns.RcodeNotAuth, "")
+		}, "unsigned reply: NOTAUTH", 1},
+		{"signed with another key", func(conn *dns.Conn, request *dns.Msg) {
+			replyUpdate(conn, request, dns.RcodeSuccess, "b3RoZXJvdGhlcm90aGVyb3RoZXI=")
+		}, "reply signature invalid", 1},
+		{"no reply", nil, fmt.Sprintf("no reply after %d attempts", writeAttempts), writeAttempts},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			attempts := 0
+			primary := newRawPrimary(t, func(conn *dns.Conn) {
+				for {
+					request, err := readUpdate(conn)
+					if err != nil {
+						return
+					}
+					mutex.Lock()
+					attempts++
+					mutex.Unlock()
+					if test.reply != nil {
+						test.reply(conn, request)
+					}
+				}
+			})
+			writer := NewWriter(primary.listener.Addr(), dnstest.Key, 1, 50*time.Millisecond)
+			defer writer.Close()
+			err := writer.WriteUpdate(300, testMapping(1), "rdvu.example.com.")
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing '%s', got %v", test.err, err)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if attempts != test.attempts {
+				t.Errorf("expected %d attempts, got %d", test.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	primary := dnstest.NewServer(t, "127.0.0.1")
+	primary.AddZone("rdvu.example.com.")
+	writer := NewWriter(primary.Addr, dnstest.Key, 1, time.Second)
+	writer.Close()
+	if err := writer.WriteUpdate(300, testMapping(1), "rdvu.example.com."); err != ErrWriterClosed {
+		t.Errorf("expected %v, got %v", ErrWriterClosed, err)
+	}
+	if updates := primary.Updates(); len(updates) != 0 {
+		t.Errorf("closed writer sent %d updates", len(updates))
+	}
+}
@@ -5,23 +5,57 @@ import (
 	"github.com/thyth/hive/conf"
 
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
 
-var (
-	SigilDeleteIP = net.IPv4(0, 0, 0, 0)
-)
-
+// Zone holds the A/AAAA and CNAME records of a zone. Its lock guards the record maps and version: writers must hold the
+// write lock, and increment the version with each change they make, so that readers holding the read lock always
+// observe a consistent version of the zone.
 type Zone struct {
-	sync.Mutex
+	sync.RWMutex
 	Server       net.Addr
 	ARecords     map[string]net.IP
 	CNAMERecords map[string]string
+	Version      uint32
+}
+
+// ZoneSnapshot is a consistent copy of the records of a zone, together with the SOA serial of that version.
+type ZoneSnapshot struct {
+	Serial   uint32
+	Mappings []*Mapping
+}
+
+// ZoneMappings copies the records of a zone, returning them with the version they were copied from.
+func ZoneMappings(zone *Zone) (uint32, []*Mapping) {
+	zone.RLock()
+	defer zone.RUnlock()
+	mappings := make([]*Mapping, 0, len(zone.CNAMERecords)+len(zone.ARecords))
+	for name, target := range zone.CNAMERecords {
+		mappings = append(mappings, &Mapping{
+			Name:   name,
+			Target: target,
+		})
+	}
+	for name, address := range zone.ARecords {
+		mappings = append(mappings, &Mapping{
+			Name: name,
+			IP:   address,
+		})
+	}
+	return zone.Version, mappings
 }
 
 // ReadZoneEntries will zone transfer and look at A and AAAA records.
 func ReadZoneEntries(dnsServer net.Addr, key *conf.TsigKey, zone string) (*Zone, error) {
+	started := time.Now()
+	transferred, err := readZoneEntries(dnsServer, key, zone)
+	recordTransfer(zone, started, transferred, err)
+	return transferred, err
+}
+
+func readZoneEntries(dnsServer net.Addr, key *conf.TsigKey, zone string) (*Zone, error) {
 	axfr := &dns.Transfer{
 		TsigSecret: map[string]string{
 			key.ZoneName: key.Key,
@@ -30,7 +64,7 @@ func ReadZoneEntries(dnsServer net.Addr, key *conf.TsigKey, zone string) (*Zone,
 	msg := &dns.Msg{}
 	msg.SetAxfr(zone)
 	msg.SetTsig(key.ZoneName, key.Algorithm, 300, time.Now().Unix())
-	envelopes, err := axfr.In(msg, dnsServer.String()+":53")
+	envelopes, err := axfr.In(msg, dnsServer.String())
 	if err != nil {
 		return nil, err
 	}
@@ -42,13 +76,15 @@ func ReadZoneEntries(dnsServer net.Addr, key *conf.TsigKey, zone string) (*Zone,
 		}
 		records := envelope.RR
 		for _, record := range records {
+			// names are case insensitive, so are recorded in lower case
+			name := strings.ToLower(record.Header().Name)
 			switch record := record.(type) {
 			case *dns.A:
-				aRecords[record.Hdr.Name] = record.A
+				aRecords[name] = record.A
 			case *dns.AAAA:
-				aRecords[record.Hdr.Name] = record.AAAA
+				aRecords[name] = record.AAAA
 			case *dns.CNAME:
-				cnameRecords[record.Hdr.Name] = record.Target
+				cnameRecords[name] = record.Target
 			}
 		}
 	}
@@ -58,94 +94,3 @@ func ReadZoneEntries(dnsServer net.Addr, key *conf.TsigKey, zone string) (*Zone,
 		CNAMERecords: cnameRecords,
 	}, nil
 }
-
-// MergeZones takes a canonical (i.e. local) zone and supplements it with suggestions that are not yet present in the
-// canonical zone. Intended to be applied with suggestions from highest to lowest priority.
-func MergeZones(canonical, suggested *Zone) *Zone {
-	merged := &Zone{
-		Server:       canonical.Server,
-		ARecords:     map[string]net.IP{},
-		CNAMERecords: map[string]string{},
-	}
-
-	// copy in canonical A and CNAME record maps
-	canonical.Lock()
-	for name, target := range canonical.ARecords {
-		merged.ARecords[name] = target
-	}
-	for name, target := range canonical.CNAMERecords {
-		merged.CNAMERecords[name] = target
-	}
-	canonical.Unlock()
-
-	// iterate over suggested A and CNAME record maps and record only new values
-	suggested.Lock()
-	for name, target := range suggested.ARecords {
-		if _, present := merged.ARecords[name]; !present {
-			merged.ARecords[name] = target
-		}
-	}
-	for name, target := range suggested.CNAMERecords {
-		if _, present := merged.CNAMERecords[name]; !present {
-			merged.CNAMERecords[name] = target
-		}
-	}
-	suggested.Unlock()
-
-	return merged
-}
-
-// Produce a pseudo-Zone as a set of operations required to transform Zone to another. Deletions are signified by the
-// presence of records that target either the sigil 0.0.0.0 IP (for A/AAAA records) or an empty string CNAME.
-func DiffZones(canonical, comparison *Zone) *Zone {
-	diff := &Zone{
-		Server:       canonical.Server,
-		ARecords:     map[string]net.IP{},
-		CNAMERecords: map[string]string{},
-	}
-
-	canonical.Lock()
-	comparison.Lock()
-
-	// iterate over canonical map keys first
-	for name, target := range canonical.ARecords {
-		comparisonTarget, present := comparison.ARecords[name]
-		if !present {
-			// insert a deletion record
-			diff.ARecords[name] = SigilDeleteIP
-		} else if !target.Equal(comparisonTarget) {
-			// insert a change record
-			diff.ARecords[name] = comparisonTarget
-		}
-	}
-	for name, target := range canonical.CNAMERecords {
-		comparisonTarget, present := comparison.CNAMERecords[name]
-		if !present {
-			// insert a deletion record
-			diff.CNAMERecords[name] = ""
-		} else if target != comparisonTarget {
-			// insert a change record
-			diff.CNAMERecords[name] = comparisonTarget
-		}
-	}
-	// iterate over comparison map keys to detect any additions
-	for name, target := range comparison.ARecords {
-		_, present := canonical.ARecords[name]
-		if !present {
-			// insert an addition record
-			diff.ARecords[name] = target
-		}
-	}
-	for name, target := range comparison.CNAMERecords {
-		_, present := canonical.CNAMERecords[name]
-		if !present {
-			// insert an addition record
-			diff.CNAMERecords[name] = target
-		}
-	}
-
-	canonical.Unlock()
-	comparison.Unlock()
-
-	return diff
-}